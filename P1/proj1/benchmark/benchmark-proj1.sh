@@ -17,7 +17,6 @@
 
 module load golang/1.19
 
-# run python all go files through python to produce graph with results  
-python slice_plot.py
-python parfiles_plot.py
+# sweep the parallel modes and write results.csv and the speedup charts (results-<mode>.svg)
+go run . -dirs small,mixture,big -modes parfiles,parslices -threads 1,2,4,6,8,12 -runs 5
 
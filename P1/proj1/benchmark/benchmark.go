@@ -0,0 +1,214 @@
+/*
+Benchmark harness for the editor, replacing benchmark-proj1.sh and the plotting scripts.
+Run it from the benchmark directory, which reads ../data like the editor:
+
+	go run . -dirs small,mixture,big -modes parfiles,parslices -threads 1,2,4,6,8,12 -runs 5
+
+Every data directory is first processed sequentially (mode s), the baseline of the
+speedups, then with every mode and thread count. Each configuration runs -runs times
+in this process; the cache manifest is bypassed so every run processes every image.
+The results are written to <out>.csv (mean and standard deviation of the runtimes and
+the speedup against s) and to one chart per mode, <out>-<mode>.svg.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"proj1/scheduler"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// baselineMode is the mode the speedups are computed against
+const baselineMode = "s"
+
+// parallelModes are the modes that take a thread count
+var parallelModes = map[string]bool{"parfiles": true, "parslices": true, "stream": true}
+
+// measurement holds the runtimes of one configuration, in seconds
+type measurement struct {
+	dir     string
+	mode    string
+	threads int
+	times   []float64
+}
+
+// mean returns the mean runtime
+func (m *measurement) mean() float64 {
+	sum := 0.0
+	for _, t := range m.times {
+		sum += t
+	}
+	return sum / float64(len(m.times))
+}
+
+// stddev returns the sample standard deviation of the runtimes (0 for a single run)
+func (m *measurement) stddev() float64 {
+	if len(m.times) < 2 {
+		return 0
+	}
+	mean := m.mean()
+	sum := 0.0
+	for _, t := range m.times {
+		sum += (t - mean) * (t - mean)
+	}
+	return math.Sqrt(sum / float64(len(m.times)-1))
+}
+
+func main() {
+	dirs := flag.String("dirs", "small,mixture,big", "comma-separated data directories")
+	modes := flag.String("modes", "parfiles,parslices", "comma-separated parallel modes (parfiles, parslices, stream)")
+	threads := flag.String("threads", "1,2,4,6,8,12", "comma-separated thread counts")
+	runs := flag.Int("runs", 5, "runs of every configuration")
+	out := flag.String("out", "results", "prefix of the CSV and SVG files")
+	flag.Parse()
+
+	threadCounts, err := parseThreads(*threads)
+	if err != nil || *runs < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid thread counts %q or runs %d\n", *threads, *runs)
+		os.Exit(2)
+	}
+	modeList := strings.Split(*modes, ",")
+	for _, mode := range modeList {
+		if !parallelModes[mode] {
+			fmt.Fprintf(os.Stderr, "Unknown parallel mode %q\n", mode)
+			os.Exit(2)
+		}
+	}
+
+	results := sweep(strings.Split(*dirs, ","), modeList, threadCounts, *runs)
+	if err := writeCSV(*out+".csv", results); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s.csv: %v\n", *out, err)
+		os.Exit(1)
+	}
+	for _, mode := range modeList {
+		path := fmt.Sprintf("%s-%s.svg", *out, mode)
+		if err := writeChart(path, mode, threadCounts, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// parseThreads parses a comma-separated list of positive thread counts
+func parseThreads(list string) ([]int, error) {
+	var counts []int
+	for _, field := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid thread count %q", field)
+		}
+		counts = append(counts, n)
+	}
+	return counts, nil
+}
+
+// sweep measures the baseline and every mode and thread count of every data directory
+func sweep(dirs, modes []string, threadCounts []int, runs int) []*measurement {
+	var results []*measurement
+	for _, dir := range dirs {
+		baseline := measure(scheduler.Config{DataDirs: dir, Mode: baselineMode}, runs)
+		results = append(results, baseline)
+		for _, mode := range modes {
+			for _, threads := range threadCounts {
+				m := measure(scheduler.Config{DataDirs: dir, Mode: mode, ThreadCount: threads}, runs)
+				results = append(results, m)
+				fmt.Printf("%s %s %d threads: %.2fs ± %.2fs, speedup %.2f\n",
+					dir, mode, threads, m.mean(), m.stddev(), baseline.mean()/m.mean())
+			}
+		}
+	}
+	return results
+}
+
+// measure runs a configuration runs times and records the runtimes
+func measure(config scheduler.Config, runs int) *measurement {
+	config.Force = true
+	m := &measurement{dir: config.DataDirs, mode: config.Mode, threads: max(1, config.ThreadCount)}
+	for i := 0; i < runs; i++ {
+		// Start every run from a collected heap, so one run's garbage does not slow the next
+		runtime.GC()
+		start := time.Now()
+		scheduler.Schedule(config)
+		m.times = append(m.times, time.Since(start).Seconds())
+	}
+	if config.Mode == baselineMode {
+		fmt.Printf("%s %s: %.2fs ± %.2fs\n", config.DataDirs, config.Mode, m.mean(), m.stddev())
+	}
+	return m
+}
+
+// baselineOf returns the baseline measurement of a data directory
+func baselineOf(results []*measurement, dir string) *measurement {
+	for _, m := range results {
+		if m.dir == dir && m.mode == baselineMode {
+			return m
+		}
+	}
+	return nil
+}
+
+// writeCSV writes one row per measurement with its statistics and speedup
+func writeCSV(path string, results []*measurement) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	w.Write([]string{"data_dir", "mode", "threads", "runs", "mean_s", "stddev_s", "speedup"})
+	for _, m := range results {
+		speedup := baselineOf(results, m.dir).mean() / m.mean()
+		w.Write([]string{
+			m.dir, m.mode, strconv.Itoa(m.threads), strconv.Itoa(len(m.times)),
+			strconv.FormatFloat(m.mean(), 'f', 4, 64),
+			strconv.FormatFloat(m.stddev(), 'f', 4, 64),
+			strconv.FormatFloat(speedup, 'f', 3, 64),
+		})
+	}
+	w.Flush()
+	err = w.Error()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeChart writes the speedup chart of a mode, with one line per data directory
+func writeChart(path, mode string, threadCounts []int, results []*measurement) error {
+	var lines []series
+	for _, m := range results {
+		if m.mode != mode {
+			continue
+		}
+		if len(lines) == 0 || lines[len(lines)-1].name != m.dir {
+			lines = append(lines, series{name: m.dir})
+		}
+		line := &lines[len(lines)-1]
+		line.points = append(line.points, point{float64(m.threads), baselineOf(results, m.dir).mean() / m.mean()})
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	title := fmt.Sprintf("Speedup of %s against %s", mode, baselineMode)
+	err = writeSpeedupChart(file, title, threadCounts, lines)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Helper to get maximum of two integers
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
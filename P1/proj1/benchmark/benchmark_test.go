@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"math"
+	"testing"
+)
+
+// TestMeasurementStats checks the mean and sample standard deviation of the runtimes
+func TestMeasurementStats(t *testing.T) {
+	m := &measurement{times: []float64{2, 4, 4, 4, 5, 5, 7, 9}}
+	if got := m.mean(); got != 5 {
+		t.Errorf("mean = %v, want 5", got)
+	}
+	if got, want := m.stddev(), math.Sqrt(32.0/7); math.Abs(got-want) > 1e-12 {
+		t.Errorf("stddev = %v, want %v", got, want)
+	}
+	if got := (&measurement{times: []float64{3}}).stddev(); got != 0 {
+		t.Errorf("stddev of one run = %v, want 0", got)
+	}
+}
+
+// TestNiceStep checks the rounding of axis steps
+func TestNiceStep(t *testing.T) {
+	cases := map[float64]float64{0.2: 0.2, 0.3: 0.5, 1.1: 2, 2: 2, 2.4: 5, 7: 10, 12: 20}
+	for raw, want := range cases {
+		if got := niceStep(raw); math.Abs(got-want) > 1e-12 {
+			t.Errorf("niceStep(%v) = %v, want %v", raw, got, want)
+		}
+	}
+}
+
+// TestSpeedupChart checks that the chart is well-formed XML with a line per series
+func TestSpeedupChart(t *testing.T) {
+	lines := []series{
+		{name: "small", points: []point{{1, 1}, {2, 1.8}, {4, 3.1}}},
+		{name: "a<b", points: []point{{1, 0.9}, {2, 1.5}, {4, 2.2}}},
+	}
+	var buf bytes.Buffer
+	if err := writeSpeedupChart(&buf, "Speedup", []int{1, 2, 4}, lines); err != nil {
+		t.Fatal(err)
+	}
+	decoder := xml.NewDecoder(&buf)
+	polylines := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("invalid SVG: %v", err)
+			}
+			break
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "polyline" {
+			polylines++
+		}
+	}
+	if polylines != len(lines) {
+		t.Errorf("%d polylines, want %d", polylines, len(lines))
+	}
+}
+
+// TestParseThreads checks the thread count list
+func TestParseThreads(t *testing.T) {
+	counts, err := parseThreads("1, 2,8")
+	if err != nil || len(counts) != 3 || counts[2] != 8 {
+		t.Errorf("parseThreads = %v, %v", counts, err)
+	}
+	for _, list := range []string{"", "0", "2,x"} {
+		if _, err := parseThreads(list); err == nil {
+			t.Errorf("parseThreads(%q) should fail", list)
+		}
+	}
+}
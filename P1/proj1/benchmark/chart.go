@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Chart layout in SVG user units
+const (
+	chartWidth   = 640
+	chartHeight  = 420
+	marginLeft   = 60
+	marginRight  = 130 // Room for the legend
+	marginTop    = 40
+	marginBottom = 50
+)
+
+// seriesColours are the line colours, reused when there are more series
+var seriesColours = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b"}
+
+// point is a thread count and the speedup measured with it
+type point struct {
+	x, y float64
+}
+
+// series is one line of a chart
+type series struct {
+	name   string
+	points []point
+}
+
+// writeSpeedupChart draws the speedup of every series against the thread count, with
+// a tick for every thread count and a grid, like the charts of the plotting scripts
+func writeSpeedupChart(w io.Writer, title string, threadCounts []int, lines []series) error {
+	plotW := float64(chartWidth - marginLeft - marginRight)
+	plotH := float64(chartHeight - marginTop - marginBottom)
+
+	xMin, xMax := math.Inf(1), math.Inf(-1)
+	for _, t := range threadCounts {
+		xMin, xMax = math.Min(xMin, float64(t)), math.Max(xMax, float64(t))
+	}
+	if xMin >= xMax {
+		xMin, xMax = xMin-1, xMax+1
+	}
+	yMax := 1.0
+	for _, line := range lines {
+		for _, p := range line.points {
+			yMax = math.Max(yMax, p.y)
+		}
+	}
+	yStep := niceStep(yMax / 5)
+	yMax = math.Ceil(yMax/yStep) * yStep
+
+	toX := func(x float64) float64 { return marginLeft + (x-xMin)/(xMax-xMin)*plotW }
+	toY := func(y float64) float64 { return marginTop + plotH - y/yMax*plotH }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`+"\n",
+		chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="white"/>`+"\n", chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<text x="%g" y="24" text-anchor="middle" font-size="16">%s</text>`+"\n", marginLeft+plotW/2, html.EscapeString(title))
+
+	// Grid and ticks
+	for _, t := range threadCounts {
+		x := toX(float64(t))
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", x, marginTop, x, marginTop+plotH)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle">%d</text>`+"\n", x, marginTop+plotH+18, t)
+	}
+	for i := 0; float64(i)*yStep <= yMax+yStep/2; i++ {
+		v := float64(i) * yStep
+		y := toY(v)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", marginLeft, y, marginLeft+plotW, y)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`+"\n", marginLeft-6, y+4, strconv.FormatFloat(v, 'g', 4, 64))
+	}
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="%.1f" fill="none" stroke="black"/>`+"\n", marginLeft, marginTop, plotW, plotH)
+	fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">Number of Threads</text>`+"\n", marginLeft+plotW/2, chartHeight-10)
+	fmt.Fprintf(&b, `<text x="16" y="%.1f" text-anchor="middle" transform="rotate(-90 16 %.1f)">Speedup</text>`+"\n", marginTop+plotH/2, marginTop+plotH/2)
+
+	// Lines with a marker per measurement, and the legend
+	for i, line := range lines {
+		colour := seriesColours[i%len(seriesColours)]
+		coords := make([]string, len(line.points))
+		for j, p := range line.points {
+			coords[j] = fmt.Sprintf("%.1f,%.1f", toX(p.x), toY(p.y))
+		}
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`+"\n", strings.Join(coords, " "), colour)
+		for _, p := range line.points {
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"/>`+"\n", toX(p.x), toY(p.y), colour)
+		}
+		legendY := marginTop + 10 + 20*i
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="%s" stroke-width="2"/>`+"\n",
+			marginLeft+plotW+12, legendY, marginLeft+plotW+32, legendY, colour)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d">%s</text>`+"\n", marginLeft+plotW+38, legendY+4, html.EscapeString(line.name))
+	}
+	b.WriteString("</svg>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// niceStep rounds a raw axis step up to 1, 2 or 5 times a power of ten
+func niceStep(raw float64) float64 {
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 5} {
+		if raw <= m*magnitude {
+			return m * magnitude
+		}
+	}
+	return 10 * magnitude
+}
@@ -1,31 +1,67 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"proj1/scheduler"
+	"proj1/verify"
 	"strconv"
 	"time"
 )
 
-const usage = "Usage: editor data_dir mode [number of threads]\n" +
-	"data_dir = The data directory to use to load the images.\n" +
-	"mode     = (s) run sequentially, (parfiles) process multiple files in parallel, (parslices) process slices of each image in parallel \n" +
-	"[number of threads] = Runs the parallel version of the program with the specified number of threads.\n"
+const usage = "Usage: editor [options] data_dir mode [number of threads]\n" +
+	"data_dir = The data directory to use to load the images (a directory or a .zip archive in ../data/in, several joined with +).\n" +
+	"mode     = (s) run sequentially, (parfiles) process multiple files in parallel, (parslices) process slices of each image in parallel, (stream) stream each image through windows of rows processed in parallel, (watch) keep processing the images arriving in the data directories until interrupted\n" +
+	"[number of threads] = Runs the parallel version of the program with the specified number of threads.\n" +
+	"options:\n" +
+	"  -maxmem MiB = Limits the decoded image memory in flight to MiB mebibytes (default 0 = unlimited).\n" +
+	"  -penc N     = Writes the output PNGs with the parallel encoder using N goroutines (default 0 = image/png).\n" +
+	"  -force      = Reprocesses every image, even if ../data/out-manifest.json says its output is up to date.\n" +
+	"  -window R   = Output rows per window in the stream mode (default 0 = 256 rows).\n" +
+	"  -outzip F   = Writes the output images into the zip file F instead of ../data/out.\n" +
+	"  -poll D     = Time between two polls of the data directories in the watch mode, e.g. 500ms (default 1s).\n" +
+	"The watch mode applies ../data/in/<data_dir>/watch.json (an effects.txt line without inPath and outPath) to every image of the directory.\n" +
+	"\n" +
+	"Usage: editor verify dir_a dir_b [tolerance]\n" +
+	"dir_a, dir_b = The output directories to compare image by image.\n" +
+	"[tolerance]  = The maximum absolute channel difference allowed (default 0).\n" +
+	"Heatmaps of mismatching images are written to dir_b_diff. Exits with status 1 if any image is out of tolerance.\n"
 
 func main() {
+	maxMem := flag.Int64("maxmem", 0, "")
+	encodeThreads := flag.Int("penc", 0, "")
+	force := flag.Bool("force", false, "")
+	windowRows := flag.Int("window", 0, "")
+	outZip := flag.String("outzip", "", "")
+	pollInterval := flag.Duration("poll", 0, "")
+	flag.Usage = func() { fmt.Print(usage) }
+	flag.Parse()
+	args := flag.Args()
 
-	if len(os.Args) < 2 {
-		fmt.Println(usage)
+	if len(args) < 1 {
+		fmt.Print(usage)
 		return
 	}
+	if args[0] == "verify" {
+		os.Exit(runVerify(args[1:]))
+	}
 	config := scheduler.Config{DataDirs: "", Mode: "", ThreadCount: 0}
-	config.DataDirs = os.Args[1]
+	config.DataDirs = args[0]
+	config.MaxInFlightBytes = *maxMem << 20
+	config.EncodeThreads = *encodeThreads
+	config.Force = *force
+	config.WindowRows = *windowRows
+	config.OutputZip = *outZip
+	config.PollInterval = *pollInterval
 
-	if len(os.Args) >= 3 {
-		config.Mode = os.Args[2]
-		threads, _ := strconv.Atoi(os.Args[3])
-		config.ThreadCount = threads
+	if len(args) >= 2 {
+		config.Mode = args[1]
+		if len(args) >= 3 {
+			threads, _ := strconv.Atoi(args[2])
+			config.ThreadCount = threads
+		}
 	} else {
 		config.Mode = "s"
 	}
@@ -35,3 +71,48 @@ func main() {
 	fmt.Printf("%.2f\n", end)
 
 }
+
+// runVerify compares two output directories and returns the process exit code
+func runVerify(args []string) int {
+	if len(args) < 2 {
+		fmt.Print(usage)
+		return 2
+	}
+	tolerance := 0
+	if len(args) >= 3 {
+		t, err := strconv.Atoi(args[2])
+		if err != nil || t < 0 {
+			fmt.Printf("Invalid tolerance %q\n", args[2])
+			return 2
+		}
+		tolerance = t
+	}
+
+	dirA, dirB := args[0], args[1]
+	heatDir := filepath.Clean(dirB) + "_diff"
+	results, ok, err := verify.CompareDirs(dirA, dirB, heatDir, tolerance)
+	if err != nil {
+		fmt.Printf("Failed to compare %s and %s: %v\n", dirA, dirB, err)
+		return 2
+	}
+
+	fmt.Printf("%-40s %8s %10s %8s  %s\n", "image", "maxdiff", "psnr", "ssim", "status")
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Printf("%-40s %8s %10s %8s  ERROR: %v\n", r.Name, "-", "-", "-", r.Err)
+			continue
+		}
+		status := "ok"
+		if !r.Within(tolerance) {
+			status = "MISMATCH"
+		}
+		fmt.Printf("%-40s %8d %10.2f %8.4f  %s\n", r.Name, r.MaxDiff, r.PSNR, r.SSIM, status)
+	}
+
+	if !ok {
+		fmt.Printf("Outputs differ beyond tolerance %d (heatmaps in %s)\n", tolerance, heatDir)
+		return 1
+	}
+	fmt.Printf("All %d images within tolerance %d\n", len(results), tolerance)
+	return 0
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeGray saves an 8x8 opaque image of the gray level v as dir/name
+func writeGray(t *testing.T, dir, name string, v uint8) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = v, v, v, 255
+	}
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestVerifyExitCode checks the exit codes of the verify command: 0 within the
+// tolerance, 1 beyond it (with a heatmap) and 2 for invalid arguments
+func TestVerifyExitCode(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	writeGray(t, dirA, "img.png", 100)
+	writeGray(t, dirB, "img.png", 104)
+
+	if code := runVerify([]string{dirA, dirB, "4"}); code != 0 {
+		t.Errorf("Tolerance 4: exit code %d", code)
+	}
+	if code := runVerify([]string{dirA, dirB}); code != 1 {
+		t.Errorf("Default tolerance: exit code %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dirB+"_diff", "img.png")); err != nil {
+		t.Errorf("No heatmap for the mismatch: %v", err)
+	}
+	os.RemoveAll(dirB + "_diff")
+
+	for _, args := range [][]string{{dirA}, {dirA, dirB, "-1"}, {dirA, dirB, "x"}, {filepath.Join(dirA, "none"), dirB}} {
+		if code := runVerify(args); code != 2 {
+			t.Errorf("Arguments %q: exit code %d", args, code)
+		}
+	}
+}
@@ -2,30 +2,142 @@
 // image flitering effects on them.
 package png
 
-import "image/color"
-
-// Grayscale applies a grayscale filtering effect to the image
-func (img *Image) Grayscale() {
-
-	// Bounds returns defines the dimensions of the image. Always
-	// use the bounds Min and Max fields to get out the width
-	// and height for the image
-	bounds := img.out.Bounds()
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			//Returns the pixel (i.e., RGBA) value at a (x,y) position
-			// Note: These get returned as int32 so based on the math you'll
-			// be performing you'll need to do a conversion to float64(..)
-			r, g, b, a := img.in.At(x, y).RGBA()
-
-			//Note: The values for r,g,b,a for this assignment will range between [0, 65535].
-			//For certain computations (i.e., convolution) the values might fall outside this
-			// range so you need to clamp them between those values.
-			greyC := clamp(float64(r+g+b) / 3)
-
-			//Note: The values need to be stored back as uint16 (I know weird..but there's valid reasons
-			// for this that I won't get into right now).
-			img.out.Set(x, y, color.RGBA64{greyC, greyC, greyC, uint16(a)})
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Convolution kernels of the effects (flat, row-major). The scheduler uses them too.
+var (
+	SharpenKernel    = []float64{0, -1, 0, -1, 5, -1, 0, -1, 0}
+	EdgeDetectKernel = []float64{-1, -1, -1, -1, 8, -1, -1, -1, -1}
+	BlurKernel       = []float64{1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9}
+)
+
+// Parallel sets the number of goroutines the rows of Bounds are split between by the
+// following effects (1 = sequential) and returns img, e.g. img.Parallel(4).Sharpen().Blur()
+func (img *Image) Parallel(n int) *Image {
+	if n < 1 {
+		n = 1
+	}
+	img.threads = n
+	return img
+}
+
+// Grayscale replaces every pixel by the average of its red, green and blue values
+func (img *Image) Grayscale() *Image {
+	return img.apply(func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			in := img.in.Pix[img.in.PixOffset(img.Bounds.Min.X, y):][:img.Bounds.Dx()*8]
+			out := img.out.Pix[img.out.PixOffset(img.Bounds.Min.X, y):][:len(in)]
+			for i := 0; i < len(in); i += 8 {
+				// The values range between [0, 65535] and are stored big-endian
+				r, g, b := channel(in, i), channel(in, i+2), channel(in, i+4)
+				grey := clamp(float64(r+g+b) / 3)
+				setChannel(out, i, grey)
+				setChannel(out, i+2, grey)
+				setChannel(out, i+4, grey)
+				out[i+6], out[i+7] = in[i+6], in[i+7]
+			}
+		}
+	})
+}
+
+// Sharpen applies the sharpen kernel
+func (img *Image) Sharpen() *Image {
+	return img.Convolve(SharpenKernel)
+}
+
+// EdgeDetect applies the edge detection kernel
+func (img *Image) EdgeDetect() *Image {
+	return img.Convolve(EdgeDetectKernel)
+}
+
+// Blur applies the 3x3 box blur kernel
+func (img *Image) Blur() *Image {
+	return img.Convolve(BlurKernel)
+}
+
+// Convolve applies a square kernel with an odd size (flat, row-major) to the red,
+// green and blue channels. Pixels outside the image count as zero and the result
+// is opaque, like the convolutions of the scheduler. It panics on other kernel sizes.
+func (img *Image) Convolve(kernel []float64) *Image {
+	size := int(math.Sqrt(float64(len(kernel))))
+	if size*size != len(kernel) || size%2 == 0 {
+		panic(fmt.Sprintf("png: kernel of %d values is not square with an odd size", len(kernel)))
+	}
+	offset := size / 2
+	bounds := img.Bounds
+
+	return img.apply(func(startY, endY int) {
+		for y := startY; y < endY; y++ {
+			out := img.out.Pix[img.out.PixOffset(bounds.Min.X, y):]
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				var rSum, gSum, bSum float64
+				for ky := -offset; ky <= offset; ky++ {
+					ny := y + ky
+					if ny < bounds.Min.Y || ny >= bounds.Max.Y {
+						continue
+					}
+					in := img.in.Pix[img.in.PixOffset(bounds.Min.X, ny):]
+					weights := kernel[(ky+offset)*size:]
+					for kx := -offset; kx <= offset; kx++ {
+						nx := x + kx
+						if nx < bounds.Min.X || nx >= bounds.Max.X {
+							continue
+						}
+						i := (nx - bounds.Min.X) * 8
+						weight := weights[kx+offset]
+						rSum += float64(channel(in, i)) * weight
+						gSum += float64(channel(in, i+2)) * weight
+						bSum += float64(channel(in, i+4)) * weight
+					}
+				}
+				i := (x - bounds.Min.X) * 8
+				setChannel(out, i, clamp(rSum))
+				setChannel(out, i+2, clamp(gSum))
+				setChannel(out, i+4, clamp(bSum))
+				setChannel(out, i+6, 0xffff)
+			}
+		}
+	})
+}
+
+// apply runs an effect that reads the rows [startY, endY) of img.in and writes them to
+// img.out, split between the goroutines set by Parallel, then swaps the buffers so the
+// result is the input of the next effect
+func (img *Image) apply(effect func(startY, endY int)) *Image {
+	threads := img.threads
+	height := img.Bounds.Dy()
+	if threads > height {
+		threads = height
+	}
+	if threads <= 1 {
+		effect(img.Bounds.Min.Y, img.Bounds.Max.Y)
+	} else {
+		var wg sync.WaitGroup
+		for i := 0; i < threads; i++ {
+			startY := img.Bounds.Min.Y + i*height/threads
+			endY := img.Bounds.Min.Y + (i+1)*height/threads
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				effect(startY, endY)
+			}()
 		}
+		wg.Wait()
 	}
+	img.in, img.out = img.out, img.in
+	return img
+}
+
+// channel reads the big-endian 16-bit channel value at i
+func channel(pix []uint8, i int) uint32 {
+	return uint32(pix[i])<<8 | uint32(pix[i+1])
+}
+
+// setChannel stores a 16-bit channel value big-endian at i
+func setChannel(pix []uint8, i int, v uint16) {
+	pix[i], pix[i+1] = uint8(v>>8), uint8(v)
 }
@@ -0,0 +1,135 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"testing"
+)
+
+// newTestImage wraps a deterministic noise image; the bounds do not start at the origin
+func newTestImage(seed int64) *Image {
+	bounds := image.Rect(3, -2, 40, 27)
+	in := image.NewRGBA64(bounds)
+	draw.Draw(in, bounds, noise(bounds, true, seed), bounds.Min, draw.Src)
+	return &Image{in: in, out: image.NewRGBA64(bounds), Bounds: bounds, threads: 1}
+}
+
+// referenceConvolve convolves src pixel by pixel through At and Set
+func referenceConvolve(src *image.RGBA64, kernel []float64) *image.RGBA64 {
+	bounds := src.Bounds()
+	dst := image.NewRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var sum [3]float64
+			for ky := -1; ky <= 1; ky++ {
+				for kx := -1; kx <= 1; kx++ {
+					if !(image.Point{x + kx, y + ky}).In(bounds) {
+						continue
+					}
+					r, g, b, _ := src.At(x+kx, y+ky).RGBA()
+					weight := kernel[(ky+1)*3+kx+1]
+					sum[0] += float64(r) * weight
+					sum[1] += float64(g) * weight
+					sum[2] += float64(b) * weight
+				}
+			}
+			dst.Set(x, y, color.RGBA64{clamp(sum[0]), clamp(sum[1]), clamp(sum[2]), 0xffff})
+		}
+	}
+	return dst
+}
+
+// referenceGrayscale averages the channels of src pixel by pixel through At and Set
+func referenceGrayscale(src *image.RGBA64) *image.RGBA64 {
+	bounds := src.Bounds()
+	dst := image.NewRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := src.At(x, y).RGBA()
+			grey := clamp(float64(r+g+b) / 3)
+			dst.Set(x, y, color.RGBA64{grey, grey, grey, uint16(a)})
+		}
+	}
+	return dst
+}
+
+// TestEffectsMatchReference checks every effect, and a chain of them, against the
+// pixel by pixel reference
+func TestEffectsMatchReference(t *testing.T) {
+	img := newTestImage(1)
+	src := img.in
+	cases := []struct {
+		name   string
+		apply  func(img *Image) *Image
+		expect func() *image.RGBA64
+	}{
+		{"Grayscale", (*Image).Grayscale, func() *image.RGBA64 { return referenceGrayscale(src) }},
+		{"Sharpen", (*Image).Sharpen, func() *image.RGBA64 { return referenceConvolve(src, SharpenKernel) }},
+		{"EdgeDetect", (*Image).EdgeDetect, func() *image.RGBA64 { return referenceConvolve(src, EdgeDetectKernel) }},
+		{"Blur", (*Image).Blur, func() *image.RGBA64 { return referenceConvolve(src, BlurKernel) }},
+		{"Grayscale+Sharpen+Blur", func(img *Image) *Image { return img.Grayscale().Sharpen().Blur() }, func() *image.RGBA64 {
+			return referenceConvolve(referenceConvolve(referenceGrayscale(src), SharpenKernel), BlurKernel)
+		}},
+	}
+	for _, c := range cases {
+		img := newTestImage(1)
+		if got, want := c.apply(img).in.Pix, c.expect().Pix; !bytes.Equal(got, want) {
+			t.Errorf("%s differs from the reference", c.name)
+		}
+	}
+}
+
+// TestParallelMatchesSequential checks that splitting the rows between any number of
+// goroutines gives the same pixels
+func TestParallelMatchesSequential(t *testing.T) {
+	chain := func(img *Image) *Image {
+		return img.Sharpen().EdgeDetect().Grayscale().Blur().Convolve([]float64{
+			0, 0, 1, 0, 0,
+			0, 1, 2, 1, 0,
+			1, 2, -16, 2, 1,
+			0, 1, 2, 1, 0,
+			0, 0, 1, 0, 0,
+		})
+	}
+	want := chain(newTestImage(2)).in.Pix
+	for _, threads := range []int{2, 3, 7, 29, 100} {
+		if got := chain(newTestImage(2).Parallel(threads)).in.Pix; !bytes.Equal(got, want) {
+			t.Errorf("Parallel(%d) differs from the sequential effects", threads)
+		}
+	}
+}
+
+// TestConvolveRejectsKernel checks that kernels which are not square with an odd size panic
+func TestConvolveRejectsKernel(t *testing.T) {
+	for _, kernel := range [][]float64{{}, {1, 2, 3, 4}, make([]float64, 8)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Convolve accepted a kernel of %d values", len(kernel))
+				}
+			}()
+			newTestImage(3).Convolve(kernel)
+		}()
+	}
+}
+
+// TestSaveWritesCurrentImage checks that Save writes the result of the chained effects
+func TestSaveWritesCurrentImage(t *testing.T) {
+	img := newTestImage(4).Parallel(4).Grayscale().Blur()
+	path := filepath.Join(t.TempDir(), "out.png")
+	if err := img.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := image.NewRGBA64(loaded.Bounds)
+	draw.Draw(want, want.Bounds(), img.in, img.Bounds.Min, draw.Src)
+	if !bytes.Equal(loaded.in.Pix, want.Pix) {
+		t.Error("the saved image differs from the processed one")
+	}
+}
@@ -0,0 +1,322 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/adler32"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"sync"
+)
+
+// pngHeader is the signature every PNG file starts with
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// PNG filter types
+const (
+	filterNone = iota
+	filterSub
+	filterUp
+	filterAverage
+	filterPaeth
+)
+
+// dictSize is the DEFLATE window primed from the previous block (pigz-style)
+const dictSize = 32 * 1024
+
+// minBlockBytes is the smallest amount of filtered data compressed by one goroutine
+const minBlockBytes = 128 * 1024
+
+// EncodeParallel writes img to w in PNG format like image/png.Encode, but filters
+// the rows and compresses independent blocks of rows with threads goroutines.
+// Every block is DEFLATE-compressed on its own, primed with the last 32KiB of the
+// previous block and terminated with a sync flush, so the concatenated blocks form
+// a single valid zlib stream.
+func EncodeParallel(w io.Writer, img *image.RGBA, threads int) error {
+	if threads < 1 {
+		threads = 1
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	opaque := img.Opaque()
+	bpp := 4 // Bytes per pixel: NRGBA, or RGB for opaque images
+	colorType := byte(6)
+	if opaque {
+		bpp = 3
+		colorType = 2
+	}
+	rowBytes := 1 + width*bpp
+
+	// Filter all rows in parallel, each row only depends on the raw pixels of itself and the row above
+	filtered := make([]byte, height*rowBytes)
+	parallelRanges(height, threads, func(startY, endY int) {
+		prev := make([]byte, width*bpp)
+		cur := make([]byte, width*bpp)
+		scratch := make([]byte, width*bpp)
+		if startY > 0 {
+			rawRow(img, startY-1, opaque, prev)
+		}
+		for y := startY; y < endY; y++ {
+			rawRow(img, y, opaque, cur)
+			filterRow(filtered[y*rowBytes:(y+1)*rowBytes], cur, prev, scratch, bpp)
+			prev, cur = cur, prev
+		}
+	})
+
+	// Split the filtered data into blocks of whole rows and compress them concurrently
+	rowsPerBlock := (height + threads - 1) / threads
+	if rowsPerBlock*rowBytes < minBlockBytes {
+		rowsPerBlock = (minBlockBytes + rowBytes - 1) / rowBytes
+	}
+	if rowsPerBlock < 1 {
+		rowsPerBlock = 1
+	}
+	blockCount := (height + rowsPerBlock - 1) / rowsPerBlock
+	if blockCount == 0 {
+		blockCount = 1
+	}
+	blocks := make([]compressedBlock, blockCount)
+
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for i := 0; i < threads && i < blockCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range next {
+				start := b * rowsPerBlock * rowBytes
+				end := start + rowsPerBlock*rowBytes
+				if end > len(filtered) {
+					end = len(filtered)
+				}
+				dictStart := start - dictSize
+				if dictStart < 0 {
+					dictStart = 0
+				}
+				blocks[b] = compressBlock(filtered[start:end], filtered[dictStart:start], b == blockCount-1)
+			}
+		}()
+	}
+	for b := 0; b < blockCount; b++ {
+		next <- b
+	}
+	close(next)
+	wg.Wait()
+
+	// Assemble the zlib stream: header, blocks, combined Adler-32 checksum
+	checksum := uint32(1)
+	for _, block := range blocks {
+		if block.err != nil {
+			return block.err
+		}
+		checksum = adler32Combine(checksum, block.adler, int64(block.length))
+	}
+
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8 // Bit depth
+	ihdr[9] = colorType
+
+	if _, err := io.WriteString(w, pngHeader); err != nil {
+		return err
+	}
+	if err := writeChunk(w, "IHDR", ihdr[:]); err != nil {
+		return err
+	}
+	for i, block := range blocks {
+		data := block.data
+		if i == 0 {
+			data = append([]byte{0x78, 0x9c}, data...)
+		}
+		if i == len(blocks)-1 {
+			data = binary.BigEndian.AppendUint32(data, checksum)
+		}
+		if err := writeChunk(w, "IDAT", data); err != nil {
+			return err
+		}
+	}
+	return writeChunk(w, "IEND", nil)
+}
+
+// compressedBlock is the raw DEFLATE data of a block of filtered rows
+type compressedBlock struct {
+	data   []byte
+	adler  uint32 // Adler-32 of the uncompressed block
+	length int    // Length of the uncompressed block
+	err    error
+}
+
+// compressBlock deflates data using dict as preset dictionary. Only the last block
+// of the stream is closed, the others end on a byte boundary with a sync flush.
+func compressBlock(data, dict []byte, last bool) compressedBlock {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriterDict(&buf, flate.DefaultCompression, dict)
+	if err != nil {
+		return compressedBlock{err: err}
+	}
+	if _, err := fw.Write(data); err != nil {
+		return compressedBlock{err: err}
+	}
+	if last {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+	return compressedBlock{data: buf.Bytes(), adler: adler32.Checksum(data), length: len(data), err: err}
+}
+
+// adler32Combine returns the Adler-32 of the concatenation of two byte sequences
+// given their checksums and the length of the second one (as zlib's adler32_combine).
+func adler32Combine(adler1, adler2 uint32, len2 int64) uint32 {
+	const base = 65521
+	rem := uint64(len2 % base)
+	sum1 := uint64(adler1 & 0xffff)
+	sum2 := (rem * sum1) % base
+	sum1 += uint64(adler2&0xffff) + base - 1
+	sum2 += uint64(adler1>>16) + uint64(adler2>>16) + base - rem
+	sum1 %= base
+	sum2 %= base
+	return uint32(sum2<<16 | sum1)
+}
+
+// rawRow writes the unfiltered bytes of row y (counted from the top of the image):
+// RGB for opaque images, otherwise non-premultiplied RGBA (PNG stores straight
+// alpha while *image.RGBA is premultiplied).
+func rawRow(img *image.RGBA, y int, opaque bool, dst []byte) {
+	bounds := img.Bounds()
+	src := img.Pix[y*img.Stride:]
+	width := bounds.Dx()
+	if opaque {
+		for x := 0; x < width; x++ {
+			copy(dst[x*3:x*3+3], src[x*4:x*4+3])
+		}
+		return
+	}
+	for x := 0; x < width; x++ {
+		p := src[x*4 : x*4+4]
+		c := color.NRGBAModel.Convert(color.RGBA{p[0], p[1], p[2], p[3]}).(color.NRGBA)
+		dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = c.R, c.G, c.B, c.A
+	}
+}
+
+// filterRow writes the filter type byte and the filtered bytes of cur into dst,
+// choosing the filter with the smallest sum of absolute values (as image/png does).
+// candidate is scratch space of the same length as cur.
+func filterRow(dst, cur, prev, candidate []byte, bpp int) {
+	best := -1
+	var bestSum int
+
+	for filter := filterNone; filter <= filterPaeth; filter++ {
+		sum := 0
+		for i, c := range cur {
+			var a, b, up byte // left, above, upper left
+			if i >= bpp {
+				a = cur[i-bpp]
+				up = prev[i-bpp]
+			}
+			b = prev[i]
+
+			var f byte
+			switch filter {
+			case filterNone:
+				f = c
+			case filterSub:
+				f = c - a
+			case filterUp:
+				f = c - b
+			case filterAverage:
+				f = c - byte((int(a)+int(b))/2)
+			case filterPaeth:
+				f = c - paeth(a, b, up)
+			}
+			candidate[i] = f
+			sum += abs8(f)
+			if best >= 0 && sum >= bestSum {
+				break
+			}
+		}
+		if best < 0 || sum < bestSum {
+			best, bestSum = filter, sum
+			dst[0] = byte(filter)
+			copy(dst[1:], candidate)
+		}
+	}
+}
+
+// paeth implements the Paeth predictor of the PNG specification
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// abs8 interprets a filtered byte as signed and returns its magnitude
+func abs8(b byte) int {
+	return absInt(int(int8(b)))
+}
+
+// absInt returns the absolute value of v
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// writeChunk writes a PNG chunk: length, type, data and CRC-32 of type and data
+func writeChunk(w io.Writer, chunkType string, data []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// parallelRanges splits [0, n) into up to threads contiguous ranges and runs fn on them concurrently
+func parallelRanges(n, threads int, fn func(start, end int)) {
+	if threads > n {
+		threads = n
+	}
+	if threads <= 1 {
+		fn(0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	size := n / threads
+	for i := 0; i < threads; i++ {
+		start := i * size
+		end := start + size
+		if i == threads-1 {
+			end = n
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			fn(start, end)
+		}(start, end)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,92 @@
+package png
+
+import (
+	"bytes"
+	"hash/adler32"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// noise creates a deterministic image; translucent images get random alpha values
+func noise(bounds image.Rectangle, translucent bool, seed int64) *image.RGBA {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// Smooth gradients with some noise exercise every filter type
+			c := color.NRGBA{uint8(x + rng.Intn(8)), uint8(y * 3), uint8(rng.Intn(256)), 255}
+			if translucent {
+				c.A = uint8(rng.Intn(256))
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// TestEncodeParallelRoundTrip checks that image/png decodes the parallel encoder's
+// output to the same pixels as the output of image/png.Encode.
+func TestEncodeParallelRoundTrip(t *testing.T) {
+	cases := []struct {
+		name        string
+		bounds      image.Rectangle
+		translucent bool
+	}{
+		{"opaque", image.Rect(0, 0, 173, 311), false},
+		{"translucent", image.Rect(0, 0, 97, 58), true},
+		{"single row", image.Rect(0, 0, 300, 1), false},
+		{"offset bounds", image.Rect(5, 7, 40, 900), false},
+		{"large", image.Rect(0, 0, 640, 480), false},
+	}
+
+	for i, tc := range cases {
+		img := noise(tc.bounds, tc.translucent, int64(i))
+
+		var reference bytes.Buffer
+		if err := png.Encode(&reference, img); err != nil {
+			t.Fatal(err)
+		}
+		expected, err := png.Decode(&reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, threads := range []int{1, 2, 3, 8} {
+			var out bytes.Buffer
+			if err := EncodeParallel(&out, img, threads); err != nil {
+				t.Fatalf("%s/%d: encode failed: %v", tc.name, threads, err)
+			}
+			got, err := png.Decode(&out)
+			if err != nil {
+				t.Fatalf("%s/%d: decode failed: %v", tc.name, threads, err)
+			}
+			if got.Bounds().Size() != expected.Bounds().Size() {
+				t.Fatalf("%s/%d: size %v, want %v", tc.name, threads, got.Bounds().Size(), expected.Bounds().Size())
+			}
+			for y := 0; y < tc.bounds.Dy(); y++ {
+				for x := 0; x < tc.bounds.Dx(); x++ {
+					want := expected.At(expected.Bounds().Min.X+x, expected.Bounds().Min.Y+y)
+					have := got.At(got.Bounds().Min.X+x, got.Bounds().Min.Y+y)
+					if want != have {
+						t.Fatalf("%s/%d: pixel (%d, %d) is %v, want %v", tc.name, threads, x, y, have, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestAdler32Combine checks the checksum combination against a direct computation
+func TestAdler32Combine(t *testing.T) {
+	data := bytes.Repeat([]byte("parallel png encoder "), 5000)
+	for _, split := range []int{0, 1, 65521, 70000, len(data)} {
+		a, b := data[:split], data[split:]
+		got := adler32Combine(adler32.Checksum(a), adler32.Checksum(b), int64(len(b)))
+		if want := adler32.Checksum(data); got != want {
+			t.Errorf("split at %d: got %08x, want %08x", split, got, want)
+		}
+	}
+}
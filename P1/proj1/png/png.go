@@ -11,11 +11,13 @@ import (
 )
 
 // The Image represents a structure for working with PNG images.
-// You are allowed to update this and change it as you wish!
+// Effects read in and write out, then the two buffers are swapped, so in always
+// holds the current pixels and effects can be chained.
 type Image struct {
-	in     *image.RGBA64   //The original pixels before applying the effect
-	out    *image.RGBA64   //The updated pixels after applying teh effect
-	Bounds image.Rectangle //The size of the image
+	in      *image.RGBA64   //The current pixels (the input of the next effect)
+	out     *image.RGBA64   //The buffer the next effect writes to
+	Bounds  image.Rectangle //The size of the image
+	threads int             //The goroutines the rows of an effect are split between (see Parallel)
 }
 
 //
@@ -54,11 +56,11 @@ func Load(filePath string) (*Image, error) {
 	task.in = inImg
 	task.out = outImg
 	task.Bounds = bounds
+	task.threads = 1
 	return task, nil
 }
 
-// Save saves the image to the given file
-// You are allowed to modify and update this as you wish
+// Save saves the image, with every effect applied so far, to the given file
 func (img *Image) Save(filePath string) error {
 
 	outWriter, err := os.Create(filePath)
@@ -67,7 +69,7 @@ func (img *Image) Save(filePath string) error {
 	}
 	defer outWriter.Close()
 
-	err = png.Encode(outWriter, img.out)
+	err = png.Encode(outWriter, img.in)
 	if err != nil {
 		return err
 	}
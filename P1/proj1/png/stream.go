@@ -0,0 +1,503 @@
+// Package png allows for loading png images and applying
+// image flitering effects on them.
+package png
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ErrInterlaced is returned by NewRowReader for Adam7-interlaced images, whose rows
+// cannot be produced in order without decoding the whole image.
+var ErrInterlaced = errors.New("png: interlaced images cannot be streamed")
+
+// PNG color types
+const (
+	ctGray      = 0
+	ctRGB       = 2
+	ctPalette   = 3
+	ctGrayAlpha = 4
+	ctRGBA      = 6
+)
+
+// RowReader decodes a PNG image one row at a time, so only two rows of the
+// image are held in memory. Rows are returned as premultiplied 8-bit RGBA,
+// the same values image/png.Decode followed by draw.Draw into an *image.RGBA gives.
+type RowReader struct {
+	Width, Height int
+
+	r         *bufio.Reader
+	pixels    io.ReadCloser // zlib stream over the IDAT chunks
+	depth     int
+	colorType int
+	bpp       int // Bytes per complete pixel for filtering (at least 1)
+	palette   [][4]uint8
+	trns      []byte // tRNS chunk of gray and RGB images (transparent sample value)
+	cur, prev []byte // Current and previous unfiltered rows (without the filter byte)
+	row       int    // Number of rows read so far
+}
+
+// NewRowReader reads the PNG header and all chunks up to the first IDAT chunk
+func NewRowReader(r io.Reader) (*RowReader, error) {
+	rr := &RowReader{r: bufio.NewReader(r)}
+
+	var signature [8]byte
+	if _, err := io.ReadFull(rr.r, signature[:]); err != nil {
+		return nil, err
+	}
+	if string(signature[:]) != pngHeader {
+		return nil, errors.New("png: invalid signature")
+	}
+
+	for {
+		length, chunkType, err := rr.readChunkHeader()
+		if err != nil {
+			return nil, err
+		}
+		if chunkType == "IDAT" {
+			if rr.Width == 0 {
+				return nil, errors.New("png: missing IHDR")
+			}
+			pixels, err := zlib.NewReader(&idatReader{rr: rr, remaining: length, crc: idatCRC()})
+			if err != nil {
+				return nil, err
+			}
+			rr.pixels = pixels
+			return rr, nil
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(rr.r, data); err != nil {
+			return nil, err
+		}
+		if err := rr.verifyCRC(chunkType, data); err != nil {
+			return nil, err
+		}
+
+		switch chunkType {
+		case "IHDR":
+			if err := rr.parseIHDR(data); err != nil {
+				return nil, err
+			}
+		case "PLTE":
+			rr.palette = make([][4]uint8, len(data)/3)
+			for i := range rr.palette {
+				rr.palette[i] = [4]uint8{data[i*3], data[i*3+1], data[i*3+2], 0xff}
+			}
+		case "tRNS":
+			if rr.colorType == ctPalette {
+				for i := 0; i < len(data) && i < len(rr.palette); i++ {
+					rr.palette[i][3] = data[i]
+				}
+			} else {
+				rr.trns = data
+			}
+		case "IEND":
+			return nil, errors.New("png: no image data")
+		}
+	}
+}
+
+// parseIHDR validates the image header and sets up the row buffers
+func (rr *RowReader) parseIHDR(data []byte) error {
+	if len(data) != 13 {
+		return errors.New("png: invalid IHDR")
+	}
+	rr.Width = int(binary.BigEndian.Uint32(data[0:4]))
+	rr.Height = int(binary.BigEndian.Uint32(data[4:8]))
+	rr.depth = int(data[8])
+	rr.colorType = int(data[9])
+	if data[12] != 0 {
+		return ErrInterlaced
+	}
+	if rr.Width <= 0 || rr.Height <= 0 {
+		return errors.New("png: invalid image size")
+	}
+
+	var channels int
+	switch rr.colorType {
+	case ctGray, ctPalette:
+		channels = 1
+	case ctGrayAlpha:
+		channels = 2
+	case ctRGB:
+		channels = 3
+	case ctRGBA:
+		channels = 4
+	default:
+		return fmt.Errorf("png: unsupported color type %d", rr.colorType)
+	}
+	switch rr.depth {
+	case 1, 2, 4:
+		if channels != 1 {
+			return fmt.Errorf("png: unsupported bit depth %d for color type %d", rr.depth, rr.colorType)
+		}
+	case 8:
+	case 16:
+		if rr.colorType == ctPalette {
+			return errors.New("png: unsupported 16-bit palette")
+		}
+	default:
+		return fmt.Errorf("png: unsupported bit depth %d", rr.depth)
+	}
+
+	bitsPerPixel := channels * rr.depth
+	rr.bpp = (bitsPerPixel + 7) / 8
+	rowBytes := (rr.Width*bitsPerPixel + 7) / 8
+	rr.cur = make([]byte, rowBytes)
+	rr.prev = make([]byte, rowBytes)
+	return nil
+}
+
+// ReadRow decodes the next row into dst, which must hold Width*4 bytes
+func (rr *RowReader) ReadRow(dst []byte) error {
+	if rr.row >= rr.Height {
+		return io.EOF
+	}
+	var filter [1]byte
+	if _, err := io.ReadFull(rr.pixels, filter[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rr.pixels, rr.cur); err != nil {
+		return err
+	}
+	if err := unfilter(filter[0], rr.cur, rr.prev, rr.bpp); err != nil {
+		return err
+	}
+	rr.convert(dst)
+	rr.cur, rr.prev = rr.prev, rr.cur
+	rr.row++
+	return nil
+}
+
+// Close releases the decompressor
+func (rr *RowReader) Close() error {
+	return rr.pixels.Close()
+}
+
+// convert turns the unfiltered row into premultiplied RGBA
+func (rr *RowReader) convert(dst []byte) {
+	src := rr.cur
+	for x := 0; x < rr.Width; x++ {
+		var r, g, b, a uint8
+		switch {
+		case rr.colorType == ctPalette:
+			index := int(rr.sample(src, x))
+			if index < len(rr.palette) {
+				c := rr.palette[index]
+				r, g, b, a = premultiply8(c[0], c[1], c[2], c[3])
+			} else {
+				a = 0xff // Out-of-range indices decode as opaque black
+			}
+		case rr.depth == 16:
+			r, g, b, a = rr.convert16(src[x*rr.bpp:])
+		case rr.colorType == ctGray:
+			v := rr.sample(src, x)
+			gray := v * (0xff / uint8(1<<rr.depth-1))
+			a = 0xff
+			if len(rr.trns) >= 2 && uint16(v) == binary.BigEndian.Uint16(rr.trns) {
+				a = 0
+			}
+			r, g, b, a = premultiply8(gray, gray, gray, a)
+		case rr.colorType == ctGrayAlpha:
+			p := src[x*2:]
+			r, g, b, a = premultiply8(p[0], p[0], p[0], p[1])
+		case rr.colorType == ctRGB:
+			p := src[x*3:]
+			a = 0xff
+			if len(rr.trns) >= 6 && uint16(p[0]) == binary.BigEndian.Uint16(rr.trns[0:]) &&
+				uint16(p[1]) == binary.BigEndian.Uint16(rr.trns[2:]) && uint16(p[2]) == binary.BigEndian.Uint16(rr.trns[4:]) {
+				a = 0
+			}
+			r, g, b, a = premultiply8(p[0], p[1], p[2], a)
+		case rr.colorType == ctRGBA:
+			p := src[x*4:]
+			r, g, b, a = premultiply8(p[0], p[1], p[2], p[3])
+		}
+		dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = r, g, b, a
+	}
+}
+
+// convert16 converts a 16-bit pixel, keeping the high byte like draw.Draw does
+func (rr *RowReader) convert16(p []byte) (r, g, b, a uint8) {
+	sample := func(i int) uint32 { return uint32(binary.BigEndian.Uint16(p[i*2:])) }
+	var r16, g16, b16, a16 uint32
+	switch rr.colorType {
+	case ctGray:
+		r16 = sample(0)
+		g16, b16, a16 = r16, r16, 0xffff
+		if len(rr.trns) >= 2 && r16 == uint32(binary.BigEndian.Uint16(rr.trns)) {
+			a16 = 0
+		}
+	case ctGrayAlpha:
+		r16, a16 = sample(0), sample(1)
+		g16, b16 = r16, r16
+	case ctRGB:
+		r16, g16, b16, a16 = sample(0), sample(1), sample(2), 0xffff
+		if len(rr.trns) >= 6 && r16 == uint32(binary.BigEndian.Uint16(rr.trns[0:])) &&
+			g16 == uint32(binary.BigEndian.Uint16(rr.trns[2:])) && b16 == uint32(binary.BigEndian.Uint16(rr.trns[4:])) {
+			a16 = 0
+		}
+	case ctRGBA:
+		r16, g16, b16, a16 = sample(0), sample(1), sample(2), sample(3)
+	}
+	return uint8(r16 * a16 / 0xffff >> 8), uint8(g16 * a16 / 0xffff >> 8), uint8(b16 * a16 / 0xffff >> 8), uint8(a16 >> 8)
+}
+
+// sample returns the x-th sample of a row with one channel of depth <= 8 bits
+func (rr *RowReader) sample(row []byte, x int) uint8 {
+	if rr.depth == 8 {
+		return row[x]
+	}
+	perByte := 8 / rr.depth
+	shift := uint(8 - rr.depth*(x%perByte+1))
+	return (row[x/perByte] >> shift) & uint8(1<<rr.depth-1)
+}
+
+// premultiply8 converts straight-alpha 8-bit values to premultiplied ones
+// with the same rounding as color.NRGBA.RGBA
+func premultiply8(r, g, b, a uint8) (uint8, uint8, uint8, uint8) {
+	if a == 0xff {
+		return r, g, b, a
+	}
+	a16 := uint32(a) * 0x101
+	mul := func(c uint8) uint8 { return uint8(uint32(c) * 0x101 * a16 / 0xffff >> 8) }
+	return mul(r), mul(g), mul(b), a
+}
+
+// unfilter reverses the PNG filter of a row in place
+func unfilter(filter byte, cur, prev []byte, bpp int) error {
+	switch filter {
+	case filterNone:
+	case filterSub:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case filterUp:
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case filterAverage:
+		for i := range cur {
+			var left byte
+			if i >= bpp {
+				left = cur[i-bpp]
+			}
+			cur[i] += byte((int(left) + int(prev[i])) / 2)
+		}
+	case filterPaeth:
+		for i := range cur {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = cur[i-bpp], prev[i-bpp]
+			}
+			cur[i] += paeth(left, prev[i], upLeft)
+		}
+	default:
+		return fmt.Errorf("png: invalid filter type %d", filter)
+	}
+	return nil
+}
+
+// readChunkHeader reads the length and type of the next chunk
+func (rr *RowReader) readChunkHeader() (int, string, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(rr.r, header[:]); err != nil {
+		return 0, "", err
+	}
+	return int(binary.BigEndian.Uint32(header[:4])), string(header[4:]), nil
+}
+
+// verifyCRC reads the CRC following a chunk and compares it with type and data
+func (rr *RowReader) verifyCRC(chunkType string, data []byte) error {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	return rr.checkCRC(crc.Sum32())
+}
+
+// checkCRC reads a chunk CRC and compares it with the expected value
+func (rr *RowReader) checkCRC(expected uint32) error {
+	var stored [4]byte
+	if _, err := io.ReadFull(rr.r, stored[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(stored[:]) != expected {
+		return errors.New("png: invalid checksum")
+	}
+	return nil
+}
+
+// idatReader concatenates the payloads of consecutive IDAT chunks
+type idatReader struct {
+	rr        *RowReader
+	remaining int    // Bytes left in the current chunk
+	crc       uint32 // Running CRC of the current chunk
+	done      bool   // A non-IDAT chunk follows the image data
+}
+
+// idatCRC returns the CRC of an IDAT chunk type, where the CRC of every IDAT chunk starts
+func idatCRC() uint32 {
+	return crc32.Update(0, crc32.IEEETable, []byte("IDAT"))
+}
+
+func (ir *idatReader) Read(p []byte) (int, error) {
+	for ir.remaining == 0 {
+		if ir.done {
+			return 0, io.EOF
+		}
+		if err := ir.rr.checkCRC(ir.crc); err != nil {
+			return 0, err
+		}
+		length, chunkType, err := ir.rr.readChunkHeader()
+		if err != nil {
+			return 0, err
+		}
+		if chunkType != "IDAT" {
+			ir.done = true
+			return 0, io.EOF
+		}
+		ir.remaining = length
+		ir.crc = idatCRC()
+	}
+
+	if len(p) > ir.remaining {
+		p = p[:ir.remaining]
+	}
+	n, err := ir.rr.r.Read(p)
+	ir.remaining -= n
+	ir.crc = crc32.Update(ir.crc, crc32.IEEETable, p[:n])
+	return n, err
+}
+
+// idatChunkSize is the payload size of the IDAT chunks written by RowWriter
+const idatChunkSize = 64 * 1024
+
+// RowWriter encodes a PNG image one row at a time. Rows are given as premultiplied
+// 8-bit RGBA and written as non-premultiplied RGBA, so only two rows plus the
+// compressor state are held in memory.
+type RowWriter struct {
+	Width, Height int
+
+	w         io.Writer
+	zw        *zlib.Writer
+	idat      *chunkWriter
+	cur, prev []byte // Current and previous raw rows
+	filtered  []byte // Filter byte followed by the filtered current row
+	candidate []byte // Scratch space for the filter selection
+	row       int    // Number of rows written so far
+}
+
+// NewRowWriter writes the PNG header of a width x height image to w
+func NewRowWriter(w io.Writer, width, height int) (*RowWriter, error) {
+	rw := &RowWriter{
+		Width:     width,
+		Height:    height,
+		w:         w,
+		cur:       make([]byte, width*4),
+		prev:      make([]byte, width*4),
+		filtered:  make([]byte, 1+width*4),
+		candidate: make([]byte, width*4),
+	}
+
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8 // Bit depth
+	ihdr[9] = ctRGBA
+
+	if _, err := io.WriteString(w, pngHeader); err != nil {
+		return nil, err
+	}
+	if err := writeChunk(w, "IHDR", ihdr[:]); err != nil {
+		return nil, err
+	}
+	rw.idat = &chunkWriter{w: w}
+	rw.zw = zlib.NewWriter(rw.idat)
+	return rw, nil
+}
+
+// WriteRow filters, compresses and writes the next row (Width*4 bytes of premultiplied RGBA)
+func (rw *RowWriter) WriteRow(row []byte) error {
+	if rw.row >= rw.Height {
+		return errors.New("png: too many rows")
+	}
+	for x := 0; x < rw.Width; x++ {
+		p := row[x*4 : x*4+4]
+		r, g, b, a := unpremultiply8(p[0], p[1], p[2], p[3])
+		rw.cur[x*4], rw.cur[x*4+1], rw.cur[x*4+2], rw.cur[x*4+3] = r, g, b, a
+	}
+	filterRow(rw.filtered, rw.cur, rw.prev, rw.candidate, 4)
+	if _, err := rw.zw.Write(rw.filtered); err != nil {
+		return err
+	}
+	rw.cur, rw.prev = rw.prev, rw.cur
+	rw.row++
+	return nil
+}
+
+// Close finishes the image data and writes the IEND chunk
+func (rw *RowWriter) Close() error {
+	if rw.row != rw.Height {
+		return fmt.Errorf("png: %d of %d rows written", rw.row, rw.Height)
+	}
+	if err := rw.zw.Close(); err != nil {
+		return err
+	}
+	if err := rw.idat.flush(); err != nil {
+		return err
+	}
+	return writeChunk(rw.w, "IEND", nil)
+}
+
+// unpremultiply8 converts premultiplied 8-bit values to straight alpha like color.NRGBAModel
+func unpremultiply8(r, g, b, a uint8) (uint8, uint8, uint8, uint8) {
+	switch a {
+	case 0xff:
+		return r, g, b, a
+	case 0:
+		return 0, 0, 0, 0
+	}
+	a16 := uint32(a) * 0x101
+	div := func(c uint8) uint8 { return uint8((uint32(c) * 0x101 * 0xffff / a16) >> 8) }
+	return div(r), div(g), div(b), a
+}
+
+// chunkWriter buffers compressed data and emits it as IDAT chunks
+type chunkWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := idatChunkSize - len(cw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		cw.buf = append(cw.buf, p[:n]...)
+		p = p[n:]
+		if len(cw.buf) == idatChunkSize {
+			if err := cw.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the buffered data as one IDAT chunk
+func (cw *chunkWriter) flush() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	err := writeChunk(cw.w, "IDAT", cw.buf)
+	cw.buf = cw.buf[:0]
+	return err
+}
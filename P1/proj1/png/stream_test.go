@@ -0,0 +1,116 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// sampleImages returns one image per PNG color type and bit depth image/png writes
+func sampleImages() map[string]image.Image {
+	rng := rand.New(rand.NewSource(7))
+	bounds := image.Rect(0, 0, 45, 31)
+
+	gray := image.NewGray(bounds)
+	gray16 := image.NewGray16(bounds)
+	rgba := image.NewRGBA(bounds)
+	nrgba := image.NewNRGBA(bounds)
+	rgba64 := image.NewRGBA64(bounds)
+	nrgba64 := image.NewNRGBA64(bounds)
+	smallPalette := image.NewPaletted(bounds, color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{200, 10, 60, 255}, color.NRGBA{30, 90, 250, 128}})
+	largePalette := image.NewPaletted(bounds, nil)
+	for i := 0; i < 200; i++ {
+		largePalette.Palette = append(largePalette.Palette, color.NRGBA{uint8(i), uint8(255 - i), uint8(i * 7), uint8(i + 50)})
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := uint16(rng.Intn(65536))
+			gray.SetGray(x, y, color.Gray{uint8(v)})
+			gray16.SetGray16(x, y, color.Gray16{v})
+			rgba.SetRGBA(x, y, color.RGBA{uint8(x * 5), uint8(y * 8), uint8(v), 255})
+			nrgba.SetNRGBA(x, y, color.NRGBA{uint8(x * 5), uint8(y * 8), uint8(v), uint8(v >> 8)})
+			rgba64.SetRGBA64(x, y, color.RGBA64{v, v / 2, v / 3, 0xffff})
+			nrgba64.SetNRGBA64(x, y, color.NRGBA64{v, v / 2, v / 3, uint16(rng.Intn(65536))})
+			smallPalette.SetColorIndex(x, y, uint8(rng.Intn(3)))
+			largePalette.SetColorIndex(x, y, uint8(rng.Intn(200)))
+		}
+	}
+	return map[string]image.Image{
+		"gray": gray, "gray16": gray16, "rgb": rgba, "nrgba": nrgba, "rgb16": rgba64,
+		"nrgba16": nrgba64, "palette2bit": smallPalette, "palette8bit": largePalette,
+	}
+}
+
+// TestRowReaderMatchesDecode checks that streaming decoding gives the same pixels as
+// image/png.Decode followed by a conversion to *image.RGBA.
+func TestRowReaderMatchesDecode(t *testing.T) {
+	for name, img := range sampleImages() {
+		var encoded bytes.Buffer
+		if err := png.Encode(&encoded, img); err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := png.Decode(bytes.NewReader(encoded.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := image.NewRGBA(decoded.Bounds())
+		draw.Draw(expected, expected.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+
+		reader, err := NewRowReader(bytes.NewReader(encoded.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		row := make([]byte, reader.Width*4)
+		for y := 0; y < reader.Height; y++ {
+			if err := reader.ReadRow(row); err != nil {
+				t.Fatalf("%s: row %d: %v", name, y, err)
+			}
+			if want := expected.Pix[y*expected.Stride : y*expected.Stride+len(row)]; !bytes.Equal(row, want) {
+				t.Fatalf("%s: row %d differs from image/png", name, y)
+			}
+		}
+		reader.Close()
+	}
+}
+
+// TestRowWriterRoundTrip checks that rows written by RowWriter decode to the same pixels
+func TestRowWriterRoundTrip(t *testing.T) {
+	for _, translucent := range []bool{false, true} {
+		img := noise(image.Rect(0, 0, 301, 257), translucent, 11)
+
+		var encoded bytes.Buffer
+		writer, err := NewRowWriter(&encoded, 301, 257)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < 257; y++ {
+			if err := writer.WriteRow(img.Pix[y*img.Stride : (y+1)*img.Stride]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var reference bytes.Buffer
+		png.Encode(&reference, img)
+		expected, _ := png.Decode(&reference)
+		got, err := png.Decode(&encoded)
+		if err != nil {
+			t.Fatalf("translucent=%v: %v", translucent, err)
+		}
+		for y := 0; y < 257; y++ {
+			for x := 0; x < 301; x++ {
+				if a, b := color.NRGBAModel.Convert(expected.At(x, y)), color.NRGBAModel.Convert(got.At(x, y)); a != b {
+					t.Fatalf("translucent=%v: pixel (%d, %d) is %v, want %v", translucent, x, y, b, a)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Animated GIFs.
+image.Decode only returns the first frame of a GIF, so animated GIF inputs are
+decoded with gif.DecodeAll instead. Every frame is composited onto the canvas
+as a viewer would show it (following the disposal methods), the task is applied
+to the frames in parallel and the result is written as an animated GIF with the
+original delays, disposal methods and loop count. The processed frames cover
+the whole canvas, and each one gets its own adaptive palette.
+*/
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"sync"
+)
+
+// decodeAnimation returns the input as an animation if it is a GIF with more than
+// one frame, and nil otherwise. The file is rewound in both cases.
+func decodeAnimation(file io.ReadSeeker) (*gif.GIF, error) {
+	var magic [6]byte
+	n, _ := io.ReadFull(file, magic[:])
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if n < len(magic) || !bytes.HasPrefix(magic[:], []byte("GIF8")) {
+		return nil, nil
+	}
+
+	anim, err := gif.DecodeAll(file)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		return nil, seekErr
+	}
+	if err != nil || len(anim.Image) < 2 {
+		return nil, err
+	}
+	return anim, nil
+}
+
+// composeFrames renders every frame of anim onto the canvas as a GIF viewer does and
+// returns the rendered canvases (pooled buffers). The canvas starts transparent.
+func composeFrames(anim *gif.GIF, canvasBounds image.Rectangle) []*image.RGBA {
+	canvas := image.NewRGBA(canvasBounds)
+	frames := make([]*image.RGBA, len(anim.Image))
+
+	for i, frame := range anim.Image {
+		disposal := byte(0)
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvasBounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames[i] = pixelBuffers.get(canvasBounds)
+		copy(frames[i].Pix, canvas.Pix)
+
+		// Prepare the canvas for the next frame
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+// processAnimation applies a task to every frame of an animated GIF. The frames are
+// split between threadCount goroutines; when there are fewer frames than goroutines
+// the remaining ones parallelize the effects of each frame.
+func processAnimation(anim *gif.GIF, task *Task, key string, threadCount int, env *runEnv) {
+	if threadCount < 1 {
+		threadCount = 1
+	}
+	canvasBounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	for _, frame := range anim.Image {
+		canvasBounds = canvasBounds.Union(frame.Bounds())
+	}
+	width, height := canvasBounds.Dx(), canvasBounds.Dy()
+	workers := min(threadCount, len(anim.Image))
+
+	// Rendered frames plus the working set of every worker
+	footprint := int64(len(anim.Image))*int64(width)*int64(height)*bytesPerPixel + int64(workers)*taskFootprint(task, width, height)
+	env.budget.acquire(footprint)
+	defer env.budget.release(footprint)
+
+	frames := composeFrames(anim, canvasBounds)
+	paletted := make([]*image.Paletted, len(frames))
+	errs := make([]error, len(frames))
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				outImg, err := applyTask(frames[i], task, env.inputs, max(1, threadCount/workers))
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				paletted[i] = quantize(outImg)
+				pixelBuffers.put(outImg)
+			}
+		}()
+	}
+	for i := range frames {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			fmt.Printf("Failed to process animation %s: %v\n", task.inPath, err)
+			return
+		}
+	}
+
+	out := &gif.GIF{
+		Image:     paletted,
+		Delay:     anim.Delay,
+		Disposal:  anim.Disposal,
+		LoopCount: anim.LoopCount,
+	}
+	err := env.writeOutput(task.outPath, func(w io.Writer) error {
+		return gif.EncodeAll(w, out)
+	})
+	if err != nil {
+		fmt.Printf("Failed to encode animation %s: %v\n", task.outPath, err)
+		return
+	}
+	env.cache.record(task.outPath, key)
+}
@@ -0,0 +1,158 @@
+package scheduler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestQuantize checks the exact palette of frames with few colours and the error
+// of the median cut palette on noise.
+func TestQuantize(t *testing.T) {
+	few := solid(9, 7, color.RGBA{10, 20, 30, 255})
+	few.SetRGBA(3, 3, color.RGBA{200, 0, 0, 255})
+	few.SetRGBA(4, 4, color.RGBA{}) // Transparent
+	p := quantize(few)
+	if len(p.Palette) != 3 {
+		t.Errorf("palette has %d colours, want 3", len(p.Palette))
+	}
+	for y := 0; y < 7; y++ {
+		for x := 0; x < 9; x++ {
+			if got, want := color.RGBAModel.Convert(p.At(x, y)), few.At(x, y); got != want {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	noise := toRGBA(randomImage(64, 64, 16))
+	p = quantize(noise)
+	if len(p.Palette) > maxPaletteSize {
+		t.Fatalf("palette has %d colours", len(p.Palette))
+	}
+	total := 0
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			got := color.RGBAModel.Convert(p.At(x, y)).(color.RGBA)
+			want := noise.RGBAAt(x, y)
+			total += absInt(int(got.R)-int(want.R)) + absInt(int(got.G)-int(want.G)) + absInt(int(got.B)-int(want.B))
+		}
+	}
+	if mean := float64(total) / (64 * 64 * 3); mean > 16 {
+		t.Errorf("mean channel error %.1f is too large", mean)
+	}
+}
+
+// absInt returns the absolute value of v
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// testAnimation builds a GIF with partial frames, every disposal method and transparency
+func testAnimation() *gif.GIF {
+	rng := rand.New(rand.NewSource(17))
+	palette := color.Palette{color.RGBA{}}
+	for i := 1; i < 40; i++ {
+		palette = append(palette, color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255})
+	}
+	frame := func(r image.Rectangle) *image.Paletted {
+		p := image.NewPaletted(r, palette)
+		for i := range p.Pix {
+			p.Pix[i] = uint8(rng.Intn(len(palette))) // Index 0 is transparent
+		}
+		return p
+	}
+	return &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 12, 10)),
+			frame(image.Rect(2, 2, 6, 6)),
+			frame(image.Rect(5, 5, 10, 9)),
+			frame(image.Rect(1, 0, 4, 10)),
+		},
+		Delay:     []int{5, 10, 15, 20},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious, gif.DisposalNone},
+		LoopCount: 2,
+		Config:    image.Config{ColorModel: palette, Width: 12, Height: 10},
+	}
+}
+
+// TestAnimatedGIF runs an animation through every mode and checks the frames,
+// delays, disposal methods and loop count of the output.
+func TestAnimatedGIF(t *testing.T) {
+	anim := testAnimation()
+	root := setupDataDir(t, nil, `{"inPath": "anim.gif", "outPath": "anim_out.gif", "effects": ["G"]}
+{"inPath": "anim.gif", "outPath": "anim_edges.gif", "effects": ["E", "B"]}
+`)
+	file, err := os.Create(filepath.Join(root, "data/in/small/anim.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.EncodeAll(file, anim); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	var expected map[string][]byte
+	for _, config := range []Config{
+		{DataDirs: "small", Mode: "s"},
+		{DataDirs: "small", Mode: "parfiles", ThreadCount: 2},
+		{DataDirs: "small", Mode: "parslices", ThreadCount: 3},
+		{DataDirs: "small", Mode: "parslices", ThreadCount: 8},
+		{DataDirs: "small", Mode: "stream", ThreadCount: 2},
+	} {
+		config.Force = true
+		Schedule(config)
+		got := make(map[string][]byte)
+		for _, name := range []string{"small_anim_out.gif", "small_anim_edges.gif"} {
+			data, err := os.ReadFile(filepath.Join("../data/out", name))
+			if err != nil {
+				t.Fatalf("%s: %v", config.Mode, err)
+			}
+			got[name] = data
+		}
+		if expected == nil {
+			expected = got
+			continue
+		}
+		for name, want := range expected {
+			if !bytes.Equal(want, got[name]) {
+				t.Errorf("%s/%d: %s differs from the sequential output", config.Mode, config.ThreadCount, name)
+			}
+		}
+	}
+
+	for _, name := range []string{"small_anim_out.gif", "small_anim_edges.gif"} {
+		out, err := gif.DecodeAll(bytes.NewReader(expected[name]))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(out.Image) != len(anim.Image) || out.LoopCount != anim.LoopCount {
+			t.Fatalf("%s: %d frames with loop count %d, want %d and %d", name, len(out.Image), out.LoopCount, len(anim.Image), anim.LoopCount)
+		}
+		for i := range anim.Image {
+			if out.Delay[i] != anim.Delay[i] || out.Disposal[i] != anim.Disposal[i] {
+				t.Errorf("%s frame %d: delay %d, disposal %d, want %d and %d", name, i, out.Delay[i], out.Disposal[i], anim.Delay[i], anim.Disposal[i])
+			}
+		}
+	}
+
+	// Grayscale frames have at most 256 colours, so they survive the palette exactly
+	out, _ := gif.DecodeAll(bytes.NewReader(expected["small_anim_out.gif"]))
+	for i, frame := range composeFrames(anim, image.Rect(0, 0, 12, 10)) {
+		want := applyEffects(frame, []string{"G"}, 1)
+		for y := 0; y < 10; y++ {
+			for x := 0; x < 12; x++ {
+				if got := color.RGBAModel.Convert(out.Image[i].At(x, y)); got != want.At(x, y) {
+					t.Fatalf("frame %d pixel (%d, %d) = %v, want %v", i, x, y, got, want.At(x, y))
+				}
+			}
+		}
+	}
+}
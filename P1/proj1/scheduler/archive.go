@@ -0,0 +1,193 @@
+/*
+Zip archives as data directories.
+An entry of Config.DataDirs may name a zip file in ../data/in (e.g. "small.zip")
+instead of a directory. Input paths through an archive, such as
+../data/in/small.zip/sky.png, are read from the archive's members: stored
+members directly from the archive file, compressed ones after inflating them in
+memory. The archives stay open for the whole run and their members can be read
+by several workers at once. Outputs can also be collected into a zip file.
+*/
+package scheduler
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveExt is the extension of data directories that are zip archives
+const archiveExt = ".zip"
+
+// dataDirName returns the prefix of the output files of a data directory
+func dataDirName(dir string) string {
+	return strings.TrimSuffix(dir, archiveExt)
+}
+
+// splitArchivePath splits a path through a zip archive into the path of the archive
+// and the name of the member. ok is false for paths outside of archives.
+func splitArchivePath(path string) (archive, member string, ok bool) {
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(path)), "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if !strings.HasSuffix(strings.ToLower(parts[i]), archiveExt) {
+			continue
+		}
+		archive = filepath.FromSlash(strings.Join(parts[:i+1], "/"))
+		if info, err := os.Stat(archive); err == nil && info.Mode().IsRegular() {
+			return archive, strings.Join(parts[i+1:], "/"), true
+		}
+	}
+	return "", "", false
+}
+
+// archives keeps the zip archives read by a run open
+type archives struct {
+	mu   sync.Mutex
+	open map[string]*openArchive
+}
+
+// openArchive is an open zip file and its members by name
+type openArchive struct {
+	reader  *zip.ReadCloser
+	members map[string]*zip.File
+}
+
+// newArchives creates an empty set of open archives
+func newArchives() *archives {
+	return &archives{open: make(map[string]*openArchive)}
+}
+
+// get returns the archive at path, opening it on first use
+func (a *archives) get(path string) (*openArchive, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if archive, ok := a.open[path]; ok {
+		return archive, nil
+	}
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	archive := &openArchive{reader: reader, members: make(map[string]*zip.File)}
+	for _, file := range reader.File {
+		archive.members[file.Name] = file
+	}
+	a.open[path] = archive
+	return archive, nil
+}
+
+// openInput opens an input file, which may be the member of a zip archive.
+// The result can be rewound, as the cache key and the decoders read it more than once.
+func (a *archives) openInput(path string) (io.ReadSeekCloser, error) {
+	archivePath, name, ok := splitArchivePath(path)
+	if !ok {
+		return os.Open(path)
+	}
+	archive, err := a.get(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	member, ok := archive.members[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: no member %s", archivePath, name)
+	}
+
+	// Stored members are a section of the archive file, which supports concurrent reads
+	if member.Method == zip.Store {
+		raw, err := member.OpenRaw()
+		if err != nil {
+			return nil, err
+		}
+		if section, ok := raw.(io.ReadSeeker); ok {
+			return nopCloser{section}, nil
+		}
+	}
+	reader, err := member.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+// close closes every archive opened during the run
+func (a *archives) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for path, archive := range a.open {
+		archive.reader.Close()
+		delete(a.open, path)
+	}
+}
+
+// nopCloser adds a no-op Close to a reader that needs no cleanup
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// outputZip collects the outputs of a run into a zip file. Workers encode their
+// images in memory; the members are written one at a time.
+type outputZip struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *zip.Writer
+}
+
+// createOutputZip creates (or truncates) the output zip at path
+func createOutputZip(path string) (*outputZip, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &outputZip{file: file, writer: zip.NewWriter(file)}, nil
+}
+
+// create returns a writer for the member of an output path; it is added on Close
+func (z *outputZip) create(outPath string) io.WriteCloser {
+	return &zipMember{zip: z, name: filepath.Base(outPath)}
+}
+
+// close finishes the zip file
+func (z *outputZip) close() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.writer.Close()
+	if closeErr := z.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// zipMember buffers an output until it is complete
+type zipMember struct {
+	zip  *outputZip
+	name string
+	data bytes.Buffer
+}
+
+func (m *zipMember) Write(p []byte) (int, error) {
+	return m.data.Write(p)
+}
+
+// Close writes the member to the archive. PNGs and GIFs are already compressed, so it is stored.
+func (m *zipMember) Close() error {
+	m.zip.mu.Lock()
+	defer m.zip.mu.Unlock()
+	w, err := m.zip.writer.CreateHeader(&zip.FileHeader{Name: m.name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(m.data.Bytes())
+	return err
+}
@@ -0,0 +1,127 @@
+package scheduler
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeZip stores the images as PNG members of a zip file; names in stored are not compressed
+func writeZip(t *testing.T, path string, images map[string]image.Image, stored map[string]bool) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := zip.NewWriter(file)
+	for name, img := range images {
+		method := zip.Deflate
+		if stored[name] {
+			method = zip.Store
+		}
+		w, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(w, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSplitArchivePath checks which paths are read from archives
+func TestSplitArchivePath(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "set.zip"), nil, 0644)
+	os.Mkdir(filepath.Join(dir, "folder.zip"), 0755)
+
+	cases := []struct {
+		path, archive, member string
+		ok                    bool
+	}{
+		{filepath.Join(dir, "set.zip", "a.png"), filepath.Join(dir, "set.zip"), "a.png", true},
+		{filepath.Join(dir, "set.zip", "sub", "b.png"), filepath.Join(dir, "set.zip"), "sub/b.png", true},
+		{filepath.Join(dir, "folder.zip", "a.png"), "", "", false},
+		{filepath.Join(dir, "set.zip"), "", "", false},
+		{filepath.Join(dir, "plain", "a.png"), "", "", false},
+	}
+	for _, c := range cases {
+		archive, member, ok := splitArchivePath(c.path)
+		if archive != c.archive || member != c.member || ok != c.ok {
+			t.Errorf("splitArchivePath(%q) = %q, %q, %v, want %q, %q, %v", c.path, archive, member, ok, c.archive, c.member, c.ok)
+		}
+	}
+}
+
+// TestZipDataDir checks that a zipped data directory gives the same outputs as the
+// extracted one in every mode, and that outputs can be written into a zip.
+func TestZipDataDir(t *testing.T) {
+	images := map[string]image.Image{
+		"a.png":    randomImage(21, 17, 18),
+		"b.png":    randomImage(9, 30, 19),
+		"logo.png": randomImage(4, 4, 20),
+	}
+	effects := `{"inPath": "a.png", "outPath": "a_out.png", "effects": ["S", "B"]}
+{"inPath": "b.png", "outPath": "b_out.png", "effects": ["G"], "overlays": [{"path": "logo.png", "x": 2, "y": 3}]}
+`
+	root := setupDataDir(t, images, effects)
+	writeZip(t, filepath.Join(root, "data/in/arch.zip"), images, map[string]bool{"a.png": true})
+
+	for _, config := range []Config{
+		{DataDirs: "small+arch.zip", Mode: "s"},
+		{DataDirs: "small+arch.zip", Mode: "parfiles", ThreadCount: 4},
+		{DataDirs: "small+arch.zip", Mode: "parslices", ThreadCount: 3},
+		{DataDirs: "small+arch.zip", Mode: "stream", ThreadCount: 2},
+	} {
+		config.Force = true
+		Schedule(config)
+		outputs := readOutputs(t)
+		if len(outputs) != 4 {
+			t.Fatalf("%s: wrote %d files, want 4", config.Mode, len(outputs))
+		}
+		for _, name := range []string{"a_out.png", "b_out.png"} {
+			if !bytes.Equal(outputs["small_"+name], outputs["arch_"+name]) {
+				t.Errorf("%s: %s from the archive differs from the directory", config.Mode, name)
+			}
+		}
+	}
+
+	// Outputs written into a zip instead of ../data/out
+	RunSequential(Config{DataDirs: "small", Mode: "s", Force: true})
+	expected := readOutputs(t)
+	zipPath := filepath.Join(root, "data/out.zip")
+	RunParallelFiles(Config{DataDirs: "small", Mode: "parfiles", ThreadCount: 2, OutputZip: zipPath})
+	if files := readOutputs(t); len(files) != 0 {
+		t.Errorf("%d files written to ../data/out with an output zip", len(files))
+	}
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if len(reader.File) != len(expected) {
+		t.Fatalf("output zip has %d members, want %d", len(reader.File), len(expected))
+	}
+	for _, member := range reader.File {
+		file, err := member.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", member.Name, err)
+		}
+		if !bytes.Equal(toRGBA(img).Pix, expected[member.Name]) {
+			t.Errorf("%s in the output zip differs from the file output", member.Name)
+		}
+	}
+}
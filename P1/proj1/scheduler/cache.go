@@ -0,0 +1,148 @@
+/*
+Incremental processing.
+The cache manifest remembers, for every output file, the content hash of the
+input image and the effect chain it was produced with. Tasks whose input and
+effects did not change since the last run are skipped.
+*/
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// manifestPath is the cache manifest, stored next to the out directory
+const manifestPath = "../data/out-manifest.json"
+
+// cacheManifest maps output paths to the cache key of the image they were produced from.
+// It is shared by all workers of a run, so every access holds the mutex.
+type cacheManifest struct {
+	mu      sync.Mutex
+	path    string            // Location of the manifest file
+	force   bool              // Reprocess every task, but still record the new keys
+	entries map[string]string // Output path -> cache key
+	dirty   bool              // Entries changed since the manifest was loaded
+}
+
+// loadManifest reads the manifest at path. A missing or unreadable manifest starts empty.
+func loadManifest(path string, force bool) *cacheManifest {
+	manifest := &cacheManifest{path: path, force: force, entries: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		json.Unmarshal(data, &manifest.entries)
+	}
+	return manifest
+}
+
+// cacheKey combines the content hash of the input with the normalized effect chain,
+// the effect graph, mask and overlays of the task and the content hashes of the
+// additional inputs (digested once per run through inputs)
+func cacheKey(input io.Reader, task *Task, inputs *sharedInputs) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, input); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(hash.Sum(nil)) + "|" + normalizeEffects(task.effects)
+	if task.graph != nil || task.mask != "" || task.overlays != nil {
+		extra, err := json.Marshal(struct {
+			Graph    []graphNode   `json:"graph,omitempty"`
+			Mask     string        `json:"mask,omitempty"`
+			Overlays []overlaySpec `json:"overlays,omitempty"`
+		}{task.graph, task.mask, task.overlays})
+		if err != nil {
+			return "", err
+		}
+		key += "|" + string(extra)
+	}
+	for _, path := range task.extraInputs() {
+		digest, err := inputs.digest(path)
+		if err != nil {
+			return "", err
+		}
+		key += "|" + digest
+	}
+	return key, nil
+}
+
+// normalizeEffects returns the effect chain in a canonical textual form.
+// Empty entries are dropped since they leave the image unchanged.
+func normalizeEffects(effects []string) string {
+	normalized := make([]string, 0, len(effects))
+	for _, effect := range effects {
+		if effect != "" {
+			normalized = append(normalized, effect)
+		}
+	}
+	data, _ := json.Marshal(normalized)
+	return string(data)
+}
+
+// upToDate reports whether outPath was already produced from key and still exists
+func (m *cacheManifest) upToDate(outPath, key string) bool {
+	if m == nil || m.force {
+		return false
+	}
+	m.mu.Lock()
+	cached, ok := m.entries[outPath]
+	m.mu.Unlock()
+	if !ok || cached != key {
+		return false
+	}
+	_, err := os.Stat(outPath)
+	return err == nil
+}
+
+// record remembers that outPath was produced from key
+func (m *cacheManifest) record(outPath, key string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries[outPath] != key {
+		m.entries[outPath] = key
+		m.dirty = true
+	}
+}
+
+// save writes the manifest if it changed. The file is replaced atomically by
+// writing a temporary file and renaming it, so readers never see a partial manifest.
+func (m *cacheManifest) save() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	m.dirty = false
+	return nil
+}
@@ -0,0 +1,88 @@
+package scheduler
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCacheSkipsUpToDateOutputs checks that a second run leaves up-to-date outputs
+// alone, while changed effects and the Force flag reprocess the image.
+func TestCacheSkipsUpToDateOutputs(t *testing.T) {
+	images := map[string]image.Image{"a.png": randomImage(16, 16, 4)}
+	root := setupDataDir(t, images, `{"inPath": "a.png", "outPath": "a_out.png", "effects": ["S"]}`)
+	outPath := "../data/out/small_a_out.png"
+	marker := []byte("not a png")
+
+	RunSequential(Config{DataDirs: "small", Mode: "s"})
+	if _, err := os.Stat(manifestPath); err != nil {
+		t.Fatalf("manifest was not written: %v", err)
+	}
+
+	// Replace the output by a marker: an up-to-date task must not overwrite it
+	if err := os.WriteFile(outPath, marker, 0644); err != nil {
+		t.Fatal(err)
+	}
+	RunSequential(Config{DataDirs: "small", Mode: "s"})
+	if data, _ := os.ReadFile(outPath); string(data) != string(marker) {
+		t.Errorf("up-to-date output was reprocessed")
+	}
+
+	// Force reprocesses the image
+	RunParallelSlices(Config{DataDirs: "small", Mode: "parslices", ThreadCount: 2, Force: true})
+	if data, _ := os.ReadFile(outPath); string(data) == string(marker) {
+		t.Errorf("forced run did not reprocess the output")
+	}
+
+	// A changed effect chain invalidates the cached output
+	os.WriteFile(outPath, marker, 0644)
+	effects := `{"inPath": "a.png", "outPath": "a_out.png", "effects": ["S", "B"]}`
+	if err := os.WriteFile(filepath.Join(root, "data/effects.txt"), []byte(effects), 0644); err != nil {
+		t.Fatal(err)
+	}
+	RunSequential(Config{DataDirs: "small", Mode: "s"})
+	if data, _ := os.ReadFile(outPath); string(data) == string(marker) {
+		t.Errorf("output was not reprocessed after the effects changed")
+	}
+}
+
+// TestCacheConcurrentWorkers checks that parfiles workers recording concurrently
+// leave a manifest with an entry for every output.
+func TestCacheConcurrentWorkers(t *testing.T) {
+	images := make(map[string]image.Image)
+	var effects strings.Builder
+	for i := 0; i < 24; i++ {
+		name := fmt.Sprintf("img%d.png", i)
+		images[name] = randomImage(8+i, 8, int64(i))
+		fmt.Fprintf(&effects, `{"inPath": %q, "outPath": "out_%s", "effects": ["B"]}`+"\n", name, name)
+	}
+	setupDataDir(t, images, effects.String())
+
+	RunParallelFiles(Config{DataDirs: "small", Mode: "parfiles", ThreadCount: 6})
+
+	manifest := loadManifest(manifestPath, false)
+	if len(manifest.entries) != len(images) {
+		t.Fatalf("manifest has %d entries, want %d", len(manifest.entries), len(images))
+	}
+	for outPath := range manifest.entries {
+		if _, err := os.Stat(outPath); err != nil {
+			t.Errorf("manifest entry %s has no output: %v", outPath, err)
+		}
+	}
+}
+
+// TestNormalizeEffects checks that equivalent effect chains share a cache key
+func TestNormalizeEffects(t *testing.T) {
+	if a, b := normalizeEffects([]string{"S", "", "B"}), normalizeEffects([]string{"S", "B"}); a != b {
+		t.Errorf("%q and %q should be equal", a, b)
+	}
+	if a, b := normalizeEffects([]string{"S", "B"}), normalizeEffects([]string{"B", "S"}); a == b {
+		t.Errorf("effect order must be part of the key")
+	}
+	if a, b := normalizeEffects([]string{"SB"}), normalizeEffects([]string{"S", "B"}); a == b {
+		t.Errorf("%q and %q must differ", a, b)
+	}
+}
@@ -0,0 +1,322 @@
+/*
+Colour-space effects.
+Conversion steps store another colour space in the three colour channels, so
+the following effects work on it (e.g. "TOHSV", "B", "FROMHSV" blurs hue,
+saturation and value separately):
+
+	TOHSV, FROMHSV  hue, saturation and value (hue scaled from [0, 360) to [0, 256))
+	TOHSL, FROMHSL  hue, saturation and lightness
+	TOYCC, FROMYCC  JPEG YCbCr
+
+Adjustments work on RGB:
+
+	HUE<degrees>    rotates the hue, e.g. "HUE120" or "HUE-45"
+	SAT<factor>     multiplies the HSV saturation, e.g. "SAT1.5" or "SAT0"
+	CURVE:<channels>:<x>,<y>;<x>,<y>...
+	                maps the listed channels (R, G and/or B) through the piecewise
+	                linear curve of the points, e.g. "CURVE:RGB:0,0;64,40;255,255"
+	Y:<effect>      applies a convolution effect to the luminance only and keeps
+	                the chroma of every pixel, e.g. "Y:S" sharpens without colour fringes
+
+Like every effect, they work on row ranges and are split between goroutines by
+applyEffects. Alpha is left unchanged.
+*/
+package scheduler
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pixelOp transforms the colour channels of one pixel in place
+type pixelOp func(px []uint8)
+
+// colourOp returns the per-pixel operation of a colour effect, if it is one
+func colourOp(effect string) (pixelOp, bool) {
+	switch effect {
+	case "TOHSV":
+		return func(px []uint8) {
+			h, s, v := rgbToHSV(px)
+			px[0], px[1], px[2] = hueToByte(h), unitToByte(s), unitToByte(v)
+		}, true
+	case "FROMHSV":
+		return func(px []uint8) {
+			setRGB(px, hsvToRGB(byteToHue(px[0]), byteToUnit(px[1]), byteToUnit(px[2])))
+		}, true
+	case "TOHSL":
+		return func(px []uint8) {
+			h, s, l := rgbToHSL(px)
+			px[0], px[1], px[2] = hueToByte(h), unitToByte(s), unitToByte(l)
+		}, true
+	case "FROMHSL":
+		return func(px []uint8) {
+			setRGB(px, hslToRGB(byteToHue(px[0]), byteToUnit(px[1]), byteToUnit(px[2])))
+		}, true
+	case "TOYCC":
+		return func(px []uint8) { px[0], px[1], px[2] = color.RGBToYCbCr(px[0], px[1], px[2]) }, true
+	case "FROMYCC":
+		return func(px []uint8) { px[0], px[1], px[2] = color.YCbCrToRGB(px[0], px[1], px[2]) }, true
+	}
+
+	if strings.HasPrefix(effect, "HUE") {
+		degrees, err := strconv.ParseFloat(effect[len("HUE"):], 64)
+		if err != nil {
+			return nil, false
+		}
+		return func(px []uint8) {
+			h, s, v := rgbToHSV(px)
+			setRGB(px, hsvToRGB(math.Mod(math.Mod(h+degrees, 360)+360, 360), s, v))
+		}, true
+	}
+	if strings.HasPrefix(effect, "SAT") {
+		factor, err := strconv.ParseFloat(effect[len("SAT"):], 64)
+		if err != nil || factor < 0 {
+			return nil, false
+		}
+		return func(px []uint8) {
+			h, s, v := rgbToHSV(px)
+			setRGB(px, hsvToRGB(h, math.Min(1, s*factor), v))
+		}, true
+	}
+	if strings.HasPrefix(effect, "CURVE:") {
+		lut, ok := parseCurve(effect[len("CURVE:"):])
+		if !ok {
+			return nil, false
+		}
+		return func(px []uint8) { px[0], px[1], px[2] = lut[0][px[0]], lut[1][px[1]], lut[2][px[2]] }, true
+	}
+	return nil, false
+}
+
+// parseCurve parses "<channels>:<x>,<y>;..." into a lookup table per channel.
+// Channels that are not listed map to themselves.
+func parseCurve(spec string) ([3][256]uint8, bool) {
+	var lut [3][256]uint8
+	for c := range lut {
+		for v := range lut[c] {
+			lut[c][v] = uint8(v)
+		}
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return lut, false
+	}
+
+	var points [][2]float64
+	for _, point := range strings.Split(parts[1], ";") {
+		xy := strings.Split(point, ",")
+		if len(xy) != 2 {
+			return lut, false
+		}
+		x, errX := strconv.ParseFloat(xy[0], 64)
+		y, errY := strconv.ParseFloat(xy[1], 64)
+		if errX != nil || errY != nil {
+			return lut, false
+		}
+		points = append(points, [2]float64{x, y})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i][0] < points[j][0] })
+
+	// Piecewise linear through the points, flat before the first and after the last one
+	var curve [256]uint8
+	for v := range curve {
+		x := float64(v)
+		y := points[0][1]
+		for i := 1; i < len(points); i++ {
+			if x >= points[i][0] {
+				y = points[i][1]
+				continue
+			}
+			if x > points[i-1][0] {
+				t := (x - points[i-1][0]) / (points[i][0] - points[i-1][0])
+				y = points[i-1][1] + t*(points[i][1]-points[i-1][1])
+			}
+			break
+		}
+		curve[v] = clampToUint8(y + 0.5)
+	}
+
+	for _, channel := range parts[0] {
+		c := strings.IndexRune("RGB", channel)
+		if c < 0 {
+			return lut, false
+		}
+		lut[c] = curve
+	}
+	return lut, true
+}
+
+// pixelRows applies a per-pixel operation to the rows [startY, endY) of in and writes them to out
+func pixelRows(in, out *image.RGBA, op pixelOp, startY, endY int) {
+	bounds := in.Bounds()
+	rowBytes := bounds.Dx() * 4
+	for y := startY; y < endY; y++ {
+		outRow := out.Pix[(y-bounds.Min.Y)*out.Stride:][:rowBytes]
+		copy(outRow, in.Pix[(y-bounds.Min.Y)*in.Stride:][:rowBytes])
+		for i := 0; i < rowBytes; i += 4 {
+			op(outRow[i : i+4])
+		}
+	}
+}
+
+// lumaKernel returns the kernel of a "Y:<effect>" luminance convolution
+func lumaKernel(effect string) ([]float64, bool) {
+	if !strings.HasPrefix(effect, "Y:") {
+		return nil, false
+	}
+	return effectKernel(effect[len("Y:"):])
+}
+
+// lumaConvolveRows convolves the luminance of the rows [startY, endY) of in with a square
+// kernel (zero-padded like convolveRows) and recombines it with the chroma of every pixel.
+func lumaConvolveRows(in, out *image.RGBA, kernel []float64, startY, endY int) {
+	bounds := in.Bounds()
+	width := bounds.Dx()
+	size := kernelSize(kernel)
+	offset := size / 2
+
+	// Luminance of the rows read by the kernel
+	top, bottom := max(bounds.Min.Y, startY-offset), min(bounds.Max.Y, endY+offset)
+	luma := make([]float64, (bottom-top)*width)
+	for y := top; y < bottom; y++ {
+		row := in.Pix[(y-bounds.Min.Y)*in.Stride:]
+		for x := 0; x < width; x++ {
+			luma[(y-top)*width+x] = 0.299*float64(row[x*4]) + 0.587*float64(row[x*4+1]) + 0.114*float64(row[x*4+2])
+		}
+	}
+
+	for y := startY; y < endY; y++ {
+		inRow := in.Pix[(y-bounds.Min.Y)*in.Stride:]
+		outRow := out.Pix[(y-bounds.Min.Y)*out.Stride:]
+		for x := 0; x < width; x++ {
+			var sum float64
+			for ky := -offset; ky <= offset; ky++ {
+				ny := y + ky
+				if ny < bounds.Min.Y || ny >= bounds.Max.Y {
+					continue
+				}
+				for kx := -offset; kx <= offset; kx++ {
+					nx := x + kx
+					if nx < 0 || nx >= width {
+						continue
+					}
+					sum += luma[(ny-top)*width+nx] * kernel[(ky+offset)*size+kx+offset]
+				}
+			}
+
+			// Keep the chroma: shift every channel by the change of luminance
+			i := x * 4
+			delta := sum - luma[(y-top)*width+x]
+			outRow[i] = clampToUint8(float64(inRow[i]) + delta + 0.5)
+			outRow[i+1] = clampToUint8(float64(inRow[i+1]) + delta + 0.5)
+			outRow[i+2] = clampToUint8(float64(inRow[i+2]) + delta + 0.5)
+			outRow[i+3] = inRow[i+3]
+		}
+	}
+}
+
+// rgbToHSV returns the hue in degrees, saturation and value in [0, 1] of a pixel
+func rgbToHSV(px []uint8) (h, s, v float64) {
+	r, g, b := float64(px[0])/255, float64(px[1])/255, float64(px[2])/255
+	hi, lo := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	h = hue(r, g, b, hi, lo)
+	if hi > 0 {
+		s = (hi - lo) / hi
+	}
+	return h, s, hi
+}
+
+// hsvToRGB converts hue (degrees), saturation and value back to RGB
+func hsvToRGB(h, s, v float64) [3]float64 {
+	chroma := v * s
+	return hueToRGB(h, chroma, v-chroma)
+}
+
+// rgbToHSL returns the hue in degrees, saturation and lightness in [0, 1] of a pixel
+func rgbToHSL(px []uint8) (h, s, l float64) {
+	r, g, b := float64(px[0])/255, float64(px[1])/255, float64(px[2])/255
+	hi, lo := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	h = hue(r, g, b, hi, lo)
+	l = (hi + lo) / 2
+	if hi > lo {
+		s = (hi - lo) / (1 - math.Abs(2*l-1))
+	}
+	return h, s, l
+}
+
+// hslToRGB converts hue (degrees), saturation and lightness back to RGB
+func hslToRGB(h, s, l float64) [3]float64 {
+	chroma := (1 - math.Abs(2*l-1)) * s
+	return hueToRGB(h, chroma, l-chroma/2)
+}
+
+// hue returns the hue in degrees of a colour with the given maximum and minimum channel
+func hue(r, g, b, hi, lo float64) float64 {
+	d := hi - lo
+	if d == 0 {
+		return 0
+	}
+	var h float64
+	switch hi {
+	case r:
+		h = math.Mod((g-b)/d, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return math.Mod(h*60+360, 360)
+}
+
+// hueToRGB returns the RGB channels in [0, 1] of a hue with the given chroma and minimum
+func hueToRGB(h, chroma, lo float64) [3]float64 {
+	sector := h / 60
+	x := chroma * (1 - math.Abs(math.Mod(sector, 2)-1))
+	var r, g, b float64
+	switch {
+	case sector < 1:
+		r, g = chroma, x
+	case sector < 2:
+		r, g = x, chroma
+	case sector < 3:
+		g, b = chroma, x
+	case sector < 4:
+		g, b = x, chroma
+	case sector < 5:
+		r, b = x, chroma
+	default:
+		r, b = chroma, x
+	}
+	return [3]float64{r + lo, g + lo, b + lo}
+}
+
+// setRGB stores RGB channels in [0, 1] into a pixel
+func setRGB(px []uint8, rgb [3]float64) {
+	for c, v := range rgb {
+		px[c] = unitToByte(v)
+	}
+}
+
+// unitToByte converts [0, 1] to [0, 255] with rounding
+func unitToByte(v float64) uint8 {
+	return clampToUint8(v*255 + 0.5)
+}
+
+// byteToUnit converts [0, 255] to [0, 1]
+func byteToUnit(b uint8) float64 {
+	return float64(b) / 255
+}
+
+// hueToByte scales a hue in degrees to [0, 256), so it wraps around like the angle
+func hueToByte(h float64) uint8 {
+	return uint8(int(math.Round(h*256/360)) & 0xff)
+}
+
+// byteToHue scales a stored hue back to degrees
+func byteToHue(b uint8) float64 {
+	return float64(b) * 360 / 256
+}
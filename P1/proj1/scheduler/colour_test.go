@@ -0,0 +1,106 @@
+package scheduler
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// applyOne applies a single effect to a copy of src
+func applyOne(src *image.RGBA, effect string) *image.RGBA {
+	out := image.NewRGBA(src.Bounds())
+	applyEffectRows(effect, src, out, src.Bounds().Min.Y, src.Bounds().Max.Y)
+	return out
+}
+
+// maxDiff returns the largest channel difference of two images of the same size
+func maxDiff(a, b *image.RGBA) int {
+	worst := 0
+	for i := range a.Pix {
+		if d := absInt(int(a.Pix[i]) - int(b.Pix[i])); d > worst {
+			worst = d
+		}
+	}
+	return worst
+}
+
+// TestColourRoundTrips converts to every colour space and back
+func TestColourRoundTrips(t *testing.T) {
+	src := toRGBA(randomImage(40, 30, 21))
+	cases := []struct {
+		to, from  string
+		tolerance int
+	}{
+		{"TOHSV", "FROMHSV", 4}, // The hue is stored with 256 steps
+		{"TOHSL", "FROMHSL", 4},
+		{"TOYCC", "FROMYCC", 2},
+	}
+	for _, c := range cases {
+		if d := maxDiff(src, applyOne(applyOne(src, c.to), c.from)); d > c.tolerance {
+			t.Errorf("%s/%s: round trip differs by %d", c.to, c.from, d)
+		}
+	}
+}
+
+// TestColourAdjustments checks hue rotation, saturation and curves
+func TestColourAdjustments(t *testing.T) {
+	src := toRGBA(randomImage(40, 30, 22))
+	if d := maxDiff(src, applyOne(src, "HUE360")); d > 1 {
+		t.Errorf("HUE360 changed the image by %d", d)
+	}
+	if d := maxDiff(src, applyOne(src, "SAT1")); d > 1 {
+		t.Errorf("SAT1 changed the image by %d", d)
+	}
+
+	red := solid(2, 2, color.RGBA{255, 0, 0, 255})
+	if got := applyOne(red, "HUE120").RGBAAt(0, 0); got != (color.RGBA{0, 255, 0, 255}) {
+		t.Errorf("HUE120 of red = %v, want green", got)
+	}
+	gray := applyOne(src, "SAT0")
+	for i := 0; i < len(gray.Pix); i += 4 {
+		if gray.Pix[i] != gray.Pix[i+1] || gray.Pix[i+1] != gray.Pix[i+2] {
+			t.Fatalf("SAT0 left colour in pixel %d: %v", i/4, gray.Pix[i:i+3])
+		}
+	}
+
+	inverted := applyOne(src, "CURVE:R:0,255;255,0")
+	for i := 0; i < len(src.Pix); i += 4 {
+		if inverted.Pix[i] != 255-src.Pix[i] || inverted.Pix[i+1] != src.Pix[i+1] || inverted.Pix[i+2] != src.Pix[i+2] {
+			t.Fatalf("inverting red changed pixel %d from %v to %v", i/4, src.Pix[i:i+3], inverted.Pix[i:i+3])
+		}
+	}
+	for _, effect := range []string{"CURVE:", "CURVE:R", "CURVE:X:0,0", "CURVE:R:0", "CURVE:R:a,b", "HUEx", "SAT-1"} {
+		if _, ok := colourOp(effect); ok {
+			t.Errorf("%q accepted", effect)
+		}
+	}
+}
+
+// TestLumaConvolution checks that Y:<effect> only changes the luminance
+func TestLumaConvolution(t *testing.T) {
+	// Gray images have no chroma, so Y:S is the plain sharpen (up to rounding)
+	gray := applyOne(toRGBA(randomImage(20, 20, 23)), "G")
+	if d := maxDiff(applyOne(gray, "S"), applyOne(gray, "Y:S")); d > 1 {
+		t.Errorf("Y:S differs from S on a gray image by %d", d)
+	}
+
+	// Without clipping, every channel moves by the same amount
+	rng := rand.New(rand.NewSource(24))
+	src := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(64 + rng.Intn(128))
+	}
+	out := applyOne(src, "Y:B")
+	for y := 1; y < 19; y++ {
+		for x := 1; x < 19; x++ {
+			in, got := src.RGBAAt(x, y), out.RGBAAt(x, y)
+			if int(got.R)-int(got.G) != int(in.R)-int(in.G) || int(got.G)-int(got.B) != int(in.G)-int(in.B) {
+				t.Fatalf("pixel (%d, %d): chroma changed from %v to %v", x, y, in, got)
+			}
+		}
+	}
+	if effectHalo("Y:B3") != 3 {
+		t.Errorf("Y:B3 halo = %d, want 3", effectHalo("Y:B3"))
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Multi-input compositing.
+Besides its input image, a task may reference additional images in the same
+data directory: overlays (e.g. a watermark) drawn on top of the processed image
+at a position, with an opacity and a blend mode, and a mask restricting the
+effects to a region:
+
+	{"inPath": "sky.png", "outPath": "sky_out.png", "effects": ["B5"],
+	 "mask": "sky_mask.png",
+	 "overlays": [{"path": "logo.png", "x": 10, "y": 10, "opacity": 0.5, "mode": "screen"}]}
+
+The brightness of the mask (aligned to the top left corner) is the weight of the
+processed pixels: white applies the effects, black keeps the original and parts
+of the image the mask does not cover are left unchanged. Effect nodes of a graph
+accept a "mask" too. Additional inputs shared by several tasks are decoded once
+per run and read concurrently by every worker.
+*/
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+// overlaySpec is an image drawn on top of the processed image
+type overlaySpec struct {
+	Path    string   `json:"path"`
+	X       int      `json:"x"`                 // Position of the overlay's top left corner
+	Y       int      `json:"y"`                 //
+	Opacity *float64 `json:"opacity,omitempty"` // Opacity in [0, 1] (default 1)
+	Mode    string   `json:"mode,omitempty"`    // over (default), blend, multiply, screen or max
+}
+
+// validateOverlay checks an overlay of an effects.txt line
+func validateOverlay(overlay overlaySpec) error {
+	if overlay.Path == "" {
+		return fmt.Errorf("overlay has no path")
+	}
+	if overlay.Opacity != nil && (*overlay.Opacity < 0 || *overlay.Opacity > 1) {
+		return fmt.Errorf("overlay %s: opacity %v is not in [0, 1]", overlay.Path, *overlay.Opacity)
+	}
+	if _, ok := combineOps[overlay.Mode]; !ok && overlay.Mode != "" && overlay.Mode != "over" {
+		return fmt.Errorf("overlay %s: unknown mode %q", overlay.Path, overlay.Mode)
+	}
+	return nil
+}
+
+// resolveInputs makes the paths of the additional inputs of a task relative to the editor
+func resolveInputs(task *Task, dir string) {
+	resolve := func(path string) string {
+		if path == "" {
+			return ""
+		}
+		return filepath.Join("../data/in", dir, path)
+	}
+	task.mask = resolve(task.mask)
+	for i := range task.overlays {
+		task.overlays[i].Path = resolve(task.overlays[i].Path)
+	}
+	for i := range task.graph {
+		task.graph[i].Mask = resolve(task.graph[i].Mask)
+	}
+}
+
+// extraInputs returns the paths of the images a task reads besides its input
+func (task *Task) extraInputs() []string {
+	var paths []string
+	if task.mask != "" {
+		paths = append(paths, task.mask)
+	}
+	for _, overlay := range task.overlays {
+		paths = append(paths, overlay.Path)
+	}
+	for _, node := range task.graph {
+		if node.Mask != "" {
+			paths = append(paths, node.Mask)
+		}
+	}
+	return paths
+}
+
+// sharedInputs decodes every additional input once per run. The decoded images are
+// read-only: they are shared by all workers and never go back to the buffer pool.
+type sharedInputs struct {
+	mu       sync.Mutex
+	inputs   map[string]*sharedInput
+	archives *archives // Opens the inputs, which may be archive members
+}
+
+// sharedInput is the lazily computed digest and decoded image of an additional input
+type sharedInput struct {
+	digestOnce sync.Once
+	digest     string
+	digestErr  error
+	decodeOnce sync.Once
+	img        *image.RGBA
+	decodeErr  error
+}
+
+// newSharedInputs creates an empty cache of additional inputs read through archives
+func newSharedInputs(archives *archives) *sharedInputs {
+	return &sharedInputs{inputs: make(map[string]*sharedInput), archives: archives}
+}
+
+// get returns the entry of path, creating it on first use
+func (s *sharedInputs) get(path string) *sharedInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	input, ok := s.inputs[path]
+	if !ok {
+		input = &sharedInput{}
+		s.inputs[path] = input
+	}
+	return input
+}
+
+// digest returns the hex SHA-256 of the file at path
+func (s *sharedInputs) digest(path string) (string, error) {
+	input := s.get(path)
+	input.digestOnce.Do(func() {
+		file, err := s.archives.openInput(path)
+		if err != nil {
+			input.digestErr = err
+			return
+		}
+		defer file.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			input.digestErr = err
+			return
+		}
+		input.digest = hex.EncodeToString(hash.Sum(nil))
+	})
+	return input.digest, input.digestErr
+}
+
+// image returns the decoded image at path
+func (s *sharedInputs) image(path string) (*image.RGBA, error) {
+	input := s.get(path)
+	input.decodeOnce.Do(func() {
+		file, err := s.archives.openInput(path)
+		if err != nil {
+			input.decodeErr = err
+			return
+		}
+		defer file.Close()
+		img, _, err := image.Decode(file)
+		if err != nil {
+			input.decodeErr = err
+			return
+		}
+		// A private copy, so the pool never hands out a shared image
+		bounds := img.Bounds()
+		rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+		input.img = rgba
+	})
+	return input.img, input.decodeErr
+}
+
+// applyTask applies the effects (or the graph) of a task to img, masks them and
+// draws the overlays. Like applyEffects it consumes img and returns a pooled buffer.
+func applyTask(img *image.RGBA, task *Task, inputs *sharedInputs, threadCount int) (*image.RGBA, error) {
+	// Load the additional inputs first, so a missing file does not waste the effects
+	extras := make(map[string]*image.RGBA)
+	for _, path := range task.extraInputs() {
+		extra, err := inputs.image(path)
+		if err != nil {
+			pixelBuffers.put(img)
+			return nil, fmt.Errorf("additional input %s: %v", path, err)
+		}
+		extras[path] = extra
+	}
+
+	var original *image.RGBA
+	if task.mask != "" {
+		original = pixelBuffers.get(img.Bounds())
+		defer pixelBuffers.put(original)
+		copyRows(img, original, img.Bounds().Min.Y, img.Bounds().Max.Y)
+	}
+
+	var outImg *image.RGBA
+	if task.graph != nil {
+		outImg = runGraph(img, task.graph, extras, threadCount)
+	} else {
+		outImg = applyEffects(img, task.effects, threadCount)
+	}
+
+	bounds := outImg.Bounds()
+	if original != nil {
+		mask := extras[task.mask]
+		parallelRows(bounds.Dy(), threadCount, func(y0, y1 int) {
+			maskRows(original, outImg, mask, bounds.Min.Y+y0, bounds.Min.Y+y1)
+		})
+	}
+	for _, overlay := range task.overlays {
+		src := extras[overlay.Path]
+		parallelRows(bounds.Dy(), threadCount, func(y0, y1 int) {
+			overlayRows(outImg, src, overlay, bounds.Min.Y+y0, bounds.Min.Y+y1)
+		})
+	}
+	return outImg, nil
+}
+
+// maskRows blends the rows [startY, endY) of processed back towards original, weighting
+// processed by the brightness of the mask. Pixels not covered by the mask keep the original.
+func maskRows(original, processed, mask *image.RGBA, startY, endY int) {
+	bounds := processed.Bounds()
+	width := bounds.Dx()
+	maskWidth := min(width, mask.Rect.Dx())
+
+	for y := startY; y < endY; y++ {
+		origRow := original.Pix[(y-bounds.Min.Y)*original.Stride:][:width*4]
+		outRow := processed.Pix[(y-bounds.Min.Y)*processed.Stride:][:width*4]
+		covered := 0
+		if y-bounds.Min.Y < mask.Rect.Dy() {
+			maskRow := mask.Pix[(y-bounds.Min.Y)*mask.Stride:]
+			covered = maskWidth
+			for x := 0; x < maskWidth; x++ {
+				m := x * 4
+				// Premultiplied, so this is the brightness scaled by the alpha
+				weight := (int(maskRow[m]) + int(maskRow[m+1]) + int(maskRow[m+2])) / 3
+				for c := x * 4; c < x*4+4; c++ {
+					outRow[c] = uint8((int(origRow[c])*(255-weight) + int(outRow[c])*weight + 127) / 255)
+				}
+			}
+		}
+		copy(outRow[covered*4:], origRow[covered*4:])
+	}
+}
+
+// overlayRows draws the part of an overlay within the rows [startY, endY) onto dst
+func overlayRows(dst, src *image.RGBA, overlay overlaySpec, startY, endY int) {
+	bounds := dst.Bounds()
+	opacity := 1.0
+	if overlay.Opacity != nil {
+		opacity = *overlay.Opacity
+	}
+	op, blended := combineOps[overlay.Mode]
+
+	// Clip the overlay to the destination
+	top := max(startY-bounds.Min.Y, overlay.Y)
+	bottom := min(endY-bounds.Min.Y, overlay.Y+src.Rect.Dy())
+	left := max(0, overlay.X)
+	right := min(bounds.Dx(), overlay.X+src.Rect.Dx())
+
+	for y := top; y < bottom; y++ {
+		dstRow := dst.Pix[y*dst.Stride:]
+		srcRow := src.Pix[(y-overlay.Y)*src.Stride:]
+		for x := left; x < right; x++ {
+			d := dstRow[x*4 : x*4+4]
+			s := srcRow[(x-overlay.X)*4 : (x-overlay.X)*4+4]
+			weight := opacity * float64(s[3]) / 255 // Coverage of the overlay pixel
+			for c := 0; c < 3; c++ {
+				if blended {
+					// Blend modes work on the straight (non-premultiplied) overlay colour
+					straight := uint8(0)
+					if s[3] > 0 {
+						straight = uint8(int(s[c]) * 255 / int(s[3]))
+					}
+					mixed := op(d[c], straight, 1)
+					d[c] = clampToUint8(float64(d[c]) + (float64(mixed)-float64(d[c]))*weight + 0.5)
+				} else {
+					// Source over with premultiplied colours
+					d[c] = clampToUint8(float64(s[c])*opacity + float64(d[c])*(1-weight) + 0.5)
+				}
+			}
+			d[3] = clampToUint8(float64(s[3])*opacity + float64(d[3])*(1-weight) + 0.5)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package scheduler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// solid creates an opaque image of a single colour
+func solid(width, height int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+// TestMaskRows checks that the mask selects between the processed and the original pixels
+func TestMaskRows(t *testing.T) {
+	original := solid(6, 4, color.RGBA{10, 20, 30, 255})
+	processed := solid(6, 4, color.RGBA{200, 100, 50, 255})
+
+	// Left half white, right half black; the mask only covers 3 of the 4 rows
+	mask := solid(6, 3, color.RGBA{0, 0, 0, 255})
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			mask.SetRGBA(x, y, color.RGBA{255, 255, 255, 255})
+		}
+	}
+	maskRows(original, processed, mask, 0, 4)
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 6; x++ {
+			want := original.RGBAAt(x, y)
+			if x < 3 && y < 3 {
+				want = color.RGBA{200, 100, 50, 255}
+			}
+			if got := processed.RGBAAt(x, y); got != want {
+				t.Errorf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+// TestOverlayRows checks the position, clipping and opacity of overlays
+func TestOverlayRows(t *testing.T) {
+	half := 0.5
+	logo := solid(4, 4, color.RGBA{255, 255, 255, 255})
+	cases := []struct {
+		name    string
+		overlay overlaySpec
+		inside  image.Rectangle // Pixels covered by the overlay
+		want    color.RGBA      // Colour of the covered pixels
+	}{
+		{"over", overlaySpec{X: 1, Y: 2}, image.Rect(1, 2, 5, 6), color.RGBA{255, 255, 255, 255}},
+		{"clipped", overlaySpec{X: -2, Y: -3}, image.Rect(0, 0, 2, 1), color.RGBA{255, 255, 255, 255}},
+		{"opacity", overlaySpec{X: 0, Y: 0, Opacity: &half}, image.Rect(0, 0, 4, 4), color.RGBA{128, 128, 128, 255}},
+		{"multiply", overlaySpec{X: 6, Y: 6, Mode: "multiply"}, image.Rect(6, 6, 8, 8), color.RGBA{0, 0, 0, 255}},
+	}
+	for _, c := range cases {
+		dst := solid(8, 8, color.RGBA{0, 0, 0, 255})
+		overlayRows(dst, logo, c.overlay, 0, 8)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				want := color.RGBA{0, 0, 0, 255}
+				if image.Pt(x, y).In(c.inside) {
+					want = c.want
+				}
+				if got := dst.RGBAAt(x, y); got != want {
+					t.Errorf("%s: pixel (%d, %d) = %v, want %v", c.name, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestSharedInputsDecodeOnce checks that concurrent workers get the same decoded image
+func TestSharedInputsDecodeOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logo.png")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(file, randomImage(5, 5, 12))
+	file.Close()
+
+	inputs := newSharedInputs(newArchives())
+	images := make([]*image.RGBA, 8)
+	var wg sync.WaitGroup
+	for i := range images {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			img, err := inputs.image(path)
+			if err != nil {
+				t.Error(err)
+			}
+			images[i] = img
+		}(i)
+	}
+	wg.Wait()
+	for _, img := range images[1:] {
+		if img != images[0] {
+			t.Fatal("shared input was decoded more than once")
+		}
+	}
+}
+
+// TestCompositeTasks runs a watermarked and a masked task in every mode, and checks
+// that editing the watermark reprocesses the cached output.
+func TestCompositeTasks(t *testing.T) {
+	images := map[string]image.Image{
+		"a.png":    randomImage(20, 16, 13),
+		"logo.png": randomImage(6, 5, 14),
+		"mask.png": solid(10, 16, color.RGBA{255, 255, 255, 255}),
+	}
+	effects := `{"inPath": "a.png", "outPath": "a_mark.png", "effects": ["G"], "overlays": [{"path": "logo.png", "x": 15, "y": 12, "opacity": 0.7, "mode": "screen"}]}
+{"inPath": "a.png", "outPath": "a_mask.png", "effects": ["E"], "mask": "mask.png", "overlays": [{"path": "logo.png", "x": 1, "y": 1}]}
+{"inPath": "a.png", "outPath": "a_bad.png", "effects": ["E"], "overlays": [{"path": "logo.png", "mode": "xor"}]}
+`
+	root := setupDataDir(t, images, effects)
+
+	RunSequential(Config{DataDirs: "small", Mode: "s", Force: true})
+	expected := readOutputs(t)
+	if len(expected) != 2 {
+		t.Fatalf("sequential run wrote %d files, want 2 (invalid overlay skipped)", len(expected))
+	}
+	for _, config := range []Config{
+		{DataDirs: "small", Mode: "parfiles", ThreadCount: 2, Force: true},
+		{DataDirs: "small", Mode: "parslices", ThreadCount: 3, Force: true},
+		{DataDirs: "small", Mode: "stream", ThreadCount: 2, Force: true},
+	} {
+		Schedule(config)
+		got := readOutputs(t)
+		for file, want := range expected {
+			if !bytes.Equal(want, got[file]) {
+				t.Errorf("%s: %s differs from the sequential output", config.Mode, file)
+			}
+		}
+	}
+
+	// The masked half keeps the original pixels of a.png, under the overlay's rows
+	src := toRGBA(images["a.png"])
+	masked := expected["small_a_mask.png"]
+	for y := 6; y < 16; y++ {
+		for x := 10; x < 20; x++ {
+			i := y*src.Stride + x*4
+			if !bytes.Equal(masked[i:i+4], src.Pix[i:i+4]) {
+				t.Fatalf("masked-out pixel (%d, %d) was modified", x, y)
+			}
+		}
+	}
+
+	// An up-to-date output is skipped until the watermark changes
+	outPath := "../data/out/small_a_mark.png"
+	marker := []byte("not a png")
+	RunSequential(Config{DataDirs: "small", Mode: "s"})
+	os.WriteFile(outPath, marker, 0644)
+	RunSequential(Config{DataDirs: "small", Mode: "s"})
+	if data, _ := os.ReadFile(outPath); !bytes.Equal(data, marker) {
+		t.Errorf("up-to-date output was reprocessed")
+	}
+	logo, err := os.Create(filepath.Join(root, "data/in/small/logo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(logo, randomImage(6, 5, 15))
+	logo.Close()
+	RunSequential(Config{DataDirs: "small", Mode: "s"})
+	if data, _ := os.ReadFile(outPath); bytes.Equal(data, marker) {
+		t.Errorf("output was not reprocessed after the watermark changed")
+	}
+}
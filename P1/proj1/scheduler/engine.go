@@ -0,0 +1,237 @@
+/*
+Pixel engine shared by every scheduling mode.
+All effects work directly on the Pix buffers of *image.RGBA values and are
+applied to a range of rows, so the sequential, parfiles and parslices modes
+only differ in how they split the rows between goroutines. This guarantees
+that every mode produces bit-identical images.
+*/
+package scheduler
+
+import (
+	"image"
+	"image/draw"
+	editorpng "proj1/png"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Convolution kernels of the effects, shared with png.Image
+var (
+	sharpenKernel = editorpng.SharpenKernel
+	edgeKernel    = editorpng.EdgeDetectKernel
+	blurKernel    = editorpng.BlurKernel
+)
+
+// toRGBA returns img as an *image.RGBA, converting it into a pooled buffer if necessary
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	bounds := img.Bounds()
+	rgba := pixelBuffers.get(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// applyEffects applies the effect chain to img, splitting the rows of every effect
+// between threadCount goroutines. img is used as one of the two ping-pong buffers
+// and is overwritten. It returns the buffer holding the final image, which is
+// either img itself or a pooled buffer; the other buffer goes back to the pool.
+func applyEffects(img *image.RGBA, effects []string, threadCount int) *image.RGBA {
+	if len(effects) == 0 {
+		return img
+	}
+	if threadCount < 1 {
+		threadCount = 1
+	}
+
+	inImg := img
+	outImg := pixelBuffers.get(img.Bounds())
+
+	bounds := img.Bounds()
+	height := bounds.Dy()
+	sliceHeight := height / threadCount
+
+	// Apply each effect in sequence, reusing the output buffer by swapping pointers
+	for _, effect := range effects {
+		if kernel, ok := effectKernel(effect); ok && useFFT(kernel) {
+			// The FFT transforms the whole image at once and parallelizes the transforms
+			fftConvolveRows(inImg, outImg, kernel, bounds.Min.Y, bounds.Max.Y, threadCount)
+		} else if threadCount == 1 {
+			applyEffectRows(effect, inImg, outImg, bounds.Min.Y, bounds.Max.Y)
+		} else {
+			var wg sync.WaitGroup
+			for i := 0; i < threadCount; i++ {
+				startY := bounds.Min.Y + i*sliceHeight
+				endY := startY + sliceHeight
+				if i == threadCount-1 {
+					endY = bounds.Max.Y
+				}
+
+				wg.Add(1)
+				go func(start, end int) {
+					defer wg.Done()
+					applyEffectRows(effect, inImg, outImg, start, end)
+				}(startY, endY)
+			}
+			// Nobody may start the next effect before every slice of this one is done
+			wg.Wait()
+		}
+
+		// Swap input and output images for the next effect
+		inImg, outImg = outImg, inImg
+	}
+	pixelBuffers.put(outImg)
+	return inImg
+}
+
+// applyEffectRows applies a single effect to the rows [startY, endY) of in and
+// writes them to out. Unknown effects copy the rows unchanged.
+func applyEffectRows(effect string, in, out *image.RGBA, startY, endY int) {
+	if kernel, ok := effectKernel(effect); ok {
+		convolve(in, out, kernel, startY, endY)
+		return
+	}
+	if kernel, ok := lumaKernel(effect); ok {
+		lumaConvolveRows(in, out, kernel, startY, endY)
+		return
+	}
+	if op, ok := colourOp(effect); ok {
+		pixelRows(in, out, op, startY, endY)
+		return
+	}
+	switch effect {
+	case "G":
+		grayscaleRows(in, out, startY, endY)
+	default:
+		copyRows(in, out, startY, endY)
+	}
+}
+
+// effectKernel returns the convolution kernel of an effect, if it is a convolution.
+// "B<r>" (e.g. "B7") is a box blur of radius r, averaging (2r+1)x(2r+1) pixels.
+func effectKernel(effect string) ([]float64, bool) {
+	switch effect {
+	case "S":
+		return sharpenKernel, true
+	case "E":
+		return edgeKernel, true
+	case "B":
+		return blurKernel, true
+	}
+	if strings.HasPrefix(effect, "B") {
+		radius, err := strconv.Atoi(effect[1:])
+		if err == nil && radius > 0 {
+			return boxKernel(radius), true
+		}
+	}
+	return nil, false
+}
+
+// boxKernel returns the averaging kernel of a box blur of the given radius
+func boxKernel(radius int) []float64 {
+	size := 2*radius + 1
+	kernel := make([]float64, size*size)
+	for i := range kernel {
+		kernel[i] = 1 / float64(size*size)
+	}
+	return kernel
+}
+
+// effectHalo returns how many rows above and below an output row the effect reads
+func effectHalo(effect string) int {
+	if kernel, ok := effectKernel(effect); ok {
+		return kernelSize(kernel) / 2
+	}
+	if kernel, ok := lumaKernel(effect); ok {
+		return kernelSize(kernel) / 2
+	}
+	return 0
+}
+
+// convolve picks the fastest backend for a kernel: the FFT for large kernels,
+// fixed-point arithmetic for 3x3 kernels and float64 direct convolution otherwise.
+func convolve(in, out *image.RGBA, kernel []float64, startY, endY int) {
+	if useFFT(kernel) {
+		fftConvolveRows(in, out, kernel, startY, endY, 1)
+	} else if fixed, ok := toFixedKernel(kernel); ok {
+		convolveRowsFixed(in, out, fixed, startY, endY)
+	} else {
+		convolveRows(in, out, kernel, startY, endY)
+	}
+}
+
+// convolveRows convolves the rows [startY, endY) of in with a square kernel,
+// using zero-padding for neighbours outside of the image bounds.
+func convolveRows(in, out *image.RGBA, kernel []float64, startY, endY int) {
+	bounds := in.Bounds()
+	width := bounds.Dx()
+	size := kernelSize(kernel)
+	offset := size / 2
+
+	for y := startY; y < endY; y++ {
+		outRow := out.Pix[(y-bounds.Min.Y)*out.Stride:]
+		for x := 0; x < width; x++ {
+			var rSum, gSum, bSum float64
+
+			for ky := -offset; ky <= offset; ky++ {
+				ny := y + ky
+				// Zero-padding: Ignore out-of-bounds rows
+				if ny < bounds.Min.Y || ny >= bounds.Max.Y {
+					continue
+				}
+				inRow := in.Pix[(ny-bounds.Min.Y)*in.Stride:]
+				weights := kernel[(ky+offset)*size:]
+
+				for kx := -offset; kx <= offset; kx++ {
+					nx := x + kx
+					// Zero-padding: Ignore out-of-bounds columns
+					if nx < 0 || nx >= width {
+						continue
+					}
+					i := nx * 4
+					weight := weights[kx+offset]
+					rSum += float64(inRow[i]) * weight
+					gSum += float64(inRow[i+1]) * weight
+					bSum += float64(inRow[i+2]) * weight
+				}
+			}
+
+			i := x * 4
+			outRow[i] = clampToUint8(rSum)
+			outRow[i+1] = clampToUint8(gSum)
+			outRow[i+2] = clampToUint8(bSum)
+			outRow[i+3] = 255
+		}
+	}
+}
+
+// grayscaleRows replaces every pixel of the rows [startY, endY) by the integer
+// average of its red, green and blue values.
+func grayscaleRows(in, out *image.RGBA, startY, endY int) {
+	bounds := in.Bounds()
+	width := bounds.Dx()
+
+	for y := startY; y < endY; y++ {
+		inRow := in.Pix[(y-bounds.Min.Y)*in.Stride:]
+		outRow := out.Pix[(y-bounds.Min.Y)*out.Stride:]
+		for x := 0; x < width; x++ {
+			i := x * 4
+			avg := uint8((int(inRow[i]) + int(inRow[i+1]) + int(inRow[i+2])) / 3)
+			outRow[i] = avg
+			outRow[i+1] = avg
+			outRow[i+2] = avg
+			outRow[i+3] = 255
+		}
+	}
+}
+
+// copyRows copies the rows [startY, endY) of in to out
+func copyRows(in, out *image.RGBA, startY, endY int) {
+	bounds := in.Bounds()
+	rowBytes := bounds.Dx() * 4
+	for y := startY; y < endY; y++ {
+		copy(out.Pix[(y-bounds.Min.Y)*out.Stride:][:rowBytes], in.Pix[(y-bounds.Min.Y)*in.Stride:][:rowBytes])
+	}
+}
@@ -0,0 +1,239 @@
+/*
+FFT convolution for large kernels.
+Direct convolution costs k*k operations per pixel for a k x k kernel. Above
+fftKernelThreshold the rows are convolved in the frequency domain instead: the
+region and the kernel are zero-padded to power-of-two sizes, transformed with a
+2D FFT (all rows in parallel, then all columns in parallel), multiplied and
+transformed back. The zero-padding makes the circular convolution equal to the
+direct one with zero-padded image borders; results match the direct path
+within 1 LSB (floating point rounding before the truncation to uint8).
+*/
+package scheduler
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"sync"
+)
+
+// fftKernelThreshold is the smallest kernel size (width in pixels) convolved with the FFT
+const fftKernelThreshold = 15
+
+// useFFT reports whether a square kernel is large enough to be convolved with the FFT
+func useFFT(kernel []float64) bool {
+	return kernelSize(kernel) >= fftKernelThreshold
+}
+
+// kernelSize returns the width of a square kernel
+func kernelSize(kernel []float64) int {
+	return int(math.Sqrt(float64(len(kernel))))
+}
+
+// complexBytes is the size of a complex128
+const complexBytes = 16
+
+// fftFootprint estimates the bytes of the three complex planes (red-green, blue and
+// kernel) the FFT allocates to convolve a whole width x height image with kernel.
+// It is 0 for kernels convolved directly.
+func fftFootprint(kernel []float64, width, height int) int64 {
+	if !useFFT(kernel) {
+		return 0
+	}
+	size := kernelSize(kernel)
+	cols := nextPowerOfTwo(width + size - 1)
+	rows := nextPowerOfTwo(height + size - 1)
+	return 3 * int64(rows) * int64(cols) * complexBytes
+}
+
+// effectsFFTFootprint returns the largest FFT footprint of an effect chain: its
+// effects run one after the other, so the planes of one are freed before the next.
+func effectsFFTFootprint(effects []string, width, height int) int64 {
+	var footprint int64
+	for _, effect := range effects {
+		if kernel, ok := effectKernel(effect); ok {
+			if n := fftFootprint(kernel, width, height); n > footprint {
+				footprint = n
+			}
+		}
+	}
+	return footprint
+}
+
+// fftConvolveRows convolves the rows [startY, endY) of in with a square kernel like
+// convolveRows, using threadCount goroutines for the transforms. Only the rows of in
+// within the kernel radius of [startY, endY) are read.
+func fftConvolveRows(in, out *image.RGBA, kernel []float64, startY, endY, threadCount int) {
+	if startY >= endY {
+		return
+	}
+	bounds := in.Bounds()
+	width := bounds.Dx()
+	size := kernelSize(kernel)
+	offset := size / 2
+
+	// Input region: the output rows plus the halo read by the kernel
+	top := max(bounds.Min.Y, startY-offset)
+	bottom := min(bounds.Max.Y, endY+offset)
+	regionHeight := bottom - top
+
+	// Padding to at least region+kernel-1 avoids wrap-around of the circular convolution
+	cols := nextPowerOfTwo(width + size - 1)
+	rows := nextPowerOfTwo(regionHeight + size - 1)
+
+	// Red and green share one complex plane (real and imaginary part), blue uses a second one.
+	// Since the kernel is real, the convolution keeps the two channels apart.
+	rg := make([]complex128, rows*cols)
+	b := make([]complex128, rows*cols)
+	parallelRows(regionHeight, threadCount, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			inRow := in.Pix[(top+y-bounds.Min.Y)*in.Stride:]
+			for x := 0; x < width; x++ {
+				i := x * 4
+				rg[y*cols+x] = complex(float64(inRow[i]), float64(inRow[i+1]))
+				b[y*cols+x] = complex(float64(inRow[i+2]), 0)
+			}
+		}
+	})
+
+	// The kernel is flipped so the product computes the correlation convolveRows uses,
+	// and shifted so that its centre sits at the origin.
+	k := make([]complex128, rows*cols)
+	for ky := 0; ky < size; ky++ {
+		for kx := 0; kx < size; kx++ {
+			y := (offset - ky + rows) % rows
+			x := (offset - kx + cols) % cols
+			k[y*cols+x] = complex(kernel[ky*size+kx], 0)
+		}
+	}
+
+	fft2D(rg, rows, cols, false, threadCount)
+	fft2D(b, rows, cols, false, threadCount)
+	fft2D(k, rows, cols, false, threadCount)
+	parallelRows(rows, threadCount, func(y0, y1 int) {
+		for i := y0 * cols; i < y1*cols; i++ {
+			rg[i] *= k[i]
+			b[i] *= k[i]
+		}
+	})
+	fft2D(rg, rows, cols, true, threadCount)
+	fft2D(b, rows, cols, true, threadCount)
+
+	parallelRows(endY-startY, threadCount, func(y0, y1 int) {
+		for y := startY + y0; y < startY+y1; y++ {
+			src := (y - top) * cols
+			outRow := out.Pix[(y-bounds.Min.Y)*out.Stride:]
+			for x := 0; x < width; x++ {
+				i := x * 4
+				outRow[i] = clampToUint8(real(rg[src+x]))
+				outRow[i+1] = clampToUint8(imag(rg[src+x]))
+				outRow[i+2] = clampToUint8(real(b[src+x]))
+				outRow[i+3] = 255
+			}
+		}
+	})
+}
+
+// fft2D transforms a rows x cols matrix in place (both powers of two): first every
+// row, then every column, each pass split between threadCount goroutines.
+// The inverse transform is scaled by 1/(rows*cols).
+func fft2D(data []complex128, rows, cols int, inverse bool, threadCount int) {
+	parallelRows(rows, threadCount, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			fft(data[y*cols:(y+1)*cols], inverse)
+		}
+	})
+	parallelRows(cols, threadCount, func(x0, x1 int) {
+		column := make([]complex128, rows)
+		for x := x0; x < x1; x++ {
+			for y := 0; y < rows; y++ {
+				column[y] = data[y*cols+x]
+			}
+			fft(column, inverse)
+			for y := 0; y < rows; y++ {
+				data[y*cols+x] = column[y]
+			}
+		}
+	})
+	if inverse {
+		scale := complex(1/float64(rows*cols), 0)
+		parallelRows(rows, threadCount, func(y0, y1 int) {
+			for i := y0 * cols; i < y1*cols; i++ {
+				data[i] *= scale
+			}
+		})
+	}
+}
+
+// fft computes the discrete Fourier transform of a (length a power of two) in place
+// with the iterative radix-2 Cooley-Tukey algorithm. The inverse is not scaled.
+func fft(a []complex128, inverse bool) {
+	n := len(a)
+	if n <= 1 {
+		return
+	}
+
+	// Bit-reversal permutation
+	shift := 64 - uint(bits.TrailingZeros(uint(n)))
+	for i := 0; i < n; i++ {
+		j := int(bits.Reverse64(uint64(i)) >> shift)
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+
+	sign := -1.0
+	if inverse {
+		sign = 1.0
+	}
+	for length := 2; length <= n; length <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(length))
+		half := length / 2
+		for start := 0; start < n; start += length {
+			w := complex(1, 0)
+			for i := 0; i < half; i++ {
+				u := a[start+i]
+				v := a[start+i+half] * w
+				a[start+i] = u + v
+				a[start+i+half] = u - v
+				w *= step
+			}
+		}
+	}
+}
+
+// nextPowerOfTwo returns the smallest power of two >= n
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// parallelRows splits [0, n) into up to threadCount contiguous ranges and runs fn on them concurrently
+func parallelRows(n, threadCount int, fn func(start, end int)) {
+	if threadCount > n {
+		threadCount = n
+	}
+	if threadCount <= 1 {
+		fn(0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	size := n / threadCount
+	for i := 0; i < threadCount; i++ {
+		start := i * size
+		end := start + size
+		if i == threadCount-1 {
+			end = n
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			fn(start, end)
+		}(start, end)
+	}
+	wg.Wait()
+}
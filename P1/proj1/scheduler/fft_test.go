@@ -0,0 +1,80 @@
+package scheduler
+
+import (
+	"fmt"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+// TestFFTMatchesDirect checks the FFT convolution against the direct one, on whole
+// images and on row ranges (as used by slices and streaming windows).
+func TestFFTMatchesDirect(t *testing.T) {
+	// An asymmetric kernel catches a missing flip, the box blur is the real use case
+	rng := rand.New(rand.NewSource(4))
+	asymmetric := make([]float64, 15*15)
+	for i := range asymmetric {
+		asymmetric[i] = rng.Float64()/100 - 0.002
+	}
+	kernels := map[string][]float64{"asymmetric": asymmetric, "box": boxKernel(9)}
+	ranges := [][2]int{{0, 41}, {0, 1}, {10, 30}, {35, 41}}
+	src := toRGBA(randomImage(53, 41, 5))
+
+	for name, kernel := range kernels {
+		if !useFFT(kernel) {
+			t.Fatalf("%s kernel is below the FFT threshold", name)
+		}
+		direct := image.NewRGBA(src.Bounds())
+		convolveRows(src, direct, kernel, 0, 41)
+
+		for _, r := range ranges {
+			for _, threads := range []int{1, 4} {
+				got := image.NewRGBA(src.Bounds())
+				fftConvolveRows(src, got, kernel, r[0], r[1], threads)
+				for i := r[0] * got.Stride; i < r[1]*got.Stride; i++ {
+					if diff := int(got.Pix[i]) - int(direct.Pix[i]); diff < -1 || diff > 1 {
+						t.Fatalf("%s rows %v, %d threads: byte %d is %d, direct %d", name, r, threads, i, got.Pix[i], direct.Pix[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestFFTRoundTrip checks that the inverse transform restores the input
+func TestFFTRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	rows, cols := 8, 32
+	data := make([]complex128, rows*cols)
+	orig := make([]complex128, rows*cols)
+	for i := range data {
+		data[i] = complex(rng.Float64(), rng.Float64())
+		orig[i] = data[i]
+	}
+	fft2D(data, rows, cols, false, 3)
+	fft2D(data, rows, cols, true, 3)
+	for i := range data {
+		if d := data[i] - orig[i]; real(d)*real(d)+imag(d)*imag(d) > 1e-18 {
+			t.Fatalf("element %d: got %v, want %v", i, data[i], orig[i])
+		}
+	}
+}
+
+// BenchmarkConvolve compares the direct and the FFT convolution around the threshold
+func BenchmarkConvolve(b *testing.B) {
+	src := toRGBA(randomImage(256, 256, 7))
+	out := image.NewRGBA(src.Bounds())
+	for _, radius := range []int{3, 7, 15} {
+		kernel := boxKernel(radius)
+		b.Run(fmt.Sprintf("direct/B%d", radius), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				convolveRows(src, out, kernel, 0, 256)
+			}
+		})
+		b.Run(fmt.Sprintf("fft/B%d", radius), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fftConvolveRows(src, out, kernel, 0, 256, 1)
+			}
+		})
+	}
+}
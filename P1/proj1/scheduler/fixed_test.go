@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"image"
+	"math/rand"
+	"testing"
+)
+
+// TestFixedMatchesFloat checks the fixed-point path against the float64 one:
+// exactly for integer kernels, within 1 LSB for the others.
+func TestFixedMatchesFloat(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	random := make([]float64, 9)
+	for i := range random {
+		random[i] = rng.Float64()*2 - 0.8
+	}
+	kernels := []struct {
+		name   string
+		kernel []float64
+		exact  bool
+	}{
+		{"S", sharpenKernel, true},
+		{"E", edgeKernel, true},
+		{"B", blurKernel, false},
+		{"random", random, false},
+	}
+	sizes := []image.Point{{1, 1}, {1, 5}, {2, 3}, {37, 23}}
+
+	for _, k := range kernels {
+		fixed, ok := toFixedKernel(k.kernel)
+		if !ok {
+			t.Fatalf("%s: kernel not converted to fixed point", k.name)
+		}
+		for _, size := range sizes {
+			src := toRGBA(randomImage(size.X, size.Y, 9))
+			want := image.NewRGBA(src.Bounds())
+			got := image.NewRGBA(src.Bounds())
+			convolveRows(src, want, k.kernel, 0, size.Y)
+			convolveRowsFixed(src, got, fixed, 0, size.Y)
+
+			for i := range want.Pix {
+				diff := int(got.Pix[i]) - int(want.Pix[i])
+				if (k.exact && diff != 0) || diff < -1 || diff > 1 {
+					t.Fatalf("%s %v: byte %d is %d, float path %d", k.name, size, i, got.Pix[i], want.Pix[i])
+				}
+			}
+		}
+	}
+}
+
+// TestToFixedKernelRejects checks the kernels the fixed-point path cannot handle
+func TestToFixedKernelRejects(t *testing.T) {
+	if _, ok := toFixedKernel(boxKernel(2)); ok {
+		t.Error("5x5 kernel accepted")
+	}
+	if _, ok := toFixedKernel([]float64{0, 0, 0, 0, 200, 0, 0, 0, 0}); ok {
+		t.Error("kernel overflowing int32 accepted")
+	}
+}
+
+// BenchmarkKernels compares the float64 and the fixed-point 3x3 convolution
+func BenchmarkKernels(b *testing.B) {
+	src := toRGBA(randomImage(512, 512, 10))
+	out := image.NewRGBA(src.Bounds())
+	kernels := map[string][]float64{"S": sharpenKernel, "E": edgeKernel, "B": blurKernel}
+
+	for name, kernel := range kernels {
+		fixed, _ := toFixedKernel(kernel)
+		b.Run("float/"+name, func(b *testing.B) {
+			b.SetBytes(int64(len(src.Pix)))
+			for i := 0; i < b.N; i++ {
+				convolveRows(src, out, kernel, 0, 512)
+			}
+		})
+		b.Run("fixed/"+name, func(b *testing.B) {
+			b.SetBytes(int64(len(src.Pix)))
+			for i := 0; i < b.N; i++ {
+				convolveRowsFixed(src, out, fixed, 0, 512)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+/*
+Effect graphs.
+Instead of a linear "effects" chain, a task may describe a graph of named
+buffers: effect nodes apply a chain of effects to the input or to another
+buffer, and combine nodes merge buffers with blend, multiply, screen or max.
+For example, an edge map and a blurred copy of the input recombined:
+
+	"graph": [
+	  {"name": "edges", "from": "input", "effects": ["G", "E"]},
+	  {"name": "soft", "from": "input", "effects": ["B3"]},
+	  {"name": "output", "op": "screen", "inputs": ["edges", "soft"]}
+	]
+
+Nodes may only refer to "input" and to nodes listed before them, so every graph
+is acyclic. The node named "output" (or the last node) is written to outPath.
+Nodes whose inputs are ready run concurrently, sharing the thread budget.
+*/
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+)
+
+// graphInput is the reserved name of the decoded input image
+const graphInput = "input"
+
+// graphOutput is the name of the node written to the output file
+const graphOutput = "output"
+
+// graphNode is a named buffer of an effect graph: either the effects applied to
+// another buffer (From and Effects), or the combination of buffers (Op and Inputs).
+type graphNode struct {
+	Name    string   `json:"name"`
+	From    string   `json:"from,omitempty"`    // Source buffer of an effect node (default "input")
+	Effects []string `json:"effects,omitempty"` // Effect chain of an effect node
+	Op      string   `json:"op,omitempty"`      // blend, multiply, screen or max
+	Inputs  []string `json:"inputs,omitempty"`  // Buffers combined left to right by a combine node
+	Amount  *float64 `json:"amount,omitempty"`  // Weight of the later input for blend (default 0.5)
+	Mask    string   `json:"mask,omitempty"`    // Image restricting the effects of an effect node
+}
+
+// sources returns the names of the buffers the node reads
+func (n *graphNode) sources() []string {
+	if n.Op != "" {
+		return n.Inputs
+	}
+	if n.From == "" {
+		return []string{graphInput}
+	}
+	return []string{n.From}
+}
+
+// validateGraph checks that every node is well-formed and only refers to earlier nodes
+func validateGraph(nodes []graphNode) error {
+	if len(nodes) == 0 {
+		return errors.New("empty graph")
+	}
+	defined := map[string]bool{graphInput: true}
+	for i, node := range nodes {
+		if node.Name == "" {
+			return fmt.Errorf("node %d has no name", i)
+		}
+		if defined[node.Name] {
+			return fmt.Errorf("node %q is defined twice (or uses the reserved name %q)", node.Name, graphInput)
+		}
+		if node.Op != "" {
+			if _, ok := combineOps[node.Op]; !ok {
+				return fmt.Errorf("node %q: unknown op %q", node.Name, node.Op)
+			}
+			if len(node.Inputs) < 2 {
+				return fmt.Errorf("node %q: %s needs at least two inputs", node.Name, node.Op)
+			}
+			if len(node.Effects) > 0 || node.From != "" || node.Mask != "" {
+				return fmt.Errorf("node %q: a combine node cannot have from, effects or mask", node.Name)
+			}
+			if node.Amount != nil && (*node.Amount < 0 || *node.Amount > 1) {
+				return fmt.Errorf("node %q: amount %v is not in [0, 1]", node.Name, *node.Amount)
+			}
+		} else if len(node.Inputs) > 0 {
+			return fmt.Errorf("node %q: inputs without an op", node.Name)
+		}
+		for _, source := range node.sources() {
+			if !defined[source] {
+				return fmt.Errorf("node %q: unknown or later buffer %q", node.Name, source)
+			}
+		}
+		defined[node.Name] = true
+	}
+	return nil
+}
+
+// outputNode returns the name of the node written to the output file
+func outputNode(nodes []graphNode) string {
+	for _, node := range nodes {
+		if node.Name == graphOutput {
+			return graphOutput
+		}
+	}
+	return nodes[len(nodes)-1].Name
+}
+
+// graphFootprint estimates the bytes of the extra buffers a graph may hold at once
+func graphFootprint(nodes []graphNode, width, height int) int64 {
+	return int64(len(nodes)) * int64(width) * int64(height) * bytesPerPixel
+}
+
+// runGraph evaluates a validated graph on img and returns the output buffer. Like
+// applyEffects it consumes img: every buffer but the result goes back to the pool.
+// masks holds the decoded mask images of the nodes, by path.
+// Nodes run in waves of the nodes whose sources are ready; the threadCount
+// goroutines are split between the nodes of a wave.
+func runGraph(img *image.RGBA, nodes []graphNode, masks map[string]*image.RGBA, threadCount int) *image.RGBA {
+	if threadCount < 1 {
+		threadCount = 1
+	}
+	output := outputNode(nodes)
+
+	// Count the readers of every buffer to release it after its last one
+	readers := map[string]int{output: 1}
+	for i := range nodes {
+		for _, source := range nodes[i].sources() {
+			readers[source]++
+		}
+	}
+	buffers := map[string]*image.RGBA{graphInput: img}
+	release := func(name string) {
+		if readers[name] == 0 {
+			pixelBuffers.put(buffers[name])
+			delete(buffers, name)
+		}
+	}
+	release(graphInput)
+
+	pending := nodes
+	for len(pending) > 0 {
+		var ready, waiting []graphNode
+		for _, node := range pending {
+			if sourcesReady(node, buffers) {
+				ready = append(ready, node)
+			} else {
+				waiting = append(waiting, node)
+			}
+		}
+
+		// Buffers are only added between waves, so the nodes can read them concurrently
+		results := make([]*image.RGBA, len(ready))
+		concurrent := min(len(ready), threadCount)
+		slots := make(chan int, concurrent)
+		for i := 0; i < concurrent; i++ {
+			threads := threadCount / concurrent
+			if i < threadCount%concurrent {
+				threads++
+			}
+			slots <- threads
+		}
+		var wg sync.WaitGroup
+		for i := range ready {
+			threads := <-slots
+			wg.Add(1)
+			go func(i, threads int) {
+				defer wg.Done()
+				results[i] = runNode(&ready[i], buffers, masks[ready[i].Mask], threads)
+				slots <- threads
+			}(i, threads)
+		}
+		wg.Wait()
+
+		for i := range ready {
+			buffers[ready[i].Name] = results[i]
+			for _, source := range ready[i].sources() {
+				readers[source]--
+				release(source)
+			}
+			release(ready[i].Name)
+		}
+		pending = waiting
+	}
+	return buffers[output]
+}
+
+// sourcesReady reports whether every buffer read by node has been computed
+func sourcesReady(node graphNode, buffers map[string]*image.RGBA) bool {
+	for _, source := range node.sources() {
+		if _, ok := buffers[source]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// runNode computes the buffer of a node with threadCount goroutines.
+// mask restricts the effects of an effect node (nil = whole image).
+func runNode(node *graphNode, buffers map[string]*image.RGBA, mask *image.RGBA, threadCount int) *image.RGBA {
+	if node.Op == "" {
+		// Other nodes may read the source too, so the effects work on a copy
+		src := buffers[node.sources()[0]]
+		bounds := src.Bounds()
+		clone := pixelBuffers.get(bounds)
+		copyRows(src, clone, bounds.Min.Y, bounds.Max.Y)
+		out := applyEffects(clone, node.Effects, threadCount)
+		if mask != nil {
+			parallelRows(bounds.Dy(), threadCount, func(y0, y1 int) {
+				maskRows(src, out, mask, bounds.Min.Y+y0, bounds.Min.Y+y1)
+			})
+		}
+		return out
+	}
+
+	inputs := make([]*image.RGBA, len(node.Inputs))
+	for i, name := range node.Inputs {
+		inputs[i] = buffers[name]
+	}
+	amount := 0.5
+	if node.Amount != nil {
+		amount = *node.Amount
+	}
+	out := pixelBuffers.get(inputs[0].Bounds())
+	bounds := out.Bounds()
+	parallelRows(bounds.Dy(), threadCount, func(y0, y1 int) {
+		combineRows(combineOps[node.Op], amount, inputs, out, bounds.Min.Y+y0, bounds.Min.Y+y1)
+	})
+	return out
+}
+
+// combineOp merges two channel values; amount is the blend weight of b
+type combineOp func(a, b uint8, amount float64) uint8
+
+// combineOps are the operations of combine nodes
+var combineOps = map[string]combineOp{
+	"blend": func(a, b uint8, amount float64) uint8 {
+		return clampToUint8(float64(a)*(1-amount) + float64(b)*amount + 0.5)
+	},
+	"multiply": func(a, b uint8, _ float64) uint8 {
+		return uint8((int(a)*int(b) + 127) / 255)
+	},
+	"screen": func(a, b uint8, _ float64) uint8 {
+		return uint8(255 - ((255-int(a))*(255-int(b))+127)/255)
+	},
+	"max": func(a, b uint8, _ float64) uint8 {
+		if a > b {
+			return a
+		}
+		return b
+	},
+}
+
+// combineRows folds the inputs left to right with op over the rows [startY, endY) and
+// writes them to out. Every channel, alpha included, is combined the same way.
+func combineRows(op combineOp, amount float64, inputs []*image.RGBA, out *image.RGBA, startY, endY int) {
+	bounds := out.Bounds()
+	rowBytes := bounds.Dx() * 4
+	for y := startY; y < endY; y++ {
+		outRow := out.Pix[(y-bounds.Min.Y)*out.Stride:][:rowBytes]
+		copy(outRow, inputs[0].Pix[(y-bounds.Min.Y)*inputs[0].Stride:][:rowBytes])
+		for _, in := range inputs[1:] {
+			inRow := in.Pix[(y-bounds.Min.Y)*in.Stride:][:rowBytes]
+			for i := range outRow {
+				outRow[i] = op(outRow[i], inRow[i], amount)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"strings"
+	"testing"
+)
+
+// parseGraph decodes the nodes of a graph from JSON
+func parseGraph(t *testing.T, text string) []graphNode {
+	t.Helper()
+	var nodes []graphNode
+	if err := json.Unmarshal([]byte(text), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	return nodes
+}
+
+// TestGraphMatchesManualEvaluation evaluates a branching graph with every thread count
+// and compares it to the same steps done by hand.
+func TestGraphMatchesManualEvaluation(t *testing.T) {
+	nodes := parseGraph(t, `[
+		{"name": "edges", "effects": ["G", "E"]},
+		{"name": "soft", "from": "input", "effects": ["B"]},
+		{"name": "unused", "effects": ["S"]},
+		{"name": "mix", "op": "blend", "inputs": ["soft", "input"], "amount": 0.25},
+		{"name": "output", "op": "max", "inputs": ["edges", "mix"]},
+		{"name": "last", "from": "output", "effects": ["B"]}
+	]`)
+	if err := validateGraph(nodes); err != nil {
+		t.Fatal(err)
+	}
+	// runGraph consumes its input, so every run converts a fresh copy of orig
+	orig := randomImage(29, 31, 11)
+	src := toRGBA(orig)
+
+	// By hand: the output node is "output", not the last node
+	edges := applyEffects(toRGBA(orig), []string{"G", "E"}, 1)
+	soft := applyEffects(toRGBA(orig), []string{"B"}, 1)
+	mix := image.NewRGBA(src.Bounds())
+	combineRows(combineOps["blend"], 0.25, []*image.RGBA{soft, src}, mix, 0, 31)
+	want := image.NewRGBA(src.Bounds())
+	combineRows(combineOps["max"], 0, []*image.RGBA{edges, mix}, want, 0, 31)
+
+	for threads := 1; threads <= 8; threads++ {
+		got := runGraph(toRGBA(orig), nodes, nil, threads)
+		if !bytes.Equal(want.Pix, got.Pix) {
+			t.Errorf("%d threads: graph output differs from the manual evaluation", threads)
+		}
+	}
+}
+
+// TestValidateGraph checks that malformed graphs are rejected
+func TestValidateGraph(t *testing.T) {
+	invalid := map[string]string{
+		"empty":          `[]`,
+		"no name":        `[{"effects": ["S"]}]`,
+		"reserved name":  `[{"name": "input", "effects": ["S"]}]`,
+		"duplicate":      `[{"name": "a"}, {"name": "a"}]`,
+		"unknown source": `[{"name": "a", "from": "b"}]`,
+		"later source":   `[{"name": "a", "op": "max", "inputs": ["input", "b"]}, {"name": "b"}]`,
+		"self reference": `[{"name": "a", "from": "a"}]`,
+		"unknown op":     `[{"name": "a", "op": "xor", "inputs": ["input", "input"]}]`,
+		"one input":      `[{"name": "a", "op": "max", "inputs": ["input"]}]`,
+		"inputs, no op":  `[{"name": "a", "inputs": ["input", "input"]}]`,
+		"op and effects": `[{"name": "a", "op": "max", "inputs": ["input", "input"], "effects": ["S"]}]`,
+		"amount":         `[{"name": "a", "op": "blend", "inputs": ["input", "input"], "amount": 1.5}]`,
+	}
+	for name, text := range invalid {
+		if err := validateGraph(parseGraph(t, text)); err == nil {
+			t.Errorf("%s: graph accepted", name)
+		}
+	}
+}
+
+// TestCombineOps checks the combine operations on a few channel values
+func TestCombineOps(t *testing.T) {
+	cases := []struct {
+		op     string
+		a, b   uint8
+		amount float64
+		want   uint8
+	}{
+		{"blend", 0, 255, 0.5, 128},
+		{"blend", 100, 200, 0, 100},
+		{"blend", 100, 200, 1, 200},
+		{"multiply", 255, 77, 0, 77},
+		{"multiply", 128, 128, 0, 64},
+		{"screen", 0, 77, 0, 77},
+		{"screen", 128, 128, 0, 192},
+		{"max", 3, 250, 0, 250},
+	}
+	for _, c := range cases {
+		if got := combineOps[c.op](c.a, c.b, c.amount); got != c.want {
+			t.Errorf("%s(%d, %d, %v) = %d, want %d", c.op, c.a, c.b, c.amount, got, c.want)
+		}
+	}
+}
+
+// TestCacheKeyIncludesGraph checks that editing a graph invalidates the cached output
+func TestCacheKeyIncludesGraph(t *testing.T) {
+	a := &Task{graph: parseGraph(t, `[{"name": "a", "op": "max", "inputs": ["input", "input"]}]`)}
+	b := &Task{graph: parseGraph(t, `[{"name": "a", "op": "screen", "inputs": ["input", "input"]}]`)}
+	keyA, _ := cacheKey(strings.NewReader("png"), a, nil)
+	keyB, _ := cacheKey(strings.NewReader("png"), b, nil)
+	keyLinear, _ := cacheKey(strings.NewReader("png"), &Task{}, nil)
+	if keyA == keyB || keyA == keyLinear {
+		t.Errorf("cache keys do not distinguish the graphs: %q, %q, %q", keyA, keyB, keyLinear)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Memory management for the scheduler.
+A memoryBudget throttles how many decoded bytes may be in flight at once and
+the pixel buffer pool recycles RGBA buffers between images of the same size.
+*/
+package scheduler
+
+import (
+	"image"
+	"sync"
+)
+
+// bytesPerPixel of an *image.RGBA buffer
+const bytesPerPixel = 4
+
+// imageFootprint estimates the memory needed to process a width x height image:
+// the decoded source plus the two RGBA buffers the effects ping-pong between.
+func imageFootprint(width, height int) int64 {
+	return 3 * int64(width) * int64(height) * bytesPerPixel
+}
+
+// taskFootprint estimates the memory needed by a task: the image itself, the buffers
+// of its effect graph, the copy of the original kept for its mask and the complex
+// planes of its FFT convolutions. The effect nodes of a graph may run at once, so
+// their FFT planes add up. Shared additional inputs are decoded once per run and
+// not counted.
+func taskFootprint(task *Task, width, height int) int64 {
+	footprint := imageFootprint(width, height) + graphFootprint(task.graph, width, height)
+	if task.mask != "" {
+		footprint += int64(width) * int64(height) * bytesPerPixel
+	}
+	footprint += effectsFFTFootprint(task.effects, width, height)
+	for _, node := range task.graph {
+		footprint += effectsFFTFootprint(node.Effects, width, height)
+	}
+	return footprint
+}
+
+// memoryBudget limits the number of bytes reserved by concurrently processed images.
+// A nil *memoryBudget is unlimited.
+type memoryBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64 // maximum number of bytes in flight
+	used  int64 // bytes currently reserved
+}
+
+// newMemoryBudget creates a budget of limit bytes (nil if limit <= 0, i.e. unlimited)
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	budget := &memoryBudget{limit: limit}
+	budget.cond = sync.NewCond(&budget.mu)
+	return budget
+}
+
+// acquire blocks until n bytes fit into the budget and reserves them.
+// An image larger than the whole budget is admitted once nothing else is in flight,
+// so it is processed on its own instead of blocking forever.
+func (b *memoryBudget) acquire(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used > 0 && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+// release returns n previously acquired bytes to the budget
+func (b *memoryBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// bufferPool recycles RGBA pixel buffers, keyed by image size
+type bufferPool struct {
+	mu    sync.Mutex
+	pools map[image.Point]*sync.Pool
+}
+
+// pixelBuffers is the buffer pool shared by every scheduling mode
+var pixelBuffers = &bufferPool{pools: make(map[image.Point]*sync.Pool)}
+
+// pool returns the pool holding buffers of the given size
+func (p *bufferPool) pool(size image.Point) *sync.Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, ok := p.pools[size]
+	if !ok {
+		pool = &sync.Pool{}
+		p.pools[size] = pool
+	}
+	return pool
+}
+
+// get returns an RGBA buffer covering bounds. Its pixels are not cleared.
+func (p *bufferPool) get(bounds image.Rectangle) *image.RGBA {
+	if buf, ok := p.pool(bounds.Size()).Get().(*image.RGBA); ok {
+		buf.Rect = bounds
+		return buf
+	}
+	return image.NewRGBA(bounds)
+}
+
+// put hands a buffer back to the pool. The caller must not use it afterwards.
+func (p *bufferPool) put(buf *image.RGBA) {
+	if buf == nil || buf.Stride != buf.Rect.Dx()*bytesPerPixel {
+		return // Sub-images share their Pix with a larger buffer
+	}
+	p.pool(buf.Rect.Size()).Put(buf)
+}
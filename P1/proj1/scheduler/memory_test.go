@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"image"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestMemoryBudgetLimit checks that concurrent reservations never exceed the limit
+// and that a reservation larger than the whole budget is still admitted alone.
+func TestMemoryBudgetLimit(t *testing.T) {
+	const limit = 100
+	budget := newMemoryBudget(limit)
+	var inFlight int64
+	var wg sync.WaitGroup
+
+	sizes := []int64{10, 40, 60, 30, 250, 70, 20, 90, 50, 5}
+	for i := 0; i < 20; i++ {
+		for _, size := range sizes {
+			wg.Add(1)
+			go func(n int64) {
+				defer wg.Done()
+				budget.acquire(n)
+				current := atomic.AddInt64(&inFlight, n)
+				if n <= limit && current > limit {
+					t.Errorf("%d bytes in flight exceed the limit of %d", current, limit)
+				}
+				if n > limit && current != n {
+					t.Errorf("oversized reservation of %d shared the budget (%d in flight)", n, current)
+				}
+				atomic.AddInt64(&inFlight, -n)
+				budget.release(n)
+			}(size)
+		}
+	}
+	wg.Wait()
+
+	if budget.used != 0 {
+		t.Errorf("budget still has %d bytes reserved", budget.used)
+	}
+}
+
+// TestBufferPoolReuse checks that buffers are handed out with the requested bounds
+func TestBufferPoolReuse(t *testing.T) {
+	pool := &bufferPool{pools: make(map[image.Point]*sync.Pool)}
+	buf := pool.get(image.Rect(0, 0, 8, 4))
+	pool.put(buf)
+
+	moved := pool.get(image.Rect(3, 5, 11, 9))
+	if moved.Bounds() != image.Rect(3, 5, 11, 9) || len(moved.Pix) != 8*4*bytesPerPixel {
+		t.Errorf("got buffer with bounds %v and %d bytes", moved.Bounds(), len(moved.Pix))
+	}
+	if other := pool.get(image.Rect(0, 0, 4, 8)); len(other.Pix) != 4*8*bytesPerPixel || other.Stride != 4*bytesPerPixel {
+		t.Errorf("buffer of a different size has stride %d", other.Stride)
+	}
+}
+
+// TestTaskFootprintFFT checks that the complex planes of FFT convolutions are counted
+func TestTaskFootprintFFT(t *testing.T) {
+	const width, height = 100, 60
+	direct := taskFootprint(&Task{effects: []string{"B", "S"}}, width, height)
+	if direct != imageFootprint(width, height) {
+		t.Errorf("direct convolutions: footprint %d, expected %d", direct, imageFootprint(width, height))
+	}
+
+	// B7 is a 15x15 kernel: planes of nextPowerOfTwo(114) x nextPowerOfTwo(74)
+	planes := int64(3 * 128 * 128 * complexBytes)
+	if got := taskFootprint(&Task{effects: []string{"B7", "S", "B7"}}, width, height); got != direct+planes {
+		t.Errorf("FFT chain: footprint %d, expected %d", got, direct+planes)
+	}
+
+	graph := []graphNode{
+		{Name: "a", From: graphInput, Effects: []string{"B7"}},
+		{Name: "b", From: graphInput, Effects: []string{"B7"}},
+	}
+	expected := imageFootprint(width, height) + graphFootprint(graph, width, height) + 2*planes
+	if got := taskFootprint(&Task{graph: graph}, width, height); got != expected {
+		t.Errorf("FFT graph: footprint %d, expected %d", got, expected)
+	}
+}
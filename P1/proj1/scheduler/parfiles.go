@@ -9,19 +9,63 @@ import (
 	"fmt"
 	"image"
 	"image/png"
+	"io"
 	"os"
 	"path/filepath"
+	editorpng "proj1/png"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 // Hold each image processing job's information
 type Task struct {
-	inPath  string
-	outPath string
-	effects []string
+	inPath   string
+	outPath  string
+	effects  []string
+	graph    []graphNode   // Effect graph used instead of the effects chain (nil = linear chain)
+	mask     string        // Image restricting the effects to a region ("" = whole image)
+	overlays []overlaySpec // Images drawn on top of the processed image
+}
+
+// effectSpec is one line of effects.txt
+type effectSpec struct {
+	InPath   string        `json:"inPath"`
+	OutPath  string        `json:"outPath"`
+	Effects  []string      `json:"effects"`
+	Graph    []graphNode   `json:"graph"`
+	Mask     string        `json:"mask"`
+	Overlays []overlaySpec `json:"overlays"`
+}
+
+// newTask creates the task of an effects.txt line for the data directory dir.
+// It fails if the line has an invalid effect graph.
+func newTask(dir string, spec effectSpec) (*Task, error) {
+	if spec.Graph != nil {
+		if len(spec.Effects) > 0 {
+			return nil, fmt.Errorf("%s: effects and graph cannot be combined", spec.InPath)
+		}
+		if err := validateGraph(spec.Graph); err != nil {
+			return nil, fmt.Errorf("%s: invalid effect graph: %v", spec.InPath, err)
+		}
+	}
+	for _, overlay := range spec.Overlays {
+		if err := validateOverlay(overlay); err != nil {
+			return nil, fmt.Errorf("%s: %v", spec.InPath, err)
+		}
+	}
+	// Prefix output path with the current directory name. Graph and overlays are
+	// copied since resolveInputs rewrites their paths for every directory.
+	task := &Task{
+		inPath:   filepath.Join("../data/in", dir, spec.InPath),
+		outPath:  filepath.Join("../data/out", fmt.Sprintf("%s_%s", dataDirName(dir), spec.OutPath)),
+		effects:  spec.Effects,
+		graph:    append([]graphNode(nil), spec.Graph...),
+		mask:     spec.Mask,
+		overlays: append([]overlaySpec(nil), spec.Overlays...),
+	}
+	resolveInputs(task, dir)
+	return task, nil
 }
 
 // Queue with enqueue and dequeue methods
@@ -42,6 +86,40 @@ func (q *TaskQueue) Dequeue() *Task {
 	return task
 }
 
+// loadTasks populates a queue with one task per image of effects.txt and data directory
+func loadTasks(config Config) *TaskQueue {
+	// Split the data directories by "+" and process each one
+	dataDirs := strings.Split(config.DataDirs, "+")
+	queue := &TaskQueue{}
+
+	// Populate the queue with tasks from each specified directory
+	for _, dir := range dataDirs {
+		effectsPathFile := "../data/effects.txt"
+		effectsFile, err := os.Open(effectsPathFile)
+		if err != nil {
+			panic("Failed to open effects file")
+		}
+
+		// JSON decoder
+		decoder := json.NewDecoder(effectsFile)
+		for decoder.More() {
+			var effect effectSpec
+			err := decoder.Decode(&effect)
+			if err != nil {
+				panic("Failed to decode JSON")
+			}
+			task, err := newTask(dir, effect)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			queue.Enqueue(task)
+		}
+		effectsFile.Close()
+	}
+	return queue
+}
+
 /*
 TAS lock implementation (to safeguard accesses to the queue)
 Items can only be taken out of the queue by a Go routine that holds the lock.
@@ -65,51 +143,10 @@ RunParallelFiles Function
 This function populates the task queue, spawns goroutines, and uses the TAS lock to synchronize access.
 */
 func RunParallelFiles(config Config) {
-	// Split the data directories by "+" and process each one
-	dataDirs := strings.Split(config.DataDirs, "+")
-
-	// Open effects file
-	effectsPathFile := "../data/effects.txt"
-	effectsFile, err := os.Open(effectsPathFile)
-	if err != nil {
-		panic("Failed to open effects file")
-	}
-	defer effectsFile.Close()
-
-	// Create task queue and TAS lock
-	queue := &TaskQueue{}
+	// Create task queue, TAS lock and the environment (memory budget, ...) shared by the workers
+	queue := loadTasks(config)
 	lock := &TASLock{}
-
-	// Populate the queue with tasks from each specified directory
-	for _, dir := range dataDirs {
-		effectsPathFile := "../data/effects.txt"
-		effectsFile, err := os.Open(effectsPathFile)
-		if err != nil {
-			panic("Failed to open effects file")
-		}
-		defer effectsFile.Close()
-
-		// JSON decoder
-		decoder := json.NewDecoder(effectsFile)
-		for decoder.More() {
-			var effect struct {
-				InPath  string   `json:"inPath"`
-				OutPath string   `json:"outPath"`
-				Effects []string `json:"effects"`
-			}
-			err := decoder.Decode(&effect)
-			if err != nil {
-				panic("Failed to decode JSON")
-			}
-			// Prefix output path with the current directory name
-			task := &Task{
-				inPath:  filepath.Join("../data/in", dir, effect.InPath),
-				outPath: filepath.Join("../data/out", fmt.Sprintf("%s_%s", dir, effect.OutPath)),
-				effects: effect.Effects,
-			}
-			queue.Enqueue(task)
-		}
-	}
+	env := newRunEnv(config)
 
 	// Spawn Go routines
 	numGoroutines := min(config.ThreadCount, len(queue.tasks)) // min(command line threads, mun of images the queue)
@@ -117,7 +154,7 @@ func RunParallelFiles(config Config) {
 	wg.Add(numGoroutines)
 
 	// Start timer for the parallel section
-	startParallel := time.Now()
+	//startParallel := time.Now()
 
 	// Worker function for each goroutine
 	worker := func() {
@@ -136,7 +173,7 @@ func RunParallelFiles(config Config) {
 			}
 
 			// Have goroutine process the image
-			processImage(task)
+			processImage(task, 1, env)
 
 			// End timer and calculate duration for this image
 			//parallelDuration := time.Since(startParallel).Seconds()
@@ -152,6 +189,7 @@ func RunParallelFiles(config Config) {
 
 	// Wait for all goroutines to terminate
 	wg.Wait()
+	env.finish()
 
 	// End timer for the parallel section and calculate duration
 	//parallelDuration := time.Since(startParallel).Seconds()
@@ -167,47 +205,169 @@ func min(a, b int) int {
 	return b
 }
 
-// Process an image based on the task
-func processImage(task *Task) {
+// Helper to get maximum of two integers
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// runEnv holds the state shared by every image of a run
+type runEnv struct {
+	budget        *memoryBudget  // Limits the decoded bytes in flight (nil = unlimited)
+	encodeThreads int            // Goroutines of the parallel PNG encoder (0 = image/png)
+	cache         *cacheManifest // Outputs that are up to date with their input and effects
+	inputs        *sharedInputs  // Additional inputs (overlays, masks) decoded once per run
+	archives      *archives      // Zip archives the inputs are read from
+	outZip        *outputZip     // Zip file collecting the outputs (nil = files in ../data/out)
+}
+
+// newRunEnv creates the shared state of a run from its configuration.
+// Outputs written to a zip are always reprocessed, since the zip is rewritten every run.
+func newRunEnv(config Config) *runEnv {
+	env := &runEnv{
+		budget:        newMemoryBudget(config.MaxInFlightBytes),
+		encodeThreads: config.EncodeThreads,
+		archives:      newArchives(),
+	}
+	env.inputs = newSharedInputs(env.archives)
+	if config.OutputZip != "" {
+		outZip, err := createOutputZip(config.OutputZip)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to create output zip %s: %v", config.OutputZip, err))
+		}
+		env.outZip = outZip
+	} else {
+		env.cache = loadManifest(manifestPath, config.Force)
+	}
+	return env
+}
+
+// writeOutput writes the output file of a task, or its member of the output zip, with encode.
+// Files are written atomically: encode writes a temporary file next to outPath, which
+// replaces outPath only once it is complete, so readers never see a partial output.
+func (env *runEnv) writeOutput(outPath string, encode func(w io.Writer) error) error {
+	if env.outZip != nil {
+		member := env.outZip.create(outPath)
+		if err := encode(member); err != nil {
+			return err
+		}
+		return member.Close()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(outPath), "."+filepath.Base(outPath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	err = encode(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), outPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// finish persists the state of a finished run
+func (env *runEnv) finish() {
+	if err := env.cache.save(); err != nil {
+		fmt.Printf("Failed to save cache manifest %s: %v\n", manifestPath, err)
+	}
+	if env.outZip != nil {
+		if err := env.outZip.close(); err != nil {
+			fmt.Printf("Failed to write output zip: %v\n", err)
+		}
+	}
+	env.archives.close()
+}
+
+// Process an image based on the task.
+// The rows of every effect are split between threadCount goroutines (1 processes the image sequentially).
+// Tasks whose output is up to date according to the cache manifest are skipped.
+// The image is only decoded once its estimated footprint fits into the memory budget.
+// Animated GIFs are processed frame by frame and written as animated GIFs.
+func processImage(task *Task, threadCount int, env *runEnv) {
 	// Open the input image
-	imgFile, err := os.Open(task.inPath)
+	imgFile, err := env.archives.openInput(task.inPath)
 	if err != nil {
 		fmt.Printf("Failed to open image file %s: %v\n", task.inPath, err)
 		return
 	}
 	defer imgFile.Close()
 
-	img, _, err := image.Decode(imgFile)
+	// Skip the task if neither the input nor the effect chain changed
+	key, err := cacheKey(imgFile, task, env.inputs)
+	if err != nil {
+		fmt.Printf("Failed to read image file %s: %v\n", task.inPath, err)
+		return
+	}
+	if env.cache.upToDate(task.outPath, key) {
+		return
+	}
+	if _, err := imgFile.Seek(0, io.SeekStart); err != nil {
+		fmt.Printf("Failed to rewind image file %s: %v\n", task.inPath, err)
+		return
+	}
+
+	// Animated GIFs keep all of their frames
+	anim, err := decodeAnimation(imgFile)
 	if err != nil {
 		fmt.Printf("Failed to decode image %s: %v\n", task.inPath, err)
 		return
 	}
-	outImg := img
-
-	// Apply each effect in sequence
-	for _, ef := range task.effects {
-		switch ef {
-		case "S":
-			outImg = ApplyKernel(outImg, []float64{0, -1, 0, -1, 5, -1, 0, -1, 0})
-		case "E":
-			outImg = ApplyKernel(outImg, []float64{-1, -1, -1, -1, 8, -1, -1, -1, -1})
-		case "B":
-			outImg = ApplyKernel(outImg, []float64{1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9, 1.0 / 9})
-		case "G":
-			outImg = ApplyGrayscale(outImg)
-		}
+	if anim != nil {
+		processAnimation(anim, task, key, threadCount, env)
+		return
 	}
 
-	// Save the processed image
-	outFile, err := os.Create(task.outPath)
+	// Read the header to reserve the decoded size before decoding the pixels
+	header, _, err := image.DecodeConfig(imgFile)
+	if err != nil {
+		fmt.Printf("Failed to decode image %s: %v\n", task.inPath, err)
+		return
+	}
+	if _, err := imgFile.Seek(0, io.SeekStart); err != nil {
+		fmt.Printf("Failed to rewind image file %s: %v\n", task.inPath, err)
+		return
+	}
+	footprint := taskFootprint(task, header.Width, header.Height)
+	env.budget.acquire(footprint)
+	defer env.budget.release(footprint)
+
+	img, _, err := image.Decode(imgFile)
 	if err != nil {
-		fmt.Printf("Failed to create output file %s: %v\n", task.outPath, err)
+		fmt.Printf("Failed to decode image %s: %v\n", task.inPath, err)
 		return
 	}
-	defer outFile.Close()
 
-	err = png.Encode(outFile, outImg)
+	// Apply each effect in sequence (or evaluate the effect graph), then the mask and overlays
+	outImg, err := applyTask(toRGBA(img), task, env.inputs, threadCount)
+	if err != nil {
+		fmt.Printf("Failed to process image %s: %v\n", task.inPath, err)
+		return
+	}
+	defer pixelBuffers.put(outImg)
+
+	// Save the processed image
+	err = env.writeOutput(task.outPath, func(w io.Writer) error {
+		return encodeImage(w, outImg, env.encodeThreads)
+	})
 	if err != nil {
 		fmt.Printf("Failed to encode image %s: %v\n", task.outPath, err)
+		return
+	}
+	env.cache.record(task.outPath, key)
+}
+
+// encodeImage writes img as a PNG, with the parallel encoder if encodeThreads > 0
+func encodeImage(w io.Writer, img *image.RGBA, encodeThreads int) error {
+	if encodeThreads > 0 {
+		return editorpng.EncodeParallel(w, img, encodeThreads)
 	}
+	return png.Encode(w, img)
 }
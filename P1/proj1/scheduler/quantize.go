@@ -0,0 +1,224 @@
+/*
+Adaptive palettes for GIF output.
+Frames with at most 256 colours keep them exactly. Other frames are reduced
+with median cut: the colours are counted in a 5 bits per channel histogram,
+the box of buckets with the most pixels is repeatedly split at the median of
+its widest channel, and every box becomes the mean of the pixels it holds.
+*/
+package scheduler
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// maxPaletteSize is the number of colours of a GIF palette
+const maxPaletteSize = 256
+
+// alphaThreshold is the alpha below which a pixel becomes the transparent index
+const alphaThreshold = 128
+
+// quantize converts img to a paletted image with an adaptive palette of at most
+// 256 colours. Pixels with alpha below alphaThreshold use a transparent entry.
+func quantize(img *image.RGBA) *image.Paletted {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+
+	// Straight colours of the pixels (GIF has no partial transparency), transparent flagged
+	straight := func(p []uint8) (color.RGBA, bool) {
+		if p[3] < alphaThreshold {
+			return color.RGBA{}, true
+		}
+		if p[3] == 255 {
+			return color.RGBA{p[0], p[1], p[2], 255}, false
+		}
+		a := int(p[3])
+		return color.RGBA{uint8(int(p[0]) * 255 / a), uint8(int(p[1]) * 255 / a), uint8(int(p[2]) * 255 / a), 255}, false
+	}
+
+	transparent := false
+	for y := 0; y < bounds.Dy() && !transparent; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			if row[x*4+3] < alphaThreshold {
+				transparent = true
+				break
+			}
+		}
+	}
+	colours := maxPaletteSize
+	if transparent {
+		colours--
+	}
+
+	// Exact palette if the frame has few colours
+	exact := make(map[color.RGBA]uint8)
+	for y := 0; y < bounds.Dy() && len(exact) <= colours; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			if c, clear := straight(row[x*4 : x*4+4]); !clear {
+				if _, ok := exact[c]; !ok {
+					exact[c] = uint8(len(exact))
+				}
+			}
+		}
+	}
+
+	var palette color.Palette
+	var index func(c color.RGBA) uint8
+	if len(exact) <= colours {
+		palette = make(color.Palette, len(exact))
+		for c, i := range exact {
+			palette[i] = c
+		}
+		index = func(c color.RGBA) uint8 { return exact[c] }
+	} else {
+		var lut []uint8
+		palette, lut = medianCut(img, colours, straight)
+		index = func(c color.RGBA) uint8 { return lut[bucketOf(c)] }
+	}
+	transparentIndex := uint8(len(palette))
+	if transparent {
+		palette = append(palette, color.RGBA{})
+	}
+
+	out := image.NewPaletted(bounds, palette)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[y*img.Stride:]
+		outRow := out.Pix[y*out.Stride:]
+		for x := 0; x < width; x++ {
+			c, clear := straight(row[x*4 : x*4+4])
+			if clear {
+				outRow[x] = transparentIndex
+			} else {
+				outRow[x] = index(c)
+			}
+		}
+	}
+	return out
+}
+
+// bucketOf returns the histogram bucket of a colour (5 bits per channel)
+func bucketOf(c color.RGBA) int {
+	return int(c.R>>3)<<10 | int(c.G>>3)<<5 | int(c.B>>3)
+}
+
+// colourBucket is a histogram bucket with the sums of the colours that fell into it
+type colourBucket struct {
+	index  int
+	count  int
+	sum    [3]int
+	coarse [3]uint8 // 5-bit channel values of the bucket
+}
+
+// medianCut builds a palette of at most colours entries and a lookup table from
+// histogram bucket to palette index.
+func medianCut(img *image.RGBA, colours int, straight func([]uint8) (color.RGBA, bool)) (color.Palette, []uint8) {
+	bounds := img.Bounds()
+	histogram := make([]colourBucket, 1<<15)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < bounds.Dx(); x++ {
+			c, clear := straight(row[x*4 : x*4+4])
+			if clear {
+				continue
+			}
+			b := &histogram[bucketOf(c)]
+			b.count++
+			b.sum[0] += int(c.R)
+			b.sum[1] += int(c.G)
+			b.sum[2] += int(c.B)
+		}
+	}
+	var used []colourBucket
+	for i, b := range histogram {
+		if b.count > 0 {
+			b.index = i
+			b.coarse = [3]uint8{uint8(i >> 10), uint8(i >> 5 & 31), uint8(i & 31)}
+			used = append(used, b)
+		}
+	}
+
+	// Split the most populated box until there are enough boxes or none can be split
+	boxes := [][]colourBucket{used}
+	for len(boxes) < colours {
+		best, bestCount := -1, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			count := 0
+			for _, b := range box {
+				count += b.count
+			}
+			if count > bestCount {
+				best, bestCount = i, count
+			}
+		}
+		if best < 0 {
+			break
+		}
+		low, high := splitBox(boxes[best], bestCount)
+		boxes[best] = low
+		boxes = append(boxes, high)
+	}
+
+	palette := make(color.Palette, len(boxes))
+	lut := make([]uint8, 1<<15)
+	for i, box := range boxes {
+		var count int
+		var sum [3]int
+		for _, b := range box {
+			count += b.count
+			for c := range sum {
+				sum[c] += b.sum[c]
+			}
+			lut[b.index] = uint8(i)
+		}
+		palette[i] = color.RGBA{uint8(sum[0] / count), uint8(sum[1] / count), uint8(sum[2] / count), 255}
+	}
+	return palette, lut
+}
+
+// splitBox sorts a box along its widest channel and splits it at the pixel median
+func splitBox(box []colourBucket, count int) ([]colourBucket, []colourBucket) {
+	channel, widest := 0, -1
+	for c := 0; c < 3; c++ {
+		lo, hi := uint8(31), uint8(0)
+		for _, b := range box {
+			lo = minUint8(lo, b.coarse[c])
+			hi = maxUint8(hi, b.coarse[c])
+		}
+		if int(hi)-int(lo) > widest {
+			channel, widest = c, int(hi)-int(lo)
+		}
+	}
+	sort.Slice(box, func(i, j int) bool { return box[i].coarse[channel] < box[j].coarse[channel] })
+
+	// Both halves keep at least one bucket
+	seen := 0
+	for i := 0; i < len(box)-1; i++ {
+		seen += box[i].count
+		if seen*2 >= count {
+			return box[:i+1], box[i+1:]
+		}
+	}
+	return box[:len(box)-1], box[len(box)-1:]
+}
+
+// minUint8 returns the smaller of two bytes
+func minUint8(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// maxUint8 returns the larger of two bytes
+func maxUint8(a, b uint8) uint8 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -1,12 +1,20 @@
 package scheduler
 
+import "time"
+
 type Config struct {
-	DataDirs string //Represents the data directories to use to load the images.
-	Mode     string // Represents which scheduler scheme to use
-	ThreadCount int // Runs parallel version with the specified number of threads
+	DataDirs         string        //Represents the data directories to use to load the images.
+	Mode             string        // Represents which scheduler scheme to use
+	ThreadCount      int           // Runs parallel version with the specified number of threads
+	MaxInFlightBytes int64         // Limits the estimated decoded bytes of images processed at once (0 = unlimited)
+	EncodeThreads    int           // Writes PNGs with the parallel encoder using this many goroutines (0 = image/png)
+	Force            bool          // Reprocesses every image, even if the cache manifest says it is up to date
+	WindowRows       int           // Output rows per window in the streaming mode (0 = default)
+	OutputZip        string        // Writes the outputs into this zip file instead of ../data/out ("" = files)
+	PollInterval     time.Duration // Time between two polls of the watch mode (0 = default)
 }
 
-//Run the correct version based on the Mode field of the configuration value
+// Run the correct version based on the Mode field of the configuration value
 func Schedule(config Config) {
 	if config.Mode == "s" {
 		RunSequential(config)
@@ -14,6 +22,10 @@ func Schedule(config Config) {
 		RunParallelFiles(config)
 	} else if config.Mode == "parslices" {
 		RunParallelSlices(config)
+	} else if config.Mode == "stream" {
+		RunStreaming(config)
+	} else if config.Mode == "watch" {
+		RunWatch(config)
 	} else {
 		panic("Invalid scheduling scheme given.")
 	}
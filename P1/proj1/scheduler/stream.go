@@ -0,0 +1,208 @@
+/*
+Out-of-core streaming of images larger than memory.
+Images are decoded row by row and cut into windows of a fixed number of output
+rows plus the halo of input rows the effect chain reads around them. Windows are
+processed in parallel and their rows are written to the output in order, so the
+memory used is bounded by the window size, not by the image height.
+*/
+package scheduler
+
+import (
+	"fmt"
+	"image"
+	"io"
+	editorpng "proj1/png"
+	"sync"
+)
+
+// defaultWindowRows is the window height used when Config.WindowRows is not set
+const defaultWindowRows = 256
+
+// RunStreaming processes the images one after the other, streaming each of them
+// through windows of rows processed by ThreadCount goroutines.
+func RunStreaming(config Config) {
+	queue := loadTasks(config)
+	env := newRunEnv(config)
+
+	threadCount := max(1, config.ThreadCount)
+	windowRows := config.WindowRows
+	if windowRows <= 0 {
+		windowRows = defaultWindowRows
+	}
+
+	for task := queue.Dequeue(); task != nil; task = queue.Dequeue() {
+		streamImage(task, threadCount, windowRows, env)
+	}
+	env.finish()
+}
+
+// rowWindow is a band of output rows together with the input rows it depends on
+type rowWindow struct {
+	index        int         // Position of the window in the image
+	startY, endY int         // Output rows [startY, endY) of the window
+	img          *image.RGBA // Input rows including the halo, then the processed rows
+}
+
+// streamImage applies the task's effects to its image window by window.
+// Images that cannot be streamed (e.g. interlaced PNGs, effect graphs, tasks with
+// additional inputs) are processed as a whole.
+func streamImage(task *Task, threadCount, windowRows int, env *runEnv) {
+	if task.graph != nil || len(task.extraInputs()) > 0 {
+		processImage(task, threadCount, env)
+		return
+	}
+	imgFile, err := env.archives.openInput(task.inPath)
+	if err != nil {
+		fmt.Printf("Failed to open image file %s: %v\n", task.inPath, err)
+		return
+	}
+	defer imgFile.Close()
+
+	// Skip the task if neither the input nor the effect chain changed
+	key, err := cacheKey(imgFile, task, env.inputs)
+	if err != nil {
+		fmt.Printf("Failed to read image file %s: %v\n", task.inPath, err)
+		return
+	}
+	if env.cache.upToDate(task.outPath, key) {
+		return
+	}
+	if _, err := imgFile.Seek(0, io.SeekStart); err != nil {
+		fmt.Printf("Failed to rewind image file %s: %v\n", task.inPath, err)
+		return
+	}
+
+	reader, err := editorpng.NewRowReader(imgFile)
+	if err != nil {
+		processImage(task, threadCount, env)
+		return
+	}
+	defer reader.Close()
+
+	err = env.writeOutput(task.outPath, func(w io.Writer) error {
+		writer, err := editorpng.NewRowWriter(w, reader.Width, reader.Height)
+		if err != nil {
+			return err
+		}
+		if err := streamWindows(reader, writer, task.effects, threadCount, windowRows); err != nil {
+			return err
+		}
+		return writer.Close()
+	})
+	if err != nil {
+		fmt.Printf("Failed to stream image %s to %s: %v\n", task.inPath, task.outPath, err)
+		return
+	}
+	env.cache.record(task.outPath, key)
+}
+
+// streamWindows reads the image, processes its windows with threadCount workers and
+// writes the output rows in order. At most 2*threadCount windows are in flight.
+func streamWindows(reader *editorpng.RowReader, writer *editorpng.RowWriter, effects []string, threadCount, windowRows int) error {
+	width, height := reader.Width, reader.Height
+	halo := 0
+	for _, effect := range effects {
+		halo += effectHalo(effect)
+	}
+
+	jobs := make(chan *rowWindow, threadCount)
+	results := make(chan *rowWindow, threadCount)
+	slots := make(chan struct{}, 2*threadCount)
+
+	// Workers apply the effect chain to whole windows
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for window := range jobs {
+				window.img = applyWindowEffects(window.img, effects, window.startY, window.endY, halo)
+				results <- window
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// The writer puts the windows back in order; after an error it keeps draining
+	writeErr := make(chan error, 1)
+	go func() {
+		var err error
+		pending := make(map[int]*rowWindow)
+		next := 0
+		for window := range results {
+			pending[window.index] = window
+			for w, ok := pending[next]; ok; w, ok = pending[next] {
+				for y := w.startY; y < w.endY && err == nil; y++ {
+					offset := (y - w.img.Rect.Min.Y) * w.img.Stride
+					err = writer.WriteRow(w.img.Pix[offset : offset+width*bytesPerPixel])
+				}
+				pixelBuffers.put(w.img)
+				delete(pending, next)
+				next++
+				<-slots
+			}
+		}
+		writeErr <- err
+	}()
+
+	// The reader keeps the rows shared by consecutive windows and cuts the image into windows
+	readErr := func() error {
+		var rows [][]byte // Decoded rows [bufStart, bufStart+len(rows))
+		bufStart := 0
+		for index, startY := 0, 0; startY < height; index, startY = index+1, startY+windowRows {
+			endY := min(height, startY+windowRows)
+			top, bottom := max(0, startY-halo), min(height, endY+halo)
+
+			for bufStart+len(rows) < bottom {
+				row := make([]byte, width*bytesPerPixel)
+				if err := reader.ReadRow(row); err != nil {
+					return err
+				}
+				rows = append(rows, row)
+			}
+
+			slots <- struct{}{}
+			img := pixelBuffers.get(image.Rect(0, top, width, bottom))
+			for y := top; y < bottom; y++ {
+				copy(img.Pix[(y-top)*img.Stride:], rows[y-bufStart])
+			}
+			jobs <- &rowWindow{index: index, startY: startY, endY: endY, img: img}
+
+			// Rows above the next window's halo are no longer needed
+			if nextTop := max(0, endY-halo); nextTop > bufStart {
+				rows = rows[min(len(rows), nextTop-bufStart):]
+				bufStart = nextTop
+			}
+		}
+		return nil
+	}()
+	close(jobs)
+
+	if err := <-writeErr; err != nil {
+		return err
+	}
+	return readErr
+}
+
+// applyWindowEffects applies the effect chain to a window whose input covers the output
+// rows [startY, endY) plus halo rows on each side (clipped to the image). After every
+// effect only the rows still needed by the remaining effects are computed, so rows next
+// to the window edges are never read once they became invalid.
+func applyWindowEffects(window *image.RGBA, effects []string, startY, endY, halo int) *image.RGBA {
+	inImg := window
+	outImg := pixelBuffers.get(window.Rect)
+	remaining := halo
+
+	for _, effect := range effects {
+		remaining -= effectHalo(effect)
+		from := max(window.Rect.Min.Y, startY-remaining)
+		to := min(window.Rect.Max.Y, endY+remaining)
+		applyEffectRows(effect, inImg, outImg, from, to)
+		inImg, outImg = outImg, inImg
+	}
+	pixelBuffers.put(outImg)
+	return inImg
+}
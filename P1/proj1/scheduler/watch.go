@@ -0,0 +1,250 @@
+/*
+Watch-folder daemon.
+The watch mode keeps running and processes the images arriving in the data
+directories. The directories are polled, which works the same on every
+platform. Each one has its own spec, ../data/in/<dir>/watch.json, with the
+fields of an effects.txt line except inPath and outPath:
+
+	{"effects": ["G", "B3"], "overlays": [{"path": "logo.png", "x": 10, "y": 10}]}
+
+The spec applies to every PNG and GIF of the directory except the additional
+inputs it names; sky.png is written to ../data/out/<dir>_sky_out.png (.gif for
+GIF inputs). The spec is re-read on every poll and a changed spec applies to
+every image again. An image is queued once its size and modification time stayed
+the same between two polls, so files that are still being copied are not read
+half-written, and it is queued again whenever it changes.
+The queued images are processed by a persistent pool of workers that each
+handle one image at a time, as in the parfiles mode. Outputs replace the
+previous ones atomically. On SIGINT or SIGTERM the daemon stops polling,
+finishes the images in progress and saves the cache manifest.
+*/
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// watchSpecName is the file holding the spec of a watched directory
+const watchSpecName = "watch.json"
+
+// defaultPollInterval is the time between two polls when Config.PollInterval is 0
+const defaultPollInterval = time.Second
+
+// watchedDir is the state of a watched data directory between polls
+type watchedDir struct {
+	name     string
+	polled   bool                    // The directory was polled before
+	spec     []byte                  // Content of the spec at the last poll (nil = missing)
+	template *effectSpec             // Parsed spec (nil = missing or invalid)
+	files    map[string]*watchedFile // Images seen at the last poll, by name
+}
+
+// watchedFile is the last seen state of an image
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	queued  bool // Handed to the workers since it last changed
+}
+
+// RunWatch processes the images arriving in the data directories until SIGINT or SIGTERM
+func RunWatch(config Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	watch(ctx, config)
+}
+
+// watch polls the data directories and processes their images until ctx is done
+func watch(ctx context.Context, config Config) {
+	interval := config.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	env := newRunEnv(config)
+
+	var dirs []*watchedDir
+	for _, dir := range strings.Split(config.DataDirs, "+") {
+		if strings.HasSuffix(strings.ToLower(dir), archiveExt) {
+			fmt.Printf("Cannot watch the archive %s, skipping it\n", dir)
+			continue
+		}
+		dirs = append(dirs, &watchedDir{name: dir, files: make(map[string]*watchedFile)})
+	}
+
+	// Persistent worker pool: every worker processes one image at a time
+	tasks := make(chan *Task)
+	var wg sync.WaitGroup
+	for i := 0; i < max(1, config.ThreadCount); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				processImage(task, 1, env)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+polling:
+	for {
+		for _, dir := range dirs {
+			for _, task := range dir.poll() {
+				select {
+				case tasks <- task:
+				case <-ctx.Done():
+					break polling
+				}
+			}
+		}
+		// Keep the manifest current in case the daemon is killed
+		if err := env.cache.save(); err != nil {
+			fmt.Printf("Failed to save cache manifest %s: %v\n", manifestPath, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			break polling
+		}
+	}
+
+	// Images waiting in the directories are picked up by the next run
+	close(tasks)
+	wg.Wait()
+	env.finish()
+}
+
+// poll lists the directory and returns the tasks of the images that are new or changed
+// and stayed unchanged since the previous poll
+func (d *watchedDir) poll() []*Task {
+	root := filepath.Join("../data/in", d.name)
+	specPath := filepath.Join(root, watchSpecName)
+	spec, err := os.ReadFile(specPath)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Failed to read %s: %v\n", specPath, err)
+		return nil
+	}
+	if !d.polled || !bytes.Equal(spec, d.spec) {
+		d.polled = true
+		d.spec = spec
+		d.template = nil
+		for _, file := range d.files {
+			file.queued = false
+		}
+		if spec == nil {
+			fmt.Printf("%s has no %s, its images wait for one\n", root, watchSpecName)
+		} else if template, err := parseWatchSpec(d.name, spec); err != nil {
+			fmt.Printf("Invalid %s: %v\n", specPath, err)
+		} else {
+			d.template = template
+		}
+	}
+	if d.template == nil {
+		return nil
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		fmt.Printf("Failed to list %s: %v\n", root, err)
+		return nil
+	}
+	// The masks and overlays of the spec are inputs, not images to process
+	extras := make(map[string]bool)
+	if task, err := newTask(d.name, *d.template); err == nil {
+		for _, path := range task.extraInputs() {
+			extras[path] = true
+		}
+	}
+
+	var tasks []*Task
+	present := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !watchedImage(name) || extras[filepath.Join(root, name)] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		present[name] = true
+
+		// New or still changing: wait for one more poll
+		file, ok := d.files[name]
+		if !ok || file.size != info.Size() || !file.modTime.Equal(info.ModTime()) {
+			d.files[name] = &watchedFile{size: info.Size(), modTime: info.ModTime()}
+			continue
+		}
+		if file.queued {
+			continue
+		}
+		file.queued = true
+
+		spec := *d.template
+		spec.InPath = name
+		spec.OutPath = watchOutputName(name, animatedGIF(filepath.Join(root, name)))
+		task, err := newTask(d.name, spec)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	for name := range d.files {
+		if !present[name] {
+			delete(d.files, name)
+		}
+	}
+	return tasks
+}
+
+// parseWatchSpec decodes the spec of a watched directory and checks its graph and overlays
+func parseWatchSpec(dir string, data []byte) (*effectSpec, error) {
+	var spec effectSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	spec.InPath, spec.OutPath = "", ""
+	if _, err := newTask(dir, spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// watchedImage reports whether a file of a watched directory is an image to process.
+// Hidden files, such as the temporary files of copy tools, are skipped.
+func watchedImage(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return !strings.HasPrefix(name, ".") && (ext == ".png" || ext == ".gif")
+}
+
+// watchOutputName returns the output name of an image of a watched directory. Like
+// processImage, only animated GIFs are written as GIFs, every other image as a PNG.
+func watchOutputName(name string, animated bool) string {
+	outExt := ".png"
+	if animated {
+		outExt = ".gif"
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "_out" + outExt
+}
+
+// animatedGIF reports whether the file at path is a GIF that processImage handles
+// as an animation
+func animatedGIF(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	anim, err := decodeAnimation(file)
+	return err == nil && anim != nil
+}
@@ -0,0 +1,186 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeAtomically writes img as a PNG (a GIF for a .gif path) to path the way a
+// well-behaved producer drops files into a watched directory: into a hidden file,
+// then renamed.
+func writeAtomically(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".part")
+	file, err := os.Create(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(path) == ".gif" {
+		err = gif.Encode(file, img, nil)
+	} else {
+		err = png.Encode(file, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForOutput polls path until its decoded pixels equal want
+func waitForOutput(t *testing.T, path string, want []byte) {
+	t.Helper()
+	var got []byte
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		img, err := png.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if got = toRGBA(img).Pix; bytes.Equal(got, want) {
+			return
+		}
+	}
+	t.Fatalf("%s: expected output not written (last read %d bytes)", path, len(got))
+}
+
+// TestWatch checks that the daemon processes arriving and changed images with the
+// directory's spec, skips the spec's additional inputs and stops when cancelled.
+func TestWatch(t *testing.T) {
+	logo := randomImage(4, 4, 30)
+	root := setupDataDir(t, map[string]image.Image{"logo.png": logo}, "")
+	spec := `{"effects": ["G", "B"], "overlays": [{"path": "logo.png", "x": 1, "y": 2}]}`
+	dir := filepath.Join(root, "data/in/small")
+	if err := os.WriteFile(filepath.Join(dir, watchSpecName), []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	template, err := parseWatchSpec("small", []byte(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expected output of an image processed with the spec
+	expected := func(img image.Image) []byte {
+		spec := *template
+		spec.InPath, spec.OutPath = "a.png", "a_out.png"
+		task, err := newTask("small", spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := applyTask(toRGBA(img), task, newSharedInputs(newArchives()), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.Pix
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watch(ctx, Config{DataDirs: "small", Mode: "watch", ThreadCount: 2, PollInterval: 10 * time.Millisecond})
+		close(done)
+	}()
+
+	first := randomImage(23, 19, 31)
+	writeAtomically(t, filepath.Join(dir, "a.png"), first)
+	waitForOutput(t, "../data/out/small_a_out.png", expected(first))
+
+	second := randomImage(23, 19, 32)
+	writeAtomically(t, filepath.Join(dir, "a.png"), second)
+	waitForOutput(t, "../data/out/small_a_out.png", expected(second))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch did not stop after cancellation")
+	}
+
+	entries, err := os.ReadDir("../data/out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "small_a_out.png" {
+			t.Errorf("unexpected output %s (temporary file or processed overlay)", entry.Name())
+		}
+	}
+	if _, err := os.Stat(manifestPath); err != nil {
+		t.Errorf("cache manifest not saved: %v", err)
+	}
+}
+
+// TestWatchOutputName checks the output names and the files that are watched
+func TestWatchOutputName(t *testing.T) {
+	names := map[string]string{"sky.png": "sky_out.png", "anim.GIF": "anim_out.gif", "a.b.png": "a.b_out.png"}
+	for name, want := range names {
+		if got := watchOutputName(name, strings.HasSuffix(want, ".gif")); got != want {
+			t.Errorf("watchOutputName(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if got := watchOutputName("still.gif", false); got != "still_out.png" {
+		t.Errorf("still GIF written as %q", got)
+	}
+	for _, name := range []string{"watch.json", ".sky.png.part", "notes.txt", ".hidden.png"} {
+		if watchedImage(name) {
+			t.Errorf("%s should not be processed", name)
+		}
+	}
+	if !watchedImage("sky.PNG") || strings.Contains(watchOutputName("sky.PNG", false), "PNG") {
+		t.Error("upper-case extensions are not handled")
+	}
+}
+
+// TestWatchStillGIF checks that a single-frame GIF, which processImage writes as a
+// PNG, gets a .png output name
+func TestWatchStillGIF(t *testing.T) {
+	root := setupDataDir(t, nil, "")
+	dir := filepath.Join(root, "data/in/small")
+	if err := os.WriteFile(filepath.Join(dir, watchSpecName), []byte(`{"effects": ["G"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watch(ctx, Config{DataDirs: "small", Mode: "watch", ThreadCount: 2, PollInterval: 10 * time.Millisecond})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	path := filepath.Join(dir, "still.gif")
+	writeAtomically(t, path, randomImage(17, 11, 33))
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	still, err := gif.Decode(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := pixelBuffers.get(still.Bounds())
+	grayscaleRows(toRGBA(still), expected, still.Bounds().Min.Y, still.Bounds().Max.Y)
+	waitForOutput(t, "../data/out/small_still_out.png", expected.Pix)
+
+	if _, err := os.Stat("../data/out/small_still_out.gif"); !os.IsNotExist(err) {
+		t.Errorf("still GIF written with a .gif name: %v", err)
+	}
+}
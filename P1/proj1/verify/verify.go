@@ -0,0 +1,281 @@
+/*
+Package verify compares the output images produced by different scheduler
+modes. Two output directories are compared image by image and, for every
+file, the maximum absolute channel difference, the PSNR and the SSIM are
+reported. A diff heatmap is written for every file that does not match.
+*/
+package verify
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Result holds the comparison metrics for a single image
+type Result struct {
+	Name    string  // File name (relative to the compared directories)
+	MaxDiff int     // Maximum absolute difference over all R, G, B channels
+	PSNR    float64 // Peak signal-to-noise ratio in dB (+Inf for identical images)
+	SSIM    float64 // Mean structural similarity of the luminance channel
+	Err     error   // Set when the pair could not be compared (missing file, size mismatch, ...)
+}
+
+// Within reports whether the result is within the given maximum absolute difference
+func (r Result) Within(tolerance int) bool {
+	return r.Err == nil && r.MaxDiff <= tolerance
+}
+
+// CompareDirs compares every PNG image of dirA with the image of the same name in dirB.
+// An image found in only one of the directories is a mismatch.
+// A heatmap is written into heatDir for every pair whose maximum difference exceeds
+// the tolerance (heatDir is created on demand, an empty heatDir disables heatmaps).
+// It returns the per-file results and whether all images are within tolerance.
+func CompareDirs(dirA, dirB, heatDir string, tolerance int) ([]Result, bool, error) {
+	namesA, err := pngNames(dirA)
+	if err != nil {
+		return nil, false, err
+	}
+	namesB, err := pngNames(dirB)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var names []string
+	for name := range namesA {
+		names = append(names, name)
+	}
+	for name := range namesB {
+		if !namesA[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	results := make([]Result, 0, len(names))
+	ok := true
+	for _, name := range names {
+		var result Result
+		var heatmap *image.RGBA
+		if namesA[name] {
+			result, heatmap = compareFiles(filepath.Join(dirA, name), filepath.Join(dirB, name))
+		} else {
+			result.Err = fmt.Errorf("no %s in %s", name, dirA)
+		}
+		result.Name = name
+
+		if !result.Within(tolerance) {
+			ok = false
+			if heatmap != nil && heatDir != "" {
+				if err := writeHeatmap(filepath.Join(heatDir, name), heatmap); err != nil {
+					return results, false, err
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results, ok, nil
+}
+
+// pngNames returns the names of the PNG files of dir
+func pngNames(dir string) (map[string]bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".png") {
+			names[entry.Name()] = true
+		}
+	}
+	return names, nil
+}
+
+// compareFiles loads both images and compares them
+func compareFiles(pathA, pathB string) (Result, *image.RGBA) {
+	imgA, err := loadRGBA(pathA)
+	if err != nil {
+		return Result{Err: err}, nil
+	}
+	imgB, err := loadRGBA(pathB)
+	if err != nil {
+		return Result{Err: err}, nil
+	}
+	return Compare(imgA, imgB)
+}
+
+// Compare computes the metrics of two images and returns a heatmap of their
+// per-pixel maximum channel difference.
+func Compare(a, b *image.RGBA) (Result, *image.RGBA) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return Result{Err: fmt.Errorf("size mismatch: %v vs %v", a.Bounds().Size(), b.Bounds().Size())}, nil
+	}
+
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	diffs := make([]uint8, width*height)
+	maxDiff := 0
+	var squared float64
+
+	for y := 0; y < height; y++ {
+		rowA := a.Pix[y*a.Stride : y*a.Stride+width*4]
+		rowB := b.Pix[y*b.Stride : y*b.Stride+width*4]
+		for x := 0; x < width; x++ {
+			pixelDiff := 0
+			for c := 0; c < 3; c++ {
+				d := int(rowA[x*4+c]) - int(rowB[x*4+c])
+				squared += float64(d * d)
+				if d < 0 {
+					d = -d
+				}
+				if d > pixelDiff {
+					pixelDiff = d
+				}
+			}
+			diffs[y*width+x] = uint8(pixelDiff)
+			if pixelDiff > maxDiff {
+				maxDiff = pixelDiff
+			}
+		}
+	}
+
+	result := Result{MaxDiff: maxDiff, PSNR: math.Inf(1), SSIM: ssim(a, b)}
+	if squared > 0 {
+		mse := squared / float64(width*height*3)
+		result.PSNR = 10 * math.Log10(255*255/mse)
+	}
+	return result, heatmap(diffs, width, height, maxDiff)
+}
+
+// SSIM constants for 8-bit images
+const (
+	ssimWindow = 8
+	ssimC1     = (0.01 * 255) * (0.01 * 255)
+	ssimC2     = (0.03 * 255) * (0.03 * 255)
+)
+
+// ssim computes the mean SSIM of the luminance of two same-sized images over
+// 8x8 windows placed every 4 pixels.
+func ssim(a, b *image.RGBA) float64 {
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	lumA, lumB := luminance(a), luminance(b)
+
+	window := ssimWindow
+	if width < window || height < window {
+		window = min(width, height)
+	}
+	if window == 0 {
+		return 1
+	}
+	step := max(1, window/2)
+
+	var total float64
+	count := 0
+	for y := 0; y+window <= height; y += step {
+		for x := 0; x+window <= width; x += step {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for wy := y; wy < y+window; wy++ {
+				for wx := x; wx < x+window; wx++ {
+					va, vb := lumA[wy*width+wx], lumB[wy*width+wx]
+					sumA += va
+					sumB += vb
+					sumAA += va * va
+					sumBB += vb * vb
+					sumAB += va * vb
+				}
+			}
+			n := float64(window * window)
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			covAB := sumAB/n - meanA*meanB
+
+			total += ((2*meanA*meanB + ssimC1) * (2*covAB + ssimC2)) /
+				((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+			count++
+		}
+	}
+	return total / float64(count)
+}
+
+// luminance returns the Rec. 601 luma of every pixel
+func luminance(img *image.RGBA) []float64 {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	lum := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			lum[y*width+x] = 0.299*float64(row[x*4]) + 0.587*float64(row[x*4+1]) + 0.114*float64(row[x*4+2])
+		}
+	}
+	return lum
+}
+
+// heatmap renders the per-pixel differences from black (equal) through red to
+// yellow (largest difference of the image).
+func heatmap(diffs []uint8, width, height, maxDiff int) *image.RGBA {
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	if maxDiff == 0 {
+		maxDiff = 1
+	}
+	for i, d := range diffs {
+		v := int(d) * 255 / maxDiff
+		out.Pix[i*4] = uint8(min(255, 2*v))
+		out.Pix[i*4+1] = uint8(max(0, 2*v-255))
+		out.Pix[i*4+3] = 255
+	}
+	return out
+}
+
+// loadRGBA decodes a PNG file into an RGBA buffer
+func loadRGBA(path string) (*image.RGBA, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoded, err := png.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	bounds := decoded.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), decoded, bounds.Min, draw.Src)
+	return rgba, nil
+}
+
+// writeHeatmap saves a heatmap as a PNG file
+func writeHeatmap(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return png.Encode(file, img)
+}
+
+// min returns the smaller of two integers
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// max returns the larger of two integers
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,147 @@
+package verify
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// uniform returns a width x height opaque image filled with the gray level v
+func uniform(width, height int, v uint8) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = v, v, v, 255
+	}
+	return img
+}
+
+// writePNG saves img as a PNG file in dir
+func writePNG(t *testing.T, dir, name string, img image.Image) {
+	t.Helper()
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompareIdentical(t *testing.T) {
+	a := uniform(16, 16, 100)
+	a.Set(3, 5, color.RGBA{200, 10, 50, 255})
+	b := uniform(16, 16, 100)
+	b.Set(3, 5, color.RGBA{200, 10, 50, 255})
+
+	result, heat := Compare(a, b)
+	if result.Err != nil || result.MaxDiff != 0 || !math.IsInf(result.PSNR, 1) || math.Abs(result.SSIM-1) > 1e-9 {
+		t.Errorf("Identical images: %+v", result)
+	}
+	for i := 0; i < len(heat.Pix); i += 4 {
+		if heat.Pix[i] != 0 || heat.Pix[i+1] != 0 {
+			t.Fatalf("Heatmap of identical images is not black at byte %d", i)
+		}
+	}
+}
+
+func TestCompareKnownDifference(t *testing.T) {
+	// One channel of one pixel differs by 10
+	a := uniform(16, 16, 100)
+	b := uniform(16, 16, 100)
+	b.Pix[b.PixOffset(7, 9)] = 110
+
+	result, heat := Compare(a, b)
+	if result.Err != nil || result.MaxDiff != 10 {
+		t.Fatalf("Got %+v, expected a maximum difference of 10", result)
+	}
+	expectedPSNR := 10 * math.Log10(255*255/(100.0/(16*16*3)))
+	if math.Abs(result.PSNR-expectedPSNR) > 1e-9 {
+		t.Errorf("PSNR is %f, expected %f", result.PSNR, expectedPSNR)
+	}
+	if result.SSIM <= 0.9 || result.SSIM >= 1 {
+		t.Errorf("SSIM of a single different pixel is %f", result.SSIM)
+	}
+	if red, green := heat.Pix[heat.PixOffset(7, 9)], heat.Pix[heat.PixOffset(7, 9)+1]; red != 255 || green != 255 {
+		t.Errorf("Heatmap at the largest difference is (%d, %d), expected yellow", red, green)
+	}
+	if heat.Pix[heat.PixOffset(0, 0)] != 0 {
+		t.Error("Heatmap is not black where the images are equal")
+	}
+
+	// Two flat images: the SSIM only depends on the means
+	result, _ = Compare(uniform(8, 8, 100), uniform(8, 8, 110))
+	expectedSSIM := (2*100*110 + ssimC1) / (100*100 + 110*110 + ssimC1)
+	if result.MaxDiff != 10 || math.Abs(result.SSIM-expectedSSIM) > 1e-6 {
+		t.Errorf("Flat images: %+v, expected an SSIM of %f", result, expectedSSIM)
+	}
+	if expectedPSNR := 10 * math.Log10(255*255/100.0); math.Abs(result.PSNR-expectedPSNR) > 1e-9 {
+		t.Errorf("Flat images: PSNR is %f, expected %f", result.PSNR, expectedPSNR)
+	}
+}
+
+func TestCompareSizeMismatch(t *testing.T) {
+	result, heat := Compare(uniform(4, 4, 0), uniform(4, 5, 0))
+	if result.Err == nil || heat != nil {
+		t.Errorf("Images of different sizes compared: %+v", result)
+	}
+	if result.Within(255) {
+		t.Error("A failed comparison is within tolerance")
+	}
+}
+
+// TestCompareDirs checks the tolerance verdict, the heatmaps written for the
+// mismatches only, and the errors of missing files
+func TestCompareDirs(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	heatDir := filepath.Join(t.TempDir(), "diff")
+
+	writePNG(t, dirA, "same.png", uniform(8, 8, 50))
+	writePNG(t, dirB, "same.png", uniform(8, 8, 50))
+	writePNG(t, dirA, "off.png", uniform(8, 8, 50))
+	writePNG(t, dirB, "off.png", uniform(8, 8, 53))
+
+	results, ok, err := CompareDirs(dirA, dirB, heatDir, 3)
+	if err != nil || !ok || len(results) != 2 {
+		t.Fatalf("Tolerance 3: got %+v, %v, %v", results, ok, err)
+	}
+	if _, err := os.Stat(heatDir); !os.IsNotExist(err) {
+		t.Errorf("Heatmaps written for images within tolerance: %v", err)
+	}
+
+	results, ok, err = CompareDirs(dirA, dirB, heatDir, 2)
+	if err != nil || ok {
+		t.Fatalf("Tolerance 2: got %+v, %v, %v", results, ok, err)
+	}
+	if results[0].Name != "off.png" || results[0].Within(2) || !results[1].Within(2) {
+		t.Errorf("Tolerance 2: got %+v", results)
+	}
+	heat, err := loadRGBA(filepath.Join(heatDir, "off.png"))
+	if err != nil {
+		t.Fatalf("Heatmap of off.png: %v", err)
+	}
+	if heat.Bounds().Dx() != 8 || heat.Pix[0] != 255 || heat.Pix[1] != 255 {
+		t.Errorf("Heatmap of a uniform difference is %v, expected yellow", heat.Pix[:4])
+	}
+	if _, err := os.Stat(filepath.Join(heatDir, "same.png")); !os.IsNotExist(err) {
+		t.Errorf("Heatmap written for a matching image: %v", err)
+	}
+
+	writePNG(t, dirA, "missing.png", uniform(8, 8, 50))
+	results, ok, err = CompareDirs(dirA, dirB, "", 255)
+	if err != nil || ok || results[0].Name != "missing.png" || results[0].Err == nil {
+		t.Errorf("Missing file: got %+v, %v, %v", results, ok, err)
+	}
+
+	// An image written only to the second directory is a mismatch too
+	os.Remove(filepath.Join(dirA, "missing.png"))
+	writePNG(t, dirB, "extra.png", uniform(8, 8, 50))
+	results, ok, err = CompareDirs(dirA, dirB, "", 255)
+	if err != nil || ok || len(results) != 3 || results[0].Name != "extra.png" || results[0].Err == nil {
+		t.Errorf("Extra file: got %+v, %v, %v", results, ok, err)
+	}
+}
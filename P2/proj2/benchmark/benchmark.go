@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"math/rand"
 	"os"
@@ -12,7 +13,8 @@ import (
 	"time"
 )
 
-const usage = "Usage: benchmark version testSize threads\n" +
+const usage = "Usage: benchmark [-feed kind] version testSize threads\n" +
+	" -feed = the feed implementation of twitter.go: coarse (default), coupling, optimistic, lazy, lockfree or skiplist\n" +
 	" version =  (p) - parallel version, (s) sequential version \n" +
 	" testSize = the test size \n" +
 	"\t xsmall = Run the extra small test size\n" +
@@ -22,6 +24,9 @@ const usage = "Usage: benchmark version testSize threads\n" +
 	"\t xlarge = Run the extra large test size\n" +
 	" threads (required for  p version only) = the number of threads to pass to twitter.go\n"
 
+// feedKind is the feed implementation twitter.go runs with
+var feedKind = flag.String("feed", "coarse", "feed implementation of twitter.go")
+
 type _TestAddRequest struct {
 	Command   string  `json:"command"`
 	Id        int64   `json:"id"`
@@ -154,9 +159,9 @@ func runAllRequests(threads, version string, postInfo []int) {
 	var cmd *exec.Cmd
 
 	if version == "p" {
-		cmd = exec.CommandContext(ctx, "go", "run", "proj2/twitter", threads)
+		cmd = exec.CommandContext(ctx, "go", "run", "proj2/twitter", "-feed", *feedKind, threads)
 	} else {
-		cmd = exec.CommandContext(ctx, "go", "run", "proj2/twitter")
+		cmd = exec.CommandContext(ctx, "go", "run", "proj2/twitter", "-feed", *feedKind)
 	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -447,14 +452,17 @@ func AllRequestsXtraLarge(threads string, version string) {
 
 func main() {
 
-	if len(os.Args) < 3 {
-		fmt.Println(usage)
+	flag.Usage = func() { fmt.Print(usage) }
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 || (args[0] == "p" && len(args) < 3) {
+		fmt.Print(usage)
 	} else {
-		version := os.Args[1]
-		test := os.Args[2]
+		version := args[0]
+		test := args[1]
 		var threads string
 		if version == "p" {
-			threads = os.Args[3]
+			threads = args[2]
 		}
 
 		start := time.Now()
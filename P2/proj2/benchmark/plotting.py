@@ -13,27 +13,49 @@ data['speedup'] = data.apply(
     axis=1
 )
 
-# Plot speedups for each test size
-test_sizes = data['test_size'].unique()
+# Results without a feed column come from before the feed implementations
+if 'feed' not in data.columns:
+    data['feed'] = 'coarse'
 
+# Plot speedups for each test size, one graph per feed implementation
+test_sizes = data['test_size'].unique()
+output_files = []
+
+for feed in data['feed'].unique():
+    plt.figure(figsize=(12, 6))
+    for test_size in test_sizes:
+        subset = data[(data['test_size'] == test_size) & (data['feed'] == feed)]
+        cleaned_speedup = subset.dropna(subset=['speedup'])  # Remove rows with NaN in speedup
+        plt.plot(cleaned_speedup['threads'], cleaned_speedup['speedup'], marker='o', label=test_size)
+
+    # Add labels and legend
+    plt.xlabel("Number of Threads")
+    plt.ylabel("Speedup")
+    plt.title(f"Speedup vs Threads for Different Test Sizes ({feed} feed)")
+    plt.legend(title="Test Size")
+    plt.grid(True)
+
+    # Save the figure
+    output_file = "speedup_graph.png" if feed == 'coarse' else f"speedup_graph_{feed}.png"
+    plt.savefig(output_file, dpi=300, bbox_inches="tight")  # Save as a high-resolution image
+    output_files.append(output_file)
+
+# Compare the feed implementations on the largest test size
+largest = test_sizes[-1]
 plt.figure(figsize=(12, 6))
-for test_size in test_sizes:
-    subset = data[data['test_size'] == test_size]
-    cleaned_speedup = subset.dropna(subset=['speedup'])  # Remove rows with NaN in speedup
-    plt.plot(cleaned_speedup['threads'], cleaned_speedup['speedup'], marker='o', label=test_size)
-
-# Add labels and legend
+for feed in data['feed'].unique():
+    subset = data[(data['test_size'] == largest) & (data['feed'] == feed)].dropna(subset=['speedup'])
+    plt.plot(subset['threads'], subset['speedup'], marker='o', label=feed)
 plt.xlabel("Number of Threads")
 plt.ylabel("Speedup")
-plt.title("Speedup vs Threads for Different Test Sizes")
-plt.legend(title="Test Size")
+plt.title(f"Speedup vs Threads for Different Feed Implementations ({largest})")
+plt.legend(title="Feed")
 plt.grid(True)
+output_file = "speedup_feeds.png"
+plt.savefig(output_file, dpi=300, bbox_inches="tight")
+output_files.append(output_file)
 
-# Save the figure
-output_file = "speedup_graph.png"
-plt.savefig(output_file, dpi=300, bbox_inches="tight")  # Save as a high-resolution image
-
-# Show the plot
+# Show the plots
 plt.show()
 
-print(f"Plot saved as {output_file}")
+print(f"Plots saved as {', '.join(output_files)}")
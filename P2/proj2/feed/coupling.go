@@ -0,0 +1,72 @@
+package feed
+
+import "math"
+
+// couplingFeed is a feed with hand-over-hand (lock-coupling) locking: a traversal
+// locks the next post before releasing the current one, so writers only hold the
+// locks of the two posts around their change and several of them can work on
+// different parts of the feed at once
+type couplingFeed struct {
+	head *lockNode // sentinel before the most recent post
+}
+
+// NewCouplingFeed creates an empty feed with hand-over-hand locking
+func NewCouplingFeed() Feed {
+	return &couplingFeed{head: newLockNode("", math.Inf(1), nil)}
+}
+
+// find returns, locked, the first node for which stop holds (nil at the end of the
+// feed) and its predecessor
+func (f *couplingFeed) find(stop func(n *lockNode) bool) (*lockNode, *lockNode) {
+	pred := f.head
+	pred.mu.Lock()
+	curr := pred.next.Load()
+	if curr != nil {
+		curr.mu.Lock()
+	}
+	for curr != nil && !stop(curr) {
+		pred.mu.Unlock()
+		pred, curr = curr, curr.next.Load()
+		if curr != nil {
+			curr.mu.Lock()
+		}
+	}
+	return pred, curr
+}
+
+// Add inserts a new post, keeping the feed ordered from the most recent post
+func (f *couplingFeed) Add(body string, timestamp float64) {
+	pred, curr := f.find(insertsBefore(timestamp))
+	pred.next.Store(newLockNode(body, timestamp, curr))
+	unlockBoth(pred, curr)
+}
+
+// Remove deletes the post with the given timestamp and reports whether there was one
+func (f *couplingFeed) Remove(timestamp float64) bool {
+	pred, curr := f.find(reachesRemoval(timestamp))
+	defer unlockBoth(pred, curr)
+	if curr == nil || curr.timestamp != timestamp {
+		return false
+	}
+	pred.next.Store(curr.next.Load())
+	return true
+}
+
+// Contains determines whether a post with the given timestamp is inside the feed
+func (f *couplingFeed) Contains(timestamp float64) bool {
+	pred, curr := f.find(reachesRemoval(timestamp))
+	defer unlockBoth(pred, curr)
+	return curr != nil && curr.timestamp == timestamp
+}
+
+// GetAllPosts returns the posts of the feed, most recent first
+func (f *couplingFeed) GetAllPosts() []*post {
+	posts, _ := coupledRange(f.head, math.Inf(1), 0, math.Inf(-1), 0)
+	return posts
+}
+
+// Range returns the posts with after < timestamp <= before but the first skip
+// posts at before, like feed.Range
+func (f *couplingFeed) Range(before float64, skip int, after float64, limit int) ([]*post, bool) {
+	return coupledRange(f.head, before, skip, after, limit)
+}
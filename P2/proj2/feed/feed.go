@@ -9,6 +9,7 @@ type Feed interface {
 	Remove(timestamp float64) bool
 	Contains(timestamp float64) bool
 	GetAllPosts() []*post // Added: Method to get all posts
+	Range(before float64, skip int, after float64, limit int) ([]*post, bool)
 }
 
 // feed is the internal representation of a user's twitter feed (hidden from outside packages)
@@ -141,3 +142,51 @@ func (f *feed) GetAllPosts() []*post {
 	return posts
 }
 
+
+// Range returns the posts with after < timestamp <= before, most recent first, but
+// the first skip posts with the timestamp before (all of them if skip is larger than
+// their number, e.g. math.MaxInt), and at most limit of them (limit <= 0 means no
+// limit). The bool reports whether more posts of the range remain; NextPage returns
+// the before and skip of the next page. Use math.Inf for an open bound. The traversal
+// stops at the end of the range, so the read lock is only held for the posts up
+// to it rather than for the whole feed.
+func (f *feed) Range(before float64, skip int, after float64, limit int) ([]*post, bool) {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+
+	posts := []*post{}
+	current := f.start
+	// Skip the posts after before, then skip of the posts at before
+	for current != nil && current.timestamp > before {
+		current = current.next
+	}
+	for ; current != nil && current.timestamp == before && skip > 0; skip-- {
+		current = current.next
+	}
+	for current != nil && current.timestamp > after {
+		if limit > 0 && len(posts) == limit {
+			return posts, true // The page is full and at least one post is left
+		}
+		posts = append(posts, current)
+		current = current.next
+	}
+	return posts, false
+}
+
+// NextPage returns the before and skip of the page that follows page, which Range
+// returned for before and skip. Posts with the same timestamp keep the order they
+// were added in, so the next page starts after the returned posts at the timestamp
+// of the last one, even if more posts share it.
+func NextPage(page []*post, before float64, skip int) (float64, int) {
+	last := page[len(page)-1].timestamp
+	next := 0
+	if last == before {
+		next = skip
+	}
+	for _, p := range page {
+		if p.timestamp == last {
+			next++
+		}
+	}
+	return last, next
+}
@@ -1,7 +1,9 @@
 package feed
 
 import (
+	"math"
 	"math/rand"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
@@ -202,11 +204,19 @@ func TestRemove(t *testing.T) {
 	}
 }
 func TestParallelAdd(t *testing.T) {
+	testParallelAdd(t, NewFeed)
+}
+
+func TestLockFreeParallelAdd(t *testing.T) {
+	testParallelAdd(t, NewLockFreeFeed)
+}
+
+func testParallelAdd(t *testing.T, newFeed func() Feed) {
 
 	const totalSize = 5000
 	const threadCount = 100
 	const localCount = totalSize / threadCount
-	feed := NewFeed()
+	feed := newFeed()
 
 	var wg sync.WaitGroup
 
@@ -237,11 +247,19 @@ func TestParallelAdd(t *testing.T) {
 		}
 }
 func TestParallelRemoveAndAdd(t *testing.T) {
+	testParallelRemoveAndAdd(t, NewFeed)
+}
+
+func TestLockFreeParallelRemoveAndAdd(t *testing.T) {
+	testParallelRemoveAndAdd(t, NewLockFreeFeed)
+}
+
+func testParallelRemoveAndAdd(t *testing.T, newFeed func() Feed) {
 
 	const totalSize = 5000
 	const threadCount = 100
 	const localCount = totalSize / threadCount
-	feed := NewFeed()
+	feed := newFeed()
 
 	//Sequentially add in all the posts
 	for i := 0; i < totalSize; i++ {
@@ -273,11 +291,19 @@ func TestParallelRemoveAndAdd(t *testing.T) {
 	}
 }
 func TestParallelAll(t *testing.T) {
+	testParallelAll(t, NewFeed)
+}
+
+func TestLockFreeParallelAll(t *testing.T) {
+	testParallelAll(t, NewLockFreeFeed)
+}
+
+func testParallelAll(t *testing.T, newFeed func() Feed) {
 
 	const totalSize = 5000
 	const threadCount = 50
 	const localCount = totalSize / threadCount
-	feed := NewFeed()
+	feed := newFeed()
 
 	//First: add the even timestamps
 	var wg sync.WaitGroup
@@ -319,4 +345,59 @@ func TestParallelAll(t *testing.T) {
 			t.Errorf("Removed all items but not all were removed:\n"+"(Got):%v\n", i)
 		}
 	}
-}
\ No newline at end of file
+}
+
+// rangeTimestamps returns the timestamps of a page of Range
+func rangeTimestamps(posts []*post) []float64 {
+	timestamps := []float64{}
+	for _, p := range posts {
+		timestamps = append(timestamps, p.Timestamp())
+	}
+	return timestamps
+}
+
+func TestRange(t *testing.T) {
+
+	feed := NewFeed()
+	for _, num := range []int{4, 1, 8, 3, 10, 6, 2, 9, 5, 7} {
+		feed.Add(strconv.Itoa(num), float64(num))
+	}
+	inf := math.Inf(1)
+
+	cases := []struct {
+		before, after float64
+		limit         int
+		expected      []float64
+		more          bool
+	}{
+		{inf, -inf, 0, []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, false},
+		{inf, -inf, 3, []float64{10, 9, 8}, true},
+		{8, -inf, 3, []float64{7, 6, 5}, true},
+		{3, -inf, 3, []float64{2, 1}, false},
+		{2, -inf, 1, []float64{1}, false},
+		{inf, 7, 0, []float64{10, 9, 8}, false},
+		{9, 4, 2, []float64{8, 7}, true},
+		{9, 6, 2, []float64{8, 7}, false},
+		{5, 5, 0, []float64{}, false},
+		{0, -inf, 5, []float64{}, false},
+	}
+	for _, c := range cases {
+		posts, more := feed.Range(c.before, math.MaxInt, c.after, c.limit)
+		if got := rangeTimestamps(posts); !reflect.DeepEqual(got, c.expected) || more != c.more {
+			t.Errorf("Range(%v, %v, %v) = %v, %v; expected %v, %v", c.before, c.after, c.limit, got, more, c.expected, c.more)
+		}
+	}
+
+	//Paging with the cursor of NextPage returns the whole feed
+	var all []float64
+	before, skip, more := inf, 0, true
+	for more {
+		var posts []*post
+		posts, more = feed.Range(before, skip, -inf, 4)
+		all = append(all, rangeTimestamps(posts)...)
+		before, skip = NextPage(posts, before, skip)
+	}
+	if !reflect.DeepEqual(all, []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}) {
+		t.Errorf("Paging through the feed returned %v", all)
+	}
+}
@@ -0,0 +1,77 @@
+package feed
+
+import "math"
+
+// lazyFeed is a feed with lazy synchronization: Remove first marks a post as
+// removed, then unlinks it. Validation only checks the marks and the link between
+// the two locked posts instead of walking the feed again, and since a post in the
+// feed is never marked, Contains and the reads traverse it without any lock.
+type lazyFeed struct {
+	head *lockNode // sentinel before the most recent post
+}
+
+// NewLazyFeed creates an empty feed with lazy synchronization
+func NewLazyFeed() Feed {
+	return &lazyFeed{head: newLockNode("", math.Inf(1), nil)}
+}
+
+// validate reports whether neither node is removed and pred is linked to curr
+func (f *lazyFeed) validate(pred, curr *lockNode) bool {
+	return !pred.marked.Load() && (curr == nil || !curr.marked.Load()) && pred.next.Load() == curr
+}
+
+// Add inserts a new post, keeping the feed ordered from the most recent post
+func (f *lazyFeed) Add(body string, timestamp float64) {
+	pred, curr := lockWindow(f.head, insertsBefore(timestamp), f.validate)
+	pred.next.Store(newLockNode(body, timestamp, curr))
+	unlockBoth(pred, curr)
+}
+
+// Remove deletes the post with the given timestamp and reports whether there was one
+func (f *lazyFeed) Remove(timestamp float64) bool {
+	pred, curr := lockWindow(f.head, reachesRemoval(timestamp), f.validate)
+	defer unlockBoth(pred, curr)
+	if curr == nil || curr.timestamp != timestamp {
+		return false
+	}
+	curr.marked.Store(true) // Logical removal: the post is out of the feed from now on
+	pred.next.Store(curr.next.Load())
+	return true
+}
+
+// Contains determines whether a post with the given timestamp is inside the feed,
+// without locking
+func (f *lazyFeed) Contains(timestamp float64) bool {
+	curr := f.head.next.Load()
+	for curr != nil && (curr.timestamp > timestamp || curr.timestamp == timestamp && curr.marked.Load()) {
+		curr = curr.next.Load()
+	}
+	return curr != nil && curr.timestamp == timestamp
+}
+
+// GetAllPosts returns the posts of the feed, most recent first
+func (f *lazyFeed) GetAllPosts() []*post {
+	posts, _ := f.Range(math.Inf(1), 0, math.Inf(-1), 0)
+	return posts
+}
+
+// Range returns the posts with after < timestamp <= before but the first skip
+// posts at before, like feed.Range, without locking: posts removed during the
+// traversal may or may not be included
+func (f *lazyFeed) Range(before float64, skip int, after float64, limit int) ([]*post, bool) {
+	posts := []*post{}
+	for curr := f.head.next.Load(); curr != nil && curr.timestamp > after; curr = curr.next.Load() {
+		if curr.timestamp > before || curr.marked.Load() {
+			continue
+		}
+		if curr.timestamp == before && skip > 0 {
+			skip--
+			continue
+		}
+		if limit > 0 && len(posts) == limit {
+			return posts, true
+		}
+		posts = append(posts, curr.toPost())
+	}
+	return posts, false
+}
@@ -0,0 +1,114 @@
+package feed
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Constructors maps the names of the Feed implementations to their constructors:
+// "coarse" is the feed behind a single read/write lock, "coupling", "optimistic"
+// and "lazy" lock each post on its own so that writers to different parts of a
+// feed do not serialize, "lockfree" takes no lock at all and "skiplist" finds posts
+// in O(log n) steps instead of walking the feed
+var Constructors = map[string]func() Feed{
+	"coarse":     NewFeed,
+	"coupling":   NewCouplingFeed,
+	"optimistic": NewOptimisticFeed,
+	"lazy":       NewLazyFeed,
+	"lockfree":   NewLockFreeFeed,
+	"skiplist":   NewSkipListFeed,
+}
+
+// lockNode is a post of the fine-grained feeds. next is atomic because the
+// optimistic and lazy feeds traverse the list without holding any lock.
+type lockNode struct {
+	body      string
+	timestamp float64
+	next      atomic.Pointer[lockNode]
+	mu        sync.Mutex  // guards the link to the next post and the removal of this one
+	marked    atomic.Bool // the post is logically removed (lazy feed only)
+}
+
+// newLockNode creates a post linked to next
+func newLockNode(body string, timestamp float64, next *lockNode) *lockNode {
+	n := &lockNode{body: body, timestamp: timestamp}
+	n.next.Store(next)
+	return n
+}
+
+// toPost copies a node into the post type returned by the Feed interface
+func (n *lockNode) toPost() *post {
+	return newPost(n.body, n.timestamp, nil)
+}
+
+// lockBoth locks a node and, if there is one, its successor
+func lockBoth(pred, curr *lockNode) {
+	pred.mu.Lock()
+	if curr != nil {
+		curr.mu.Lock()
+	}
+}
+
+// unlockBoth undoes lockBoth
+func unlockBoth(pred, curr *lockNode) {
+	if curr != nil {
+		curr.mu.Unlock()
+	}
+	pred.mu.Unlock()
+}
+
+// insertsBefore and reachesRemoval are the positions of Add and of Remove and
+// Contains: posts are ordered by decreasing timestamp, a new post goes after the
+// posts with the same timestamp
+func insertsBefore(timestamp float64) func(n *lockNode) bool {
+	return func(n *lockNode) bool { return n.timestamp < timestamp }
+}
+
+func reachesRemoval(timestamp float64) func(n *lockNode) bool {
+	return func(n *lockNode) bool { return n.timestamp <= timestamp }
+}
+
+// lockWindow traverses the list after head without locks up to the first node for
+// which stop holds (nil at the end of the list), locks it and its predecessor and
+// returns them once validate accepts them, retrying the traversal otherwise
+func lockWindow(head *lockNode, stop func(n *lockNode) bool, validate func(pred, curr *lockNode) bool) (*lockNode, *lockNode) {
+	for {
+		pred, curr := head, head.next.Load()
+		for curr != nil && !stop(curr) {
+			pred, curr = curr, curr.next.Load()
+		}
+		lockBoth(pred, curr)
+		if validate(pred, curr) {
+			return pred, curr
+		}
+		unlockBoth(pred, curr)
+	}
+}
+
+// coupledRange implements Range by hand-over-hand locking from head: a post cannot
+// be unlinked while its predecessor is locked, so the traversal sees a consistent
+// sequence of posts
+func coupledRange(head *lockNode, before float64, skip int, after float64, limit int) ([]*post, bool) {
+	posts := []*post{}
+	pred := head
+	pred.mu.Lock()
+	for {
+		curr := pred.next.Load()
+		if curr == nil || curr.timestamp <= after {
+			pred.mu.Unlock()
+			return posts, false
+		}
+		if curr.timestamp == before && skip > 0 {
+			skip--
+		} else if curr.timestamp <= before {
+			if limit > 0 && len(posts) == limit {
+				pred.mu.Unlock()
+				return posts, true
+			}
+			posts = append(posts, curr.toPost())
+		}
+		curr.mu.Lock()
+		pred.mu.Unlock()
+		pred = curr
+	}
+}
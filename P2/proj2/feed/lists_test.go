@@ -0,0 +1,314 @@
+package feed
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// forEachKind runs a test against every Feed implementation
+func forEachKind(t *testing.T, test func(t *testing.T, newFeed func() Feed)) {
+	kinds := make([]string, 0, len(Constructors))
+	for kind := range Constructors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		newFeed := Constructors[kind]
+		t.Run(kind, func(t *testing.T) { test(t, newFeed) })
+	}
+}
+
+func TestKindsSeq(t *testing.T) {
+	forEachKind(t, func(t *testing.T, newFeed func() Feed) {
+		feed := newFeed()
+		if feed.Contains(1) || feed.Remove(1) || len(feed.GetAllPosts()) != 0 {
+			t.Fatalf("New feed is not empty")
+		}
+
+		postInfo := []int{1, 2, 18, 9, 8, 20, 16, 10, 6, 14, 17, 15, 19, 5, 13, 11, 7, 4, 3, 12}
+		for _, num := range postInfo {
+			feed.Add(strconv.Itoa(num), float64(num))
+		}
+		posts := feed.GetAllPosts()
+		if len(posts) != len(postInfo) {
+			t.Fatalf("Added %v posts but the feed has %v", len(postInfo), len(posts))
+		}
+		for i, p := range posts {
+			if num := 20 - i; p.Timestamp() != float64(num) || p.Body() != strconv.Itoa(num) {
+				t.Errorf("Post %v is (%v, %v), expected (%v, %v)", i, p.Body(), p.Timestamp(), num, num)
+			}
+		}
+
+		//Remove the odd timestamps
+		for num := 1; num <= 20; num += 2 {
+			if !feed.Remove(float64(num)) {
+				t.Errorf("Did not remove (%v)", num)
+			}
+			if feed.Remove(float64(num)) || feed.Contains(float64(num)) {
+				t.Errorf("Removed (%v) twice", num)
+			}
+		}
+		for num := 2; num <= 20; num += 2 {
+			if !feed.Contains(float64(num)) {
+				t.Errorf("Feed should contain timestamp (%v)", num)
+			}
+		}
+
+		page, more := feed.Range(16, math.MaxInt, 5, 3)
+		if got := rangeTimestamps(page); !reflect.DeepEqual(got, []float64{14, 12, 10}) || !more {
+			t.Errorf("Range(16, 5, 3) = %v, %v", got, more)
+		}
+		page, more = feed.Range(10, math.MaxInt, 5, 3)
+		if got := rangeTimestamps(page); !reflect.DeepEqual(got, []float64{8, 6}) || more {
+			t.Errorf("Range(10, 5, 3) = %v, %v", got, more)
+		}
+	})
+}
+
+// TestKindsRangeTies pages through posts sharing timestamps with pages that end
+// between them: every post is returned once, in the order of the feed
+func TestKindsRangeTies(t *testing.T) {
+	forEachKind(t, func(t *testing.T, newFeed func() Feed) {
+		feed := newFeed()
+		var expected []string
+		for _, timestamp := range []float64{9, 7, 5, 3} {
+			for i := 0; i < 5; i++ {
+				body := fmt.Sprintf("%v-%d", timestamp, i)
+				feed.Add(body, timestamp)
+				expected = append(expected, body)
+			}
+		}
+
+		for _, limit := range []int{1, 2, 3, 4, 6, 7} {
+			var got []string
+			before, skip, more := math.Inf(1), 0, true
+			for more {
+				var page []*post
+				page, more = feed.Range(before, skip, math.Inf(-1), limit)
+				for _, p := range page {
+					got = append(got, p.Body())
+				}
+				before, skip = NextPage(page, before, skip)
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Pages of %d returned %v", limit, got)
+			}
+		}
+
+		// A plain before excludes every post at it, a skip only the first ones
+		if page, _ := feed.Range(7, math.MaxInt, 4, 0); len(page) != 5 || page[0].Body() != "5-0" {
+			t.Errorf("Range(7, MaxInt, 4) = %v", rangeTimestamps(page))
+		}
+		if page, _ := feed.Range(7, 3, 6, 0); len(page) != 2 || page[0].Body() != "7-3" {
+			t.Errorf("Range(7, 3, 6) = %v", rangeTimestamps(page))
+		}
+	})
+}
+
+func TestKindsParallel(t *testing.T) {
+	forEachKind(t, func(t *testing.T, newFeed func() Feed) {
+		const totalSize = 2000
+		const threadCount = 20
+		const localCount = totalSize / threadCount
+		feed := newFeed()
+
+		//First: add the even timestamps
+		var wg sync.WaitGroup
+		for i := 0; i < threadCount; i++ {
+			wg.Add(2)
+			go addGoroutine2(true, i*localCount, feed, localCount, &wg)
+			go randomReads(feed, totalSize, &wg)
+		}
+		wg.Wait()
+
+		//Second: add the odd timestamps but also remove even timestamps, while
+		//checking that the feed stays ordered
+		for i := 0; i < threadCount; i++ {
+			wg.Add(3)
+			go addGoroutine2(false, i*localCount, feed, localCount, &wg)
+			go removeGoroutine2(true, t, i*localCount, feed, localCount, &wg)
+			go func() {
+				defer wg.Done()
+				posts, _ := feed.Range(math.Inf(1), 0, math.Inf(-1), rand.Intn(totalSize))
+				for j := 1; j < len(posts); j++ {
+					if posts[j-1].Timestamp() <= posts[j].Timestamp() {
+						t.Errorf("Feed out of order: %v before %v", posts[j-1].Timestamp(), posts[j].Timestamp())
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		//Third: only the odd timestamps are left
+		posts := feed.GetAllPosts()
+		if len(posts) != totalSize/2 {
+			t.Fatalf("Feed has %v posts, expected %v", len(posts), totalSize/2)
+		}
+		for i, p := range posts {
+			if num := totalSize - 1 - 2*i; p.Timestamp() != float64(num) {
+				t.Fatalf("Post %v has timestamp %v, expected %v", i, p.Timestamp(), num)
+			}
+		}
+	})
+}
+
+func TestLockFreeStress(t *testing.T) {
+	testStress(t, NewLockFreeFeed)
+}
+
+func TestSkipListStress(t *testing.T) {
+	testStress(t, NewSkipListFeed)
+}
+
+// testStress runs writers on interleaved timestamps of one feed, each checking the
+// results of its own operations, while other writers race to remove the same posts
+// (exactly one of them must succeed) and readers check the order
+func testStress(t *testing.T, newFeed func() Feed) {
+	const writers = 16
+	const keysPerWriter = 200
+	const rounds = 2000
+	const shared = 500
+	feed := newFeed()
+
+	//Shared posts with negative timestamps, all removed concurrently below
+	for i := 1; i <= shared; i++ {
+		feed.Add(strconv.Itoa(-i), float64(-i))
+	}
+	removed := make([]int32, shared+1)
+
+	var wg sync.WaitGroup
+	var readers sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				posts := feed.GetAllPosts()
+				for j := 1; j < len(posts); j++ {
+					if posts[j-1].Timestamp() < posts[j].Timestamp() {
+						t.Errorf("Feed out of order: %v before %v", posts[j-1].Timestamp(), posts[j].Timestamp())
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	present := make([]map[int]bool, writers)
+	for w := 0; w < writers; w++ {
+		present[w] = make(map[int]bool)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			mine := present[w]
+			for i := 0; i < rounds; i++ {
+				//Timestamps of the writer w are w, w + writers, w + 2*writers...
+				num := rnd.Intn(keysPerWriter)*writers + w
+				switch rnd.Intn(3) {
+				case 0:
+					if !mine[num] {
+						feed.Add(strconv.Itoa(num), float64(num))
+						mine[num] = true
+					}
+				case 1:
+					if feed.Remove(float64(num)) != mine[num] {
+						t.Errorf("Remove(%v) should return %v", num, mine[num])
+					}
+					delete(mine, num)
+				case 2:
+					if feed.Contains(float64(num)) != mine[num] {
+						t.Errorf("Contains(%v) should return %v", num, mine[num])
+					}
+				}
+				if num := rnd.Intn(shared) + 1; feed.Remove(float64(-num)) {
+					atomic.AddInt32(&removed[num], 1)
+				}
+			}
+			for num := 1; num <= shared; num++ {
+				if feed.Remove(float64(-num)) {
+					atomic.AddInt32(&removed[num], 1)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	for num := 1; num <= shared; num++ {
+		if removed[num] != 1 {
+			t.Errorf("Shared post %v was removed %v times", -num, removed[num])
+		}
+	}
+	var expected []float64
+	for w := range present {
+		for num := range present[w] {
+			expected = append(expected, float64(num))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(expected)))
+	if got := rangeTimestamps(feed.GetAllPosts()); !reflect.DeepEqual(got, append([]float64{}, expected...)) {
+		t.Errorf("Feed has %v posts, expected %v", len(got), len(expected))
+	}
+}
+
+// BenchmarkKinds compares the Feed implementations on a feed of 10000 posts with
+// parallel goroutines doing 80% Contains and 20% Add or Remove. The feed holds the
+// even timestamps; every goroutine adds one post between them at a time, at an
+// offset no other goroutine uses, and removes it again, so the timestamps stay
+// unique and the size of the feed stays the same.
+func BenchmarkKinds(b *testing.B) {
+	const size = 10000
+	kinds := make([]string, 0, len(Constructors))
+	for kind := range Constructors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		newFeed := Constructors[kind]
+		b.Run(kind, func(b *testing.B) {
+			feed := newFeed()
+			for _, num := range rand.Perm(size) {
+				feed.Add(strconv.Itoa(2*num), float64(2*num))
+			}
+			var seed int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				id := atomic.AddInt64(&seed, 1)
+				rnd := rand.New(rand.NewSource(id))
+				offset := 1 - 1/float64(id+1) // In (0, 1), distinct for every goroutine
+				added := -1.0                 // Timestamp of the post this goroutine added (-1 = none)
+				for pb.Next() {
+					switch op := rnd.Intn(10); {
+					case op < 8:
+						feed.Contains(float64(rnd.Intn(2 * size)))
+					case added < 0:
+						added = float64(2*rnd.Intn(size)) + offset
+						feed.Add("", added)
+					default:
+						feed.Remove(added)
+						added = -1
+					}
+				}
+				if added >= 0 {
+					feed.Remove(added)
+				}
+			})
+		})
+	}
+}
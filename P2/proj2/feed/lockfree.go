@@ -0,0 +1,139 @@
+package feed
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// lockFreeFeed is a feed on a lock-free ordered linked list (Harris). Remove marks
+// the link out of a post, which removes the post logically and stops any insertion
+// after it, then tries to unlink it with a CAS; posts left marked are unlinked by
+// the next traversal of Add or Remove passing by. Contains and the reads never write
+// and never retry, so they are wait-free and any number of them run at once.
+type lockFreeFeed struct {
+	head *lfNode // sentinel before the most recent post
+}
+
+// lfNode is a post of the lock-free feed
+type lfNode struct {
+	body      string
+	timestamp float64
+	ref       atomic.Pointer[markedRef] // link to the next post
+}
+
+// markedRef is an immutable pair of a successor and a deletion mark. Go cannot
+// steal the low bit of a pointer like Harris' list does, so a node's link and
+// mark are replaced together by swapping the whole pair with one CAS.
+type markedRef struct {
+	next   *lfNode
+	marked bool // the node holding this link is logically removed
+}
+
+// NewLockFreeFeed creates an empty lock-free feed
+func NewLockFreeFeed() Feed {
+	head := &lfNode{timestamp: math.Inf(1)}
+	head.ref.Store(&markedRef{})
+	return &lockFreeFeed{head: head}
+}
+
+// find returns the first unmarked node with a timestamp below the given one
+// (inclusive: at most equal to it), nil at the end of the feed, together with its
+// predecessor and the link read from the predecessor. Marked nodes on the way are
+// unlinked; losing a CAS to another writer restarts the traversal.
+func (f *lockFreeFeed) find(timestamp float64, inclusive bool) (*lfNode, *markedRef, *lfNode) {
+retry:
+	for {
+		pred := f.head
+		predRef := pred.ref.Load()
+		curr := predRef.next
+		for curr != nil {
+			currRef := curr.ref.Load()
+			if currRef.marked {
+				unlinked := &markedRef{next: currRef.next}
+				if !pred.ref.CompareAndSwap(predRef, unlinked) {
+					continue retry
+				}
+				predRef, curr = unlinked, currRef.next
+				continue
+			}
+			if curr.timestamp < timestamp || inclusive && curr.timestamp == timestamp {
+				break
+			}
+			pred, predRef, curr = curr, currRef, currRef.next
+		}
+		return pred, predRef, curr
+	}
+}
+
+// Add inserts a new post, keeping the feed ordered from the most recent post
+func (f *lockFreeFeed) Add(body string, timestamp float64) {
+	n := &lfNode{body: body, timestamp: timestamp}
+	for {
+		pred, predRef, curr := f.find(timestamp, false)
+		n.ref.Store(&markedRef{next: curr})
+		if pred.ref.CompareAndSwap(predRef, &markedRef{next: n}) {
+			return
+		}
+	}
+}
+
+// Remove deletes the post with the given timestamp and reports whether there was
+// one. The post is removed once it is marked; unlinking it is only a cleanup.
+func (f *lockFreeFeed) Remove(timestamp float64) bool {
+	for {
+		pred, predRef, curr := f.find(timestamp, true)
+		if curr == nil || curr.timestamp != timestamp {
+			return false
+		}
+		currRef := curr.ref.Load()
+		if currRef.marked || !curr.ref.CompareAndSwap(currRef, &markedRef{next: currRef.next, marked: true}) {
+			continue // Removed by someone else or a post was inserted after it
+		}
+		pred.ref.CompareAndSwap(predRef, &markedRef{next: currRef.next})
+		return true
+	}
+}
+
+// Contains determines whether a post with the given timestamp is inside the feed,
+// without writing or retrying
+func (f *lockFreeFeed) Contains(timestamp float64) bool {
+	curr := f.head.ref.Load().next
+	for curr != nil && curr.timestamp > timestamp {
+		curr = curr.ref.Load().next
+	}
+	for ; curr != nil && curr.timestamp == timestamp; curr = curr.ref.Load().next {
+		if !curr.ref.Load().marked {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAllPosts returns the posts of the feed, most recent first
+func (f *lockFreeFeed) GetAllPosts() []*post {
+	posts, _ := f.Range(math.Inf(1), 0, math.Inf(-1), 0)
+	return posts
+}
+
+// Range returns the posts with after < timestamp <= before but the first skip
+// posts at before, like feed.Range, without locking: posts removed during the
+// traversal may or may not be included
+func (f *lockFreeFeed) Range(before float64, skip int, after float64, limit int) ([]*post, bool) {
+	posts := []*post{}
+	for curr := f.head.ref.Load().next; curr != nil && curr.timestamp > after; {
+		node, ref := curr, curr.ref.Load()
+		curr = ref.next
+		if node.timestamp > before || ref.marked {
+			continue
+		}
+		if node.timestamp == before && skip > 0 {
+			skip--
+			continue
+		}
+		if limit > 0 && len(posts) == limit {
+			return posts, true
+		}
+		posts = append(posts, newPost(node.body, node.timestamp, nil))
+	}
+	return posts, false
+}
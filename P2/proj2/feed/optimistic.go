@@ -0,0 +1,65 @@
+package feed
+
+import "math"
+
+// optimisticFeed is a feed with optimistic locking: operations find their position
+// without locks, then lock the two posts around it and validate that the first one
+// is still in the feed and still linked to the second. Traversals are cheap, but a
+// failed validation restarts the operation and validating walks the feed again.
+type optimisticFeed struct {
+	head *lockNode // sentinel before the most recent post
+}
+
+// NewOptimisticFeed creates an empty feed with optimistic locking
+func NewOptimisticFeed() Feed {
+	return &optimisticFeed{head: newLockNode("", math.Inf(1), nil)}
+}
+
+// validate reports whether pred is reachable from the head and linked to curr. It is
+// called with both locked, so the link cannot change afterwards.
+func (f *optimisticFeed) validate(pred, curr *lockNode) bool {
+	for n := f.head; n != nil; n = n.next.Load() {
+		if n == pred {
+			return pred.next.Load() == curr
+		}
+	}
+	return false
+}
+
+// Add inserts a new post, keeping the feed ordered from the most recent post
+func (f *optimisticFeed) Add(body string, timestamp float64) {
+	pred, curr := lockWindow(f.head, insertsBefore(timestamp), f.validate)
+	pred.next.Store(newLockNode(body, timestamp, curr))
+	unlockBoth(pred, curr)
+}
+
+// Remove deletes the post with the given timestamp and reports whether there was one
+func (f *optimisticFeed) Remove(timestamp float64) bool {
+	pred, curr := lockWindow(f.head, reachesRemoval(timestamp), f.validate)
+	defer unlockBoth(pred, curr)
+	if curr == nil || curr.timestamp != timestamp {
+		return false
+	}
+	pred.next.Store(curr.next.Load())
+	return true
+}
+
+// Contains determines whether a post with the given timestamp is inside the feed.
+// A node found without locks may have been unlinked since, so it validates too.
+func (f *optimisticFeed) Contains(timestamp float64) bool {
+	pred, curr := lockWindow(f.head, reachesRemoval(timestamp), f.validate)
+	defer unlockBoth(pred, curr)
+	return curr != nil && curr.timestamp == timestamp
+}
+
+// GetAllPosts returns the posts of the feed, most recent first
+func (f *optimisticFeed) GetAllPosts() []*post {
+	posts, _ := coupledRange(f.head, math.Inf(1), 0, math.Inf(-1), 0)
+	return posts
+}
+
+// Range returns the posts with after < timestamp <= before but the first skip
+// posts at before, like feed.Range
+func (f *optimisticFeed) Range(before float64, skip int, after float64, limit int) ([]*post, bool) {
+	return coupledRange(f.head, before, skip, after, limit)
+}
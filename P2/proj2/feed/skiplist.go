@@ -0,0 +1,203 @@
+package feed
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// skipListMaxLevel bounds the number of levels of a skip list feed; with one post
+// in two promoted to each next level it suits feeds of up to about 2^20 posts
+const skipListMaxLevel = 20
+
+// skipListFeed is a feed on a lazy-locking skip list (Herlihy, Lev, Luchangco and
+// Shavit): every post is on the bottom level and on a random number of levels
+// above it, so Add, Remove and Contains take O(log n) steps instead of walking the
+// feed. Writers lock only the predecessors of their post, as in the lazy feed, and
+// Contains and the reads never lock.
+type skipListFeed struct {
+	head *skipNode     // sentinel on every level, before the most recent post
+	seq  atomic.Uint64 // last sequence number given to a post
+}
+
+// skipNode is a post of the skip list feed. Posts are ordered by decreasing
+// timestamp and, for equal timestamps, by increasing sequence number, so that every
+// post has a distinct position and a post with the same timestamp as others goes
+// after them like in the other feeds.
+type skipNode struct {
+	body        string
+	timestamp   float64
+	seq         uint64
+	next        []atomic.Pointer[skipNode] // successor on each level of the node
+	mu          sync.Mutex                 // guards the links out of the node and its removal
+	marked      atomic.Bool                // the post is logically removed
+	fullyLinked atomic.Bool                // the post is linked on all its levels
+}
+
+// NewSkipListFeed creates an empty skip list feed
+func NewSkipListFeed() Feed {
+	head := &skipNode{timestamp: math.Inf(1), next: make([]atomic.Pointer[skipNode], skipListMaxLevel)}
+	return &skipListFeed{head: head}
+}
+
+// randomLevel returns the top level of a new node: level l with probability 2^-(l+1)
+func randomLevel() int {
+	level := 0
+	for level < skipListMaxLevel-1 && rand.Int63()&1 == 0 {
+		level++
+	}
+	return level
+}
+
+// before reports whether the node goes before the position (timestamp, seq)
+func (n *skipNode) before(timestamp float64, seq uint64) bool {
+	return n.timestamp > timestamp || n.timestamp == timestamp && n.seq < seq
+}
+
+// find fills preds and succs with the nodes around the position (timestamp, seq) on
+// every level, without locking
+func (f *skipListFeed) find(timestamp float64, seq uint64, preds, succs *[skipListMaxLevel]*skipNode) {
+	pred := f.head
+	for level := skipListMaxLevel - 1; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr != nil && curr.before(timestamp, seq) {
+			pred, curr = curr, curr.next[level].Load()
+		}
+		preds[level], succs[level] = pred, curr
+	}
+}
+
+// lockPreds locks the distinct predecessors of levels 0 to topLevel and reports
+// whether each is still in the feed and linked to valid on its level. It returns the
+// number of levels to pass to unlockPreds, even when the validation fails.
+func lockPreds(preds *[skipListMaxLevel]*skipNode, topLevel int, valid func(level int) bool) (int, bool) {
+	var prev *skipNode
+	for level := 0; level <= topLevel; level++ {
+		// A node is the predecessor on consecutive levels only, so comparing
+		// with the previous level locks each node once
+		if preds[level] != prev {
+			preds[level].mu.Lock()
+			prev = preds[level]
+		}
+		if preds[level].marked.Load() || !valid(level) {
+			return level + 1, false
+		}
+	}
+	return topLevel + 1, true
+}
+
+// unlockPreds unlocks the predecessors locked by lockPreds
+func unlockPreds(preds *[skipListMaxLevel]*skipNode, levels int) {
+	var prev *skipNode
+	for level := 0; level < levels; level++ {
+		if preds[level] != prev {
+			preds[level].mu.Unlock()
+			prev = preds[level]
+		}
+	}
+}
+
+// Add inserts a new post, keeping the feed ordered from the most recent post
+func (f *skipListFeed) Add(body string, timestamp float64) {
+	topLevel := randomLevel()
+	n := &skipNode{body: body, timestamp: timestamp, seq: f.seq.Add(1), next: make([]atomic.Pointer[skipNode], topLevel+1)}
+	var preds, succs [skipListMaxLevel]*skipNode
+	for {
+		f.find(timestamp, n.seq, &preds, &succs)
+		locked, valid := lockPreds(&preds, topLevel, func(level int) bool {
+			succ := succs[level]
+			return (succ == nil || !succ.marked.Load()) && preds[level].next[level].Load() == succ
+		})
+		if valid {
+			for level := 0; level <= topLevel; level++ {
+				n.next[level].Store(succs[level])
+			}
+			for level := 0; level <= topLevel; level++ {
+				preds[level].next[level].Store(n)
+			}
+			n.fullyLinked.Store(true)
+		}
+		unlockPreds(&preds, locked)
+		if valid {
+			return
+		}
+	}
+}
+
+// Remove deletes the post with the given timestamp and reports whether there was one
+func (f *skipListFeed) Remove(timestamp float64) bool {
+	var preds, succs [skipListMaxLevel]*skipNode
+	// Sequence numbers start at 1, so this finds the first post with the timestamp
+	f.find(timestamp, 0, &preds, &succs)
+	victim := succs[0]
+	if victim == nil || victim.timestamp != timestamp || !victim.fullyLinked.Load() {
+		return false
+	}
+	victim.mu.Lock()
+	defer victim.mu.Unlock()
+	if victim.marked.Load() {
+		return false // Removed by someone else
+	}
+	victim.marked.Store(true) // Logical removal: the post is out of the feed from now on
+
+	topLevel := len(victim.next) - 1
+	for {
+		f.find(victim.timestamp, victim.seq, &preds, &succs)
+		locked, valid := lockPreds(&preds, topLevel, func(level int) bool {
+			return preds[level].next[level].Load() == victim
+		})
+		if valid {
+			for level := topLevel; level >= 0; level-- {
+				preds[level].next[level].Store(victim.next[level].Load())
+			}
+		}
+		unlockPreds(&preds, locked)
+		if valid {
+			return true
+		}
+	}
+}
+
+// Contains determines whether a post with the given timestamp is inside the feed,
+// without locking
+func (f *skipListFeed) Contains(timestamp float64) bool {
+	var preds, succs [skipListMaxLevel]*skipNode
+	f.find(timestamp, 0, &preds, &succs)
+	for curr := succs[0]; curr != nil && curr.timestamp == timestamp; curr = curr.next[0].Load() {
+		if curr.fullyLinked.Load() && !curr.marked.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAllPosts returns the posts of the feed, most recent first
+func (f *skipListFeed) GetAllPosts() []*post {
+	posts, _ := f.Range(math.Inf(1), 0, math.Inf(-1), 0)
+	return posts
+}
+
+// Range returns the posts with after < timestamp <= before but the first skip
+// posts at before, like feed.Range, without locking. The upper levels take it to
+// the first post of the range in O(log n).
+func (f *skipListFeed) Range(before float64, skip int, after float64, limit int) ([]*post, bool) {
+	var preds, succs [skipListMaxLevel]*skipNode
+	// Sequence numbers start at 1, so this finds the first post with the timestamp before
+	f.find(before, 0, &preds, &succs)
+	posts := []*post{}
+	for curr := succs[0]; curr != nil && curr.timestamp > after; curr = curr.next[0].Load() {
+		if !curr.fullyLinked.Load() || curr.marked.Load() {
+			continue
+		}
+		if curr.timestamp == before && skip > 0 {
+			skip--
+			continue
+		}
+		if limit > 0 && len(posts) == limit {
+			return posts, true
+		}
+		posts = append(posts, newPost(curr.body, curr.timestamp, nil))
+	}
+	return posts, false
+}
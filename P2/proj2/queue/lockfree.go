@@ -9,8 +9,16 @@ import (
 type Request struct {
 	Command   string
 	ID        int
+	User      int // User the request acts on (0 when omitted)
+	Followee  int // User to FOLLOW or UNFOLLOW
 	Body      string
 	Timestamp float64
+	Limit     int      // Maximum number of posts of a FEED (0 = all of them)
+	Before    *float64 // FEED only returns the posts older than this timestamp
+	Offset    *int     // With Before: FEED also returns the posts at Before but the first Offset
+	After     *float64 // FEED only returns the posts newer than this timestamp
+	Seq       uint64   `json:"-"` // Position of the request in the input, set by the server
+	Client    uint64   `json:"-"` // Connection the request came from, set by the server
 }
 
 // node represents a single node in the queue
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// defaultEventsBuffer is the number of events buffered per subscriber
+const defaultEventsBuffer = 64
+
+// postEvent is the event of a new post
+type postEvent struct {
+	User      int     `json:"user"`
+	Body      string  `json:"body"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// broker passes the posts added to the feeds to the subscribers of their users.
+// Each subscriber has a bounded buffer; publishing never waits for a subscriber,
+// and one whose buffer is full is dropped, so a slow client cannot hold back the
+// consumers. A dropped client can read the posts it missed with FEED and subscribe
+// again.
+type broker struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+	buffer      int // capacity of the buffer of each subscriber
+}
+
+// subscriber is a client of the broker
+type subscriber struct {
+	users   map[int]bool   // users whose posts the subscriber gets (nil = every user)
+	events  chan postEvent // closed when the subscriber is dropped or the broker closes
+	dropped bool           // the subscriber was dropped for being too slow
+}
+
+// newBroker creates a broker with the given buffer per subscriber (0 = default)
+func newBroker(buffer int) *broker {
+	if buffer <= 0 {
+		buffer = defaultEventsBuffer
+	}
+	return &broker{subscribers: make(map[*subscriber]bool), buffer: buffer}
+}
+
+// subscribe adds a subscriber to the posts of the given users (nil = every user)
+func (b *broker) subscribe(users map[int]bool) *subscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := &subscriber{users: users, events: make(chan postEvent, b.buffer)}
+	b.subscribers[sub] = true
+	return sub
+}
+
+// unsubscribe removes a subscriber, if it was not dropped already
+func (b *broker) unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// publish sends the event of a new post to its subscribers. It is a no-op on a nil
+// broker, so the server can publish whether subscriptions are enabled or not.
+func (b *broker) publish(event postEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers {
+		if sub.users != nil && !sub.users[event.User] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// Slow consumer: drop it rather than wait or lose events silently
+			delete(b.subscribers, sub)
+			sub.dropped = true
+			close(sub.events)
+		}
+	}
+}
+
+// close ends every subscription
+func (b *broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// ServeHTTP streams the new posts as Server-Sent Events: a "post" event with the
+// JSON of the post for each new post of the users given by the user query
+// parameters (every user if there is none), and a final "dropped" event if the
+// client does not keep up
+func (b *broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var users map[int]bool
+	for _, param := range r.URL.Query()["user"] {
+		id, err := strconv.Atoi(param)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid user %q", param), http.StatusBadRequest)
+			return
+		}
+		if users == nil {
+			users = make(map[int]bool)
+		}
+		users[id] = true
+	}
+
+	sub := b.subscribe(users)
+	defer b.unsubscribe(sub)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				if sub.dropped {
+					fmt.Fprint(w, "event: dropped\ndata: {}\n\n")
+					flusher.Flush()
+				}
+				return
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: post\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// startEvents starts the HTTP endpoint of the subscriptions, GET /subscribe, on
+// config.EventsAddr if it is set, and makes users publish the posts added to them.
+// A SUBSCRIBE request of the JSON protocol is only acknowledged: the events come
+// from GET /subscribe. The returned function ends the subscriptions and stops the
+// endpoint.
+func startEvents(config Config, users *userMap) (func(), error) {
+	if config.EventsAddr == "" {
+		return func() {}, nil
+	}
+	listener, err := net.Listen("tcp", config.EventsAddr)
+	if err != nil {
+		return nil, err
+	}
+	events := newBroker(config.EventsBuffer)
+	users.events = events
+
+	mux := http.NewServeMux()
+	mux.Handle("/subscribe", events)
+	httpServer := &http.Server{Handler: mux}
+	go httpServer.Serve(listener)
+	return func() {
+		events.close() // Lets the streaming handlers return
+		httpServer.Close()
+	}, nil
+}
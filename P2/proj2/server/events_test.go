@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"proj2/feed"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readEvent reads the next event of an SSE stream and returns its type and data
+func readEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	t.Helper()
+	var kind, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && kind != "":
+			return kind, data
+		case strings.HasPrefix(line, "event: "):
+			kind = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// subscribeHTTP subscribes to the broker of server with the given query and waits
+// until the subscription is registered
+func subscribeHTTP(t *testing.T, server *httptest.Server, query string) *bufio.Reader {
+	t.Helper()
+	response, err := http.Get(server.URL + "/subscribe" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Got status %d and content type %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(response.Body)
+	if line, err := reader.ReadString('\n'); err != nil || line != ": subscribed\n" {
+		t.Fatalf("Got %q, %v before the events", line, err)
+	}
+	return reader
+}
+
+// TestSubscribe checks that both modes publish the posts of successful ADDs to the
+// subscribers of their user, and to the subscribers of every user
+func TestSubscribe(t *testing.T) {
+	for _, mode := range []string{"s", "p"} {
+		users := newUserMap(feed.NewFeed)
+		users.events = newBroker(0)
+		server := httptest.NewServer(users.events)
+
+		userOne := subscribeHTTP(t, server, "?user=1")
+		everyone := subscribeHTTP(t, server, "")
+
+		requests := []string{
+			`{"command": "ADD", "id": 1, "user": 2, "body": "two", "timestamp": 1}`,
+			`{"command": "REMOVE", "id": 2, "user": 2, "timestamp": 1}`,
+			`{"command": "ADD", "id": 3, "user": 1, "body": "one", "timestamp": 2}`,
+			`{"command": "SUBSCRIBE", "id": 4, "user": 1}`,
+		}
+		var out strings.Builder
+		config := Config{
+			Encoder:        json.NewEncoder(&out),
+			Decoder:        json.NewDecoder(strings.NewReader(strings.Join(requests, "\n"))),
+			ConsumersCount: 1, // One consumer keeps the order of the events
+		}
+		if mode == "s" {
+			runSequential(config, users)
+		} else {
+			runParallel(config, users)
+		}
+
+		if kind, data := readEvent(t, userOne); kind != "post" || data != `{"user":1,"body":"one","timestamp":2}` {
+			t.Errorf("%s: subscriber of user 1 got %s %s", mode, kind, data)
+		}
+		for _, expected := range []string{`{"user":2,"body":"two","timestamp":1}`, `{"user":1,"body":"one","timestamp":2}`} {
+			if kind, data := readEvent(t, everyone); kind != "post" || data != expected {
+				t.Errorf("%s: subscriber of every user got %s %s, expected %s", mode, kind, data, expected)
+			}
+		}
+		users.events.close()
+		server.Close()
+
+		// SUBSCRIBE is answered, but the subscriptions go through GET /subscribe
+		subscribed := false
+		decoder := json.NewDecoder(strings.NewReader(out.String()))
+		for decoder.More() {
+			var response testResponse
+			if err := decoder.Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.ID == 4 {
+				subscribed = true
+				if response.Success {
+					t.Errorf("%s: SUBSCRIBE succeeded", mode)
+				}
+			}
+		}
+		if !subscribed {
+			t.Errorf("%s: no response to SUBSCRIBE", mode)
+		}
+	}
+}
+
+// TestPublishOrder checks that the parallel version publishes the posts of a user in
+// the order it added them to the feed, which keeps posts sharing a timestamp in the
+// order they were added
+func TestPublishOrder(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		users := newUserMap(feed.NewFeed)
+		if dir != "" {
+			if err := users.recoverFrom(dir, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		users.events = newBroker(1000)
+		everyone := users.events.subscribe(nil)
+
+		var requests []string
+		for i := 0; i < 500; i++ {
+			request, _ := json.Marshal(map[string]interface{}{"command": "ADD", "id": i, "user": 1, "body": strconv.Itoa(i), "timestamp": 1})
+			requests = append(requests, string(request))
+		}
+		var out strings.Builder
+		runParallel(Config{
+			Encoder:        json.NewEncoder(&out),
+			Decoder:        json.NewDecoder(strings.NewReader(strings.Join(requests, "\n"))),
+			ConsumersCount: 8,
+		}, users)
+		users.events.close()
+		users.close()
+
+		var published []string
+		for event := range everyone.events {
+			published = append(published, event.Body)
+		}
+		var added []string
+		for _, p := range users.lookup(1).feed.GetAllPosts() {
+			added = append(added, p.Body())
+		}
+		if len(published) != 500 || !reflect.DeepEqual(published, added) {
+			t.Errorf("Data dir %q: published %d posts in another order than the feed", dir, len(published))
+		}
+	}
+}
+
+func TestSubscribeInvalidUser(t *testing.T) {
+	server := httptest.NewServer(newBroker(0))
+	defer server.Close()
+	response, err := http.Get(server.URL + "/subscribe?user=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Got status %d for an invalid user", response.StatusCode)
+	}
+}
+
+// TestSlowSubscriberDropped checks that a subscriber whose buffer is full is dropped
+// after the buffered events, while the others keep getting events
+func TestSlowSubscriberDropped(t *testing.T) {
+	b := newBroker(2)
+	slow := b.subscribe(nil)
+	other := b.subscribe(map[int]bool{2: true})
+	for i := 0; i < 3; i++ {
+		b.publish(postEvent{1, "post", float64(i)})
+	}
+	b.publish(postEvent{2, "post", 5})
+
+	var received []float64
+	for event := range slow.events {
+		received = append(received, event.Timestamp)
+	}
+	if len(received) != 2 || !slow.dropped {
+		t.Errorf("Slow subscriber got %v, dropped = %v", received, slow.dropped)
+	}
+	if event := <-other.events; event.User != 2 {
+		t.Errorf("Other subscriber got %+v", event)
+	}
+
+	// Unsubscribing a dropped subscriber, or one after close, is harmless
+	b.unsubscribe(slow)
+	b.close()
+	b.unsubscribe(other)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"proj2/queue"
+	"sync"
+	"time"
+)
+
+// defaultWriteTimeout is the time a client of Serve has to take a response
+const defaultWriteTimeout = 10 * time.Second
+
+// netServer is the state of Serve: the connected clients, each with the writer of
+// its responses, sharing one user map and one consumer pool
+type netServer struct {
+	mu      sync.Mutex
+	clients map[uint64]*netClient // client ID -> client
+	lastID  uint64                // ID of the last client connected
+	closing bool                  // the listener is closed, no more requests are read
+}
+
+// netClient is a connection of a client
+type netClient struct {
+	conn net.Conn
+	out  *responseWriter
+}
+
+// Serve runs the twitter server on the connections accepted by listener, which can
+// be a TCP or a Unix socket listener. Every connection speaks the protocol of Run,
+// newline-delimited JSON requests and responses, and its responses only go back to
+// it; DONE closes the connection. The connections share the users, the feeds and a
+// pool of config.ConsumersCount consumers (at least one). Config.Encoder,
+// Config.Decoder and Config.Mode are not used.
+//
+// A client that does not take a response within config.WriteTimeout is dropped: its
+// connection is closed, so the consumers writing to it cannot hold back the other
+// clients for longer than that.
+//
+// Serve returns once the listener is closed: it stops reading requests, answers
+// the requests already read and closes the connections. The error is that of
+// Accept, nil if the listener was closed.
+func Serve(listener net.Listener, config Config) error {
+	users, err := newUsers(config)
+	if err != nil {
+		return err
+	}
+	defer users.close()
+	stopEvents, err := startEvents(config, users)
+	if err != nil {
+		return err
+	}
+	defer stopEvents()
+
+	s := &netServer{clients: make(map[uint64]*netClient)}
+	consumers := config.ConsumersCount
+	if consumers < 1 {
+		consumers = 1
+	}
+	pool := startConsumers(consumers, users, s.route)
+	timeout := config.WriteTimeout
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+
+	var conns sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			s.shutdown()
+			conns.Wait()
+			pool.stop()
+			return err
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			s.serveConn(conn, pool, config.Ordered, timeout)
+		}()
+	}
+}
+
+// serveConn reads the requests of a connection until it ends, sends DONE or the
+// server shuts down, then waits for their responses and closes it
+func (s *netServer) serveConn(conn net.Conn, pool *consumerPool, ordered bool, timeout time.Duration) {
+	encoder := json.NewEncoder(&deadlineWriter{conn: conn, timeout: timeout})
+	client := &netClient{conn: conn, out: newResponseWriter(encoder, ordered)}
+	s.mu.Lock()
+	s.lastID++
+	id := s.lastID
+	s.clients[id] = client
+	if s.closing {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	requests := producer(pool, json.NewDecoder(conn), id)
+	client.out.waitFor(requests)
+
+	s.mu.Lock()
+	delete(s.clients, id)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+// deadlineWriter writes to a connection with a deadline, and closes it when a write
+// fails: the reads of its requests fail too, and its next responses are discarded
+// at once instead of waiting for the deadline again
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	n, err := w.conn.Write(p)
+	if err != nil {
+		w.conn.Close()
+	}
+	return n, err
+}
+
+// route returns the writer of the connection a task came from
+func (s *netServer) route(task *queue.Request) *responseWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A client is only removed once all its responses are written
+	return s.clients[task.Client].out
+}
+
+// shutdown stops reading requests: the pending reads of every connection fail at once
+func (s *netServer) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing = true
+	for _, client := range s.clients {
+		client.conn.SetReadDeadline(time.Now())
+	}
+}
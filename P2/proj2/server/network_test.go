@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServe runs Serve on a new listener and returns it and the result of Serve
+func startServe(t *testing.T, network, address string, config Config) (net.Listener, chan error) {
+	t.Helper()
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() { result <- Serve(listener, config) }()
+	return listener, result
+}
+
+// stopServe closes the listener and checks that Serve returns
+func stopServe(t *testing.T, listener net.Listener, result chan error) {
+	t.Helper()
+	listener.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve did not return after the listener was closed")
+	}
+}
+
+// exchange sends the requests on a new connection, then DONE, and returns the
+// responses in the order they arrived and whether the server closed the connection
+func exchange(t *testing.T, network, address string, requests ...map[string]interface{}) []testResponse {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	for _, request := range append(requests, map[string]interface{}{"command": "DONE"}) {
+		if err := encoder.Encode(request); err != nil {
+			t.Error(err)
+			return nil
+		}
+	}
+	var responses []testResponse
+	decoder := json.NewDecoder(conn)
+	for {
+		var response testResponse
+		if err := decoder.Decode(&response); err == io.EOF {
+			return responses // DONE closed the connection
+		} else if err != nil {
+			t.Error(err)
+			return responses
+		}
+		responses = append(responses, response)
+	}
+}
+
+// TestServeTCP runs concurrent clients that each post to their own user: every
+// client gets the responses to its requests only, and sees the posts of the others
+func TestServeTCP(t *testing.T) {
+	const clients = 8
+	const posts = 50
+	listener, result := startServe(t, "tcp", "127.0.0.1:0", Config{ConsumersCount: 4})
+	address := listener.Addr().String()
+
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			var requests []map[string]interface{}
+			for i := 0; i < posts; i++ {
+				requests = append(requests, map[string]interface{}{"command": "ADD", "id": c*1000 + i, "user": c, "body": "post", "timestamp": i})
+			}
+			responses := exchange(t, "tcp", address, requests...)
+			ids := make(map[int]bool)
+			for _, response := range responses {
+				if response.ID/1000 != c || !response.Success {
+					t.Errorf("Client %d got response %+v", c, response)
+				}
+				ids[response.ID] = true
+			}
+			if len(responses) != posts || len(ids) != posts {
+				t.Errorf("Client %d got %d responses to %d requests", c, len(responses), posts)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	// Another connection reads the feeds written by the first ones
+	var requests []map[string]interface{}
+	for c := 0; c < clients; c++ {
+		requests = append(requests, map[string]interface{}{"command": "FEED", "id": c, "user": c, "limit": 3})
+	}
+	for _, response := range exchange(t, "tcp", address, requests...) {
+		if got := feedTimestamps(response); !reflect.DeepEqual(got, []float64{49, 48, 47}) {
+			t.Errorf("Feed of user %d is %v", response.ID, got)
+		}
+	}
+	stopServe(t, listener, result)
+}
+
+// TestServeUnix checks a Unix socket and ordered responses on each connection
+func TestServeUnix(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "twitter.sock")
+	listener, result := startServe(t, "unix", address, Config{ConsumersCount: 8, Ordered: true})
+
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			var requests []map[string]interface{}
+			for i := 0; i < 200; i++ {
+				command := []string{"ADD", "CONTAINS", "FEED"}[i%3]
+				requests = append(requests, map[string]interface{}{"command": command, "id": i, "user": c, "body": "post", "timestamp": i})
+			}
+			responses := exchange(t, "unix", address, requests...)
+			for i, response := range responses {
+				if response.ID != i {
+					t.Errorf("Client %d: response %d has ID %d", c, i, response.ID)
+					return
+				}
+			}
+			if len(responses) != 200 {
+				t.Errorf("Client %d got %d responses", c, len(responses))
+			}
+		}(c)
+	}
+	wg.Wait()
+	stopServe(t, listener, result)
+}
+
+// TestServeShutdown checks that closing the listener answers the requests already
+// sent by a connected client, then closes its connection
+func TestServeShutdown(t *testing.T) {
+	listener, result := startServe(t, "tcp", "127.0.0.1:0", Config{ConsumersCount: 2})
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, `{"command": "ADD", "id": 1, "user": 1, "body": "post", "timestamp": 1}`)
+	decoder := json.NewDecoder(conn)
+	var response testResponse
+	if err := decoder.Decode(&response); err != nil || response.ID != 1 {
+		t.Fatalf("Got %+v, %v", response, err)
+	}
+
+	stopServe(t, listener, result)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := decoder.Decode(&response); err != io.EOF {
+		t.Errorf("Connection still open after the shutdown: %v", err)
+	}
+}
+
+// TestServeClientNotReading checks that a client that sends requests but does not
+// read its responses is dropped after the write timeout, without holding back the
+// other clients
+func TestServeClientNotReading(t *testing.T) {
+	config := Config{ConsumersCount: 2, WriteTimeout: 200 * time.Millisecond}
+	listener, result := startServe(t, "tcp", "127.0.0.1:0", config)
+	address := listener.Addr().String()
+
+	// Large FEED responses fill the socket buffers of the connection
+	slow, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	body := strings.Repeat("x", 64<<10)
+	fmt.Fprintf(slow, "{\"command\": \"ADD\", \"id\": 0, \"user\": 1, \"body\": %q, \"timestamp\": 1}\n", body)
+	go func() {
+		for i := 1; i <= 500; i++ {
+			if _, err := fmt.Fprintf(slow, "{\"command\": \"FEED\", \"id\": %d, \"user\": 1}\n", i); err != nil {
+				return // Dropped
+			}
+		}
+	}()
+
+	// Long enough for the responses to block the consumers and for the timeout
+	time.Sleep(time.Second)
+	done := make(chan []testResponse)
+	go func() {
+		done <- exchange(t, "tcp", address, map[string]interface{}{"command": "ADD", "id": 1, "user": 2, "body": "post", "timestamp": 1})
+	}()
+	select {
+	case responses := <-done:
+		if len(responses) != 1 || !responses[0].Success {
+			t.Errorf("Other client got %+v", responses)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client held back by a client that does not read")
+	}
+
+	// The slow client finds its connection closed once it reads
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.Copy(io.Discard, slow)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Error("Connection of the client that does not read is still open")
+	}
+	stopServe(t, listener, result)
+}
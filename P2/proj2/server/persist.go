@@ -0,0 +1,302 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"proj2/lock"
+	"proj2/wal"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Files of the persistent state, in Config.DataDir
+const (
+	logFile      = "wal.log"
+	snapshotFile = "snapshot.json"
+)
+
+// defaultSnapshotEvery is the number of log records between two snapshots
+const defaultSnapshotEvery = 1000
+
+// persistence makes the state of the server durable. Every successful ADD, REMOVE,
+// FOLLOW and UNFOLLOW is appended to the write-ahead log before it is acknowledged;
+// the records of concurrent consumers share their fsyncs (group commit). Every
+// snapshotEvery records the whole state is written to a snapshot and the log starts
+// over. On startup the snapshot is loaded and the log replayed on top of it.
+//
+// The log and the snapshot carry an epoch: a snapshot with epoch E holds every
+// record of the logs before epoch E, so a log with an older epoch (left by a crash
+// between writing a snapshot and resetting the log) is skipped.
+//
+// A failure of the log is fatal to the persistence: a mutation whose record could
+// not be made durable is already visible in memory, and after a failed reset the
+// records would go to a log that recovery skips. From then on no request is
+// served (see userMap.failure).
+type persistence struct {
+	dir           string
+	log           *wal.Log
+	epoch         uint64       // epoch of the current log and of the last snapshot
+	snapshotEvery int          // log records between two snapshots
+	checkpoint    *lock.RWLock // shared by mutations, exclusive while taking a snapshot
+	snapshotting  int32        // a consumer is taking a snapshot (atomic)
+
+	mu  sync.Mutex // guards err
+	err error      // sticky failure of the log
+}
+
+// logEntry is a log record of a mutation
+type logEntry struct {
+	Command   string  `json:"command"`
+	User      int     `json:"user"`
+	Followee  int     `json:"followee,omitempty"`
+	Body      string  `json:"body,omitempty"`
+	Timestamp float64 `json:"timestamp,omitempty"`
+}
+
+// snapshot is the whole state of the server
+type snapshot struct {
+	Epoch uint64                `json:"epoch"`
+	Users map[int]*userSnapshot `json:"users"`
+}
+
+// userSnapshot is the state of a user: its posts, most recent first, and followees
+type userSnapshot struct {
+	Posts     []snapshotPost `json:"posts,omitempty"`
+	Following []int          `json:"following,omitempty"`
+}
+
+// snapshotPost is a post of a snapshot
+type snapshotPost struct {
+	Body      string  `json:"body"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// recoverFrom restores the state saved in dir into the empty user map u, then makes the
+// following mutations of u durable
+func (u *userMap) recoverFrom(dir string, snapshotEvery int) error {
+	if snapshotEvery <= 0 {
+		snapshotEvery = defaultSnapshotEvery
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	snap := &snapshot{}
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err == nil {
+		if err := json.Unmarshal(data, snap); err != nil {
+			return fmt.Errorf("corrupt snapshot: %v", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	u.restore(snap)
+
+	log, epoch, records, err := wal.Open(filepath.Join(dir, logFile))
+	if err != nil {
+		return err
+	}
+	switch {
+	case epoch == snap.Epoch:
+		for _, record := range records {
+			var entry logEntry
+			if err := json.Unmarshal(record, &entry); err != nil {
+				log.Close()
+				return fmt.Errorf("corrupt log record: %v", err)
+			}
+			u.apply(entry)
+		}
+	case epoch < snap.Epoch:
+		// The snapshot already holds the records of this log
+		if err := log.Reset(snap.Epoch); err != nil {
+			log.Close()
+			return err
+		}
+	default:
+		log.Close()
+		return fmt.Errorf("log epoch %d is ahead of snapshot epoch %d", epoch, snap.Epoch)
+	}
+
+	u.persist = &persistence{
+		dir:           dir,
+		log:           log,
+		epoch:         snap.Epoch,
+		snapshotEvery: snapshotEvery,
+		checkpoint:    lock.NewRWLock(),
+	}
+	return nil
+}
+
+// apply replays a log record
+func (u *userMap) apply(entry logEntry) {
+	switch entry.Command {
+	case "ADD":
+		u.add(entry.User, entry.Body, entry.Timestamp)
+	case "REMOVE":
+		u.remove(entry.User, entry.Timestamp)
+	case "FOLLOW":
+		u.follow(entry.User, entry.Followee)
+	case "UNFOLLOW":
+		u.unfollow(entry.User, entry.Followee)
+	}
+}
+
+// restore loads a snapshot into the empty user map
+func (u *userMap) restore(snap *snapshot) {
+	for id, state := range snap.Users {
+		usr := u.get(id)
+		// Oldest first, so every post goes to the front of the feed
+		for i := len(state.Posts) - 1; i >= 0; i-- {
+			usr.feed.Add(state.Posts[i].Body, state.Posts[i].Timestamp)
+		}
+		for _, followee := range state.Following {
+			usr.following[followee] = true
+		}
+	}
+}
+
+// snapshot captures the state of every user. Mutations must be excluded by the caller.
+func (u *userMap) snapshot(epoch uint64) *snapshot {
+	u.rw.RLock()
+	defer u.rw.RUnlock()
+	snap := &snapshot{Epoch: epoch, Users: make(map[int]*userSnapshot, len(u.table))}
+	for id, usr := range u.table {
+		state := &userSnapshot{}
+		for _, p := range usr.feed.GetAllPosts() {
+			state.Posts = append(state.Posts, snapshotPost{p.Body(), p.Timestamp()})
+		}
+		usr.mu.Lock()
+		for followee := range usr.following {
+			state.Following = append(state.Following, followee)
+		}
+		usr.mu.Unlock()
+		sort.Ints(state.Following)
+		snap.Users[id] = state
+	}
+	return snap
+}
+
+// fail records the first failure of the log and reports it
+func (p *persistence) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		fmt.Fprintf(os.Stderr, "Persistence failed, no more requests are served: %v\n", err)
+	}
+}
+
+// failure returns the failure of the log of a persistent user map, nil if it has
+// none or the map is in memory only
+func (u *userMap) failure() error {
+	p := u.persist
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// mutate applies a mutation of usr and, if it changed the state, logs it. The
+// user's order lock keeps its log records, and the events published by apply, in
+// the order of its mutations, and the mutation is only acknowledged once its
+// record is durable. It returns the result of apply, or false if the record could
+// not be logged or the log failed before.
+func (u *userMap) mutate(usr *user, entry logEntry, apply func() bool) bool {
+	p := u.persist
+	if p == nil {
+		usr.order.Lock()
+		defer usr.order.Unlock()
+		return apply()
+	}
+
+	p.checkpoint.RLock()
+	if u.failure() != nil {
+		p.checkpoint.RUnlock()
+		return false
+	}
+	usr.order.Lock()
+	changed := apply()
+	var seq uint64
+	if changed {
+		data, _ := json.Marshal(entry)
+		seq = p.log.Enqueue(data)
+	}
+	usr.order.Unlock()
+	p.checkpoint.RUnlock()
+	if !changed {
+		return false
+	}
+
+	if err := p.log.Wait(seq); err != nil {
+		p.fail(fmt.Errorf("failed to log %s: %v", entry.Command, err))
+		return false
+	}
+	if p.log.Len() >= p.snapshotEvery && atomic.CompareAndSwapInt32(&p.snapshotting, 0, 1) {
+		if err := u.takeSnapshot(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to take snapshot: %v\n", err)
+		}
+		atomic.StoreInt32(&p.snapshotting, 0)
+	}
+	return true
+}
+
+// takeSnapshot writes the state to a new snapshot and starts a new log. Mutations
+// wait until it is done.
+func (u *userMap) takeSnapshot() error {
+	p := u.persist
+	p.checkpoint.Lock()
+	defer p.checkpoint.Unlock()
+
+	data, err := json.Marshal(u.snapshot(p.epoch + 1))
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(p.dir, snapshotFile), data); err != nil {
+		return err
+	}
+	// A crash here leaves a log older than the snapshot, which recovery skips
+	if err := p.log.Reset(p.epoch + 1); err != nil {
+		p.fail(fmt.Errorf("failed to reset the log: %v", err))
+		return err
+	}
+	p.epoch++
+	return nil
+}
+
+// close closes the log of a persistent user map
+func (u *userMap) close() error {
+	if u.persist == nil {
+		return nil
+	}
+	return u.persist.log.Close()
+}
+
+// writeFileAtomic replaces path by a file with the given content. The content is
+// synced before the rename, so a crash leaves either the old or the new file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return wal.SyncDir(filepath.Dir(path))
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"proj2/feed"
+	"proj2/queue"
+	"proj2/wal"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testResponse decodes the responses of the server
+type testResponse struct {
+	ID      int
+	Success bool
+	Feed    []struct {
+		User      int
+		Body      string
+		Timestamp float64
+	}
+	Next *Cursor
+}
+
+// runServer runs the server on the requests (one JSON object per line) with its
+// state in dir and returns the responses by ID
+func runServer(t *testing.T, dir, mode string, snapshotEvery int, requests ...string) map[int]testResponse {
+	t.Helper()
+	var out bytes.Buffer
+	Run(Config{
+		Encoder:        json.NewEncoder(&out),
+		Decoder:        json.NewDecoder(strings.NewReader(strings.Join(requests, "\n"))),
+		Mode:           mode,
+		ConsumersCount: 4,
+		DataDir:        dir,
+		SnapshotEvery:  snapshotEvery,
+	})
+	responses := make(map[int]testResponse)
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var response testResponse
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		responses[response.ID] = response
+	}
+	return responses
+}
+
+// feedTimestamps returns the timestamps of a FEED or TIMELINE response
+func feedTimestamps(response testResponse) []float64 {
+	timestamps := []float64{}
+	for _, post := range response.Feed {
+		timestamps = append(timestamps, post.Timestamp)
+	}
+	return timestamps
+}
+
+// addRequests returns ADD requests for user 1 with the timestamps from..to-1
+func addRequests(from, to int) []string {
+	var requests []string
+	for i := from; i < to; i++ {
+		request, _ := json.Marshal(map[string]interface{}{"command": "ADD", "id": i, "user": 1, "body": "post", "timestamp": i})
+		requests = append(requests, string(request))
+	}
+	return requests
+}
+
+// TestRecoverFromLog checks that every mutation survives a restart in both modes
+func TestRecoverFromLog(t *testing.T) {
+	for _, mode := range []string{"s", "p"} {
+		dir := t.TempDir()
+		runServer(t, dir, mode, 0, append(addRequests(1, 6),
+			`{"command": "REMOVE", "id": 10, "user": 1, "timestamp": 2}`,
+			`{"command": "FOLLOW", "id": 11, "user": 2, "followee": 1}`,
+			`{"command": "FOLLOW", "id": 12, "user": 2, "followee": 3}`,
+			`{"command": "UNFOLLOW", "id": 13, "user": 2, "followee": 3}`,
+			`{"command": "ADD", "id": 14, "user": 3, "body": "hidden", "timestamp": 9}`,
+		)...)
+
+		responses := runServer(t, dir, mode, 0,
+			`{"command": "FEED", "id": 1, "user": 1}`,
+			`{"command": "TIMELINE", "id": 2, "user": 2}`,
+			`{"command": "CONTAINS", "id": 3, "user": 3, "timestamp": 9}`,
+		)
+		if got, want := feedTimestamps(responses[1]), []float64{5, 4, 3, 1}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: recovered feed %v, want %v", mode, got, want)
+		}
+		if got, want := feedTimestamps(responses[2]), []float64{5, 4, 3, 1}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: recovered timeline %v, want %v", mode, got, want)
+		}
+		if !responses[3].Success {
+			t.Errorf("%s: post of user 3 lost", mode)
+		}
+	}
+}
+
+// TestRecoverAfterTornWrite simulates a crash in the middle of writing a log record:
+// the torn record is dropped, every acknowledged one is kept and the log is usable
+func TestRecoverAfterTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	runServer(t, dir, "s", 0, addRequests(1, 4)...)
+
+	logPath := filepath.Join(dir, logFile)
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Length and checksum of a 60-byte record, but only part of its payload
+	file.Write([]byte{0, 0, 0, 60, 1, 2, 3, 4, '{', '"', 'c', 'o'})
+	file.Close()
+
+	runServer(t, dir, "p", 0, addRequests(4, 6)...)
+	responses := runServer(t, dir, "s", 0, `{"command": "FEED", "id": 1, "user": 1}`)
+	if got, want := feedTimestamps(responses[1]), []float64{5, 4, 3, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered feed %v, want %v", got, want)
+	}
+}
+
+// TestSnapshots checks that snapshots are taken and recovered together with the log
+// written after them
+func TestSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	runServer(t, dir, "p", 5, append(addRequests(1, 13),
+		`{"command": "FOLLOW", "id": 20, "user": 2, "followee": 1}`,
+	)...)
+
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		t.Fatalf("no snapshot taken: %v", err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil || snap.Epoch == 0 {
+		t.Fatalf("invalid snapshot (epoch %d): %v", snap.Epoch, err)
+	}
+
+	responses := runServer(t, dir, "s", 5, `{"command": "TIMELINE", "id": 1, "user": 2}`)
+	want := []float64{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+	if got := feedTimestamps(responses[1]); !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered timeline %v, want %v", got, want)
+	}
+}
+
+// TestStaleLogSkipped simulates a crash after writing a snapshot but before starting
+// the new log: the records of the old log are in the snapshot and must not be replayed
+func TestStaleLogSkipped(t *testing.T) {
+	dir := t.TempDir()
+	requests := addRequests(1, 4)
+	runServer(t, dir, "s", 3, requests...)
+
+	// Put back a log of the previous epoch holding the same records
+	logPath := filepath.Join(dir, logFile)
+	os.Remove(logPath)
+	log, epoch, _, err := wal.Open(logPath)
+	if err != nil || epoch != 0 {
+		t.Fatalf("epoch %d: %v", epoch, err)
+	}
+	for i := 1; i < 4; i++ {
+		record, _ := json.Marshal(logEntry{Command: "ADD", User: 1, Body: "post", Timestamp: float64(i)})
+		log.Append(record)
+	}
+	log.Close()
+
+	responses := runServer(t, dir, "s", 3, `{"command": "FEED", "id": 1, "user": 1}`)
+	if got, want := feedTimestamps(responses[1]), []float64{3, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered feed %v, want %v", got, want)
+	}
+}
+
+// handleAll runs the requests on users one after the other and returns the responses
+func handleAll(t *testing.T, users *userMap, requests ...queue.Request) []testResponse {
+	t.Helper()
+	var out bytes.Buffer
+	w := newResponseWriter(json.NewEncoder(&out), false)
+	for i := range requests {
+		handleTask(&requests[i], users, w)
+	}
+	var responses []testResponse
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var response testResponse
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+// TestLogFailureStopsServing checks that once a record cannot be logged, neither
+// that mutation nor any later request is acknowledged
+func TestLogFailureStopsServing(t *testing.T) {
+	users := newUserMap(feed.NewFeed)
+	if err := users.recoverFrom(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+	defer users.close()
+	add := queue.Request{Command: "ADD", ID: 1, User: 1, Body: "post", Timestamp: 1}
+	if responses := handleAll(t, users, add); !responses[0].Success {
+		t.Fatal("ADD failed before the log failed")
+	}
+
+	users.persist.log.Close() // Every later append fails
+	responses := handleAll(t, users,
+		queue.Request{Command: "ADD", ID: 2, User: 1, Body: "post", Timestamp: 2},
+		queue.Request{Command: "CONTAINS", ID: 3, User: 1, Timestamp: 1},
+		queue.Request{Command: "FEED", ID: 4, User: 1},
+		queue.Request{Command: "ADD", ID: 5, User: 1, Body: "post", Timestamp: 3},
+	)
+	if users.failure() == nil {
+		t.Error("No failure recorded")
+	}
+	for _, response := range responses {
+		if response.Success || len(response.Feed) != 0 {
+			t.Errorf("Request %d served after the log failed: %+v", response.ID, response)
+		}
+	}
+}
+
+// TestResetFailureStopsMutations checks that a snapshot whose log cannot be reset
+// stops the mutations, which would go to a log that recovery skips
+func TestResetFailureStopsMutations(t *testing.T) {
+	dir := t.TempDir()
+	users := newUserMap(feed.NewFeed)
+	if err := users.recoverFrom(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	handleAll(t, users, queue.Request{Command: "ADD", ID: 1, User: 1, Body: "post", Timestamp: 1})
+
+	users.persist.log.Close()
+	if err := users.takeSnapshot(); err == nil {
+		t.Fatal("Snapshot succeeded without a log")
+	}
+	if users.add(1, "post", 2) || users.failure() == nil {
+		t.Error("Mutation accepted after the log could not be reset")
+	}
+
+	// The snapshot holds the acknowledged post
+	restarted := newUserMap(feed.NewFeed)
+	if err := restarted.recoverFrom(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.close()
+	if usr := restarted.lookup(1); usr == nil || !usr.feed.Contains(1) || usr.feed.Contains(2) {
+		t.Error("Recovered state differs from the acknowledged one")
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// responseWriter serializes the responses of the consumers on one encoder, so each
+// response is written as a whole line. In ordered mode it also sends them in the
+// order of the requests: a response that finishes before the responses of earlier
+// requests waits in a reorder buffer keyed by the sequence number of its request.
+type responseWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	ordered bool
+	next    uint64                      // sequence number of the next response to send (ordered mode)
+	pending map[uint64]*pendingResponse // responses waiting for the earlier ones (ordered mode)
+
+	released uint64     // number of requests written or skipped
+	drained  *sync.Cond // signalled when a request is written or skipped
+}
+
+// pendingResponse is a response of the reorder buffer; skipped requests have none
+type pendingResponse struct {
+	response interface{}
+	skipped  bool
+}
+
+// newResponseWriter creates a writer on encoder. In ordered mode the sequence
+// numbers of the requests must be 0, 1, 2... and each must be written or skipped.
+func newResponseWriter(encoder *json.Encoder, ordered bool) *responseWriter {
+	w := &responseWriter{encoder: encoder, ordered: ordered, pending: make(map[uint64]*pendingResponse)}
+	w.drained = sync.NewCond(&w.mu)
+	return w
+}
+
+// waitFor blocks until n requests have been written or skipped
+func (w *responseWriter) waitFor(n uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.released < n {
+		w.drained.Wait()
+	}
+}
+
+// write sends the response to the request with sequence number seq
+func (w *responseWriter) write(seq uint64, response interface{}) {
+	w.release(seq, &pendingResponse{response: response})
+}
+
+// skip records that the request with sequence number seq has no response, so the
+// responses after it are not held back in ordered mode
+func (w *responseWriter) skip(seq uint64) {
+	w.release(seq, &pendingResponse{skipped: true})
+}
+
+// release sends a response, or buffers it until the responses before it are sent
+func (w *responseWriter) release(seq uint64, p *pendingResponse) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.released++
+	w.drained.Broadcast()
+	if !w.ordered {
+		if !p.skipped {
+			w.encoder.Encode(p.response)
+		}
+		return
+	}
+
+	w.pending[seq] = p
+	for {
+		next, ok := w.pending[w.next]
+		if !ok {
+			return
+		}
+		delete(w.pending, w.next)
+		w.next++
+		if !next.skipped {
+			w.encoder.Encode(next.response)
+		}
+	}
+}
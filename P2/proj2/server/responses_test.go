@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// writeAll writes the responses 0..n-1 from concurrent goroutines in a random order,
+// skipping the multiples of 7, and returns the IDs in the order they were sent
+func writeAll(t *testing.T, ordered bool, n int) []int {
+	var out bytes.Buffer
+	w := newResponseWriter(json.NewEncoder(&out), ordered)
+	var wg sync.WaitGroup
+	for _, seq := range rand.Perm(n) {
+		wg.Add(1)
+		go func(seq int) {
+			defer wg.Done()
+			if seq%7 == 0 {
+				w.skip(uint64(seq))
+			} else {
+				w.write(uint64(seq), Response{ID: seq, Success: true, Feed: []map[string]interface{}{{"body": "post", "timestamp": seq}}})
+			}
+		}(seq)
+	}
+	wg.Wait()
+
+	var ids []int
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var response testResponse
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatalf("Invalid response line after %d responses: %v", len(ids), err)
+		}
+		ids = append(ids, response.ID)
+	}
+	return ids
+}
+
+func TestUnorderedResponses(t *testing.T) {
+	ids := writeAll(t, false, 1000)
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if id%7 == 0 || seen[id] {
+			t.Errorf("Unexpected response %d", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 1000-143 {
+		t.Errorf("Got %d responses, expected %d", len(seen), 1000-143)
+	}
+}
+
+func TestOrderedResponses(t *testing.T) {
+	ids := writeAll(t, true, 1000)
+	var expected []int
+	for id := 0; id < 1000; id++ {
+		if id%7 != 0 {
+			expected = append(expected, id)
+		}
+	}
+	if len(ids) != len(expected) {
+		t.Fatalf("Got %d responses, expected %d", len(ids), len(expected))
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			t.Fatalf("Response %d has ID %d, expected %d", i, ids[i], expected[i])
+		}
+	}
+}
@@ -2,9 +2,13 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"os"
 	"proj2/feed"
 	"proj2/queue"
 	"sync"
+	"time"
 )
 
 type Config struct {
@@ -15,32 +19,83 @@ type Config struct {
 	// If Mode == "s"  then run the sequential version
 	// If Mode == "p"  then run the parallel version
 	// These are the only values for Version
-	ConsumersCount int // Represents the number of consumers to spawn
+	ConsumersCount int           // Represents the number of consumers to spawn
+	DataDir        string        // Directory of the write-ahead log and snapshots ("" = state is not persisted)
+	SnapshotEvery  int           // Log records between two snapshots (0 = default)
+	FeedKind       string        // Feed implementation, a key of feed.Constructors ("" = "coarse")
+	Ordered        bool          // Send the responses of the parallel version in the order of the requests
+	EventsAddr     string        // Address of the HTTP endpoint streaming new posts as Server-Sent Events ("" = none)
+	EventsBuffer   int           // Events buffered per subscriber before a slow one is dropped (0 = default)
+	WriteTimeout   time.Duration // Time a network client has to take a response before it is dropped (0 = default)
 }
 
 type Response struct {
 	ID      int         	// json:"id"
 	Success bool        	// json:"success,omitempty"
 	Feed    interface{} 	// json:"feed,omitempty"
+	Next    *Cursor     	// Position of the next page of a paginated FEED (nil = last page)
+}
+
+// Cursor is the position of the next page of a FEED, sent back as its before and
+// offset fields: the posts older than Before, and the posts at Before but the first
+// Offset of them, which were on the previous pages
+type Cursor struct {
+	Before float64
+	Offset int
 }
 
 // Run starts up the twitter server based on the configuration
 // information provided and only returns when the server is fully
 // shutdown.
 func Run(config Config) {
+	users, err := newUsers(config)	// Initialize the feeds of the users
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer users.close()
+
+	// Stream the new posts to the subscribers
+	stopEvents, err := startEvents(config, users)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer stopEvents()
+
 	// Run sequential
 	if config.Mode == "s" {
-		runSequential(config)
+		runSequential(config, users)
 	// Run parallel
 	} else if config.Mode == "p" {
-		runParallel(config)
+		runParallel(config, users)
 	}
 }
 
-// Sequential execution of requests
-func runSequential(config Config) {
-	twitterFeed := feed.NewFeed()		// Initialize the feed
+// newUsers creates the user map of the configuration, with the state of the
+// previous runs if it is persistent
+func newUsers(config Config) (*userMap, error) {
+	if config.FeedKind == "" {
+		config.FeedKind = "coarse"
+	}
+	newFeed, ok := feed.Constructors[config.FeedKind]
+	if !ok {
+		return nil, fmt.Errorf("unknown feed implementation %q", config.FeedKind)
+	}
+	users := newUserMap(newFeed)
 
+	// Recover the state of the previous runs
+	if config.DataDir != "" {
+		if err := users.recoverFrom(config.DataDir, config.SnapshotEvery); err != nil {
+			return nil, fmt.Errorf("failed to recover state from %s: %v", config.DataDir, err)
+		}
+	}
+	return users, nil
+}
+
+// Sequential execution of requests
+func runSequential(config Config, users *userMap) {
+	out := newResponseWriter(config.Encoder, false)	// Responses are in order anyway
 	for {
 		var task queue.Request
 		// Decode the next task
@@ -53,102 +108,183 @@ func runSequential(config Config) {
 			break
 		}
 
-		handleTask(&task, twitterFeed, config.Encoder)
+		handleTask(&task, users, out)
 	}
 }
 
 // Parallel execution of requests
-func runParallel(config Config) {
-	twitterFeed := feed.NewFeed()			// Init the feed
-	taskQueue := queue.NewLockFreeQueue()	// Init lock-free queue
-	cond := sync.NewCond(&sync.Mutex{})
-	done := false
-	wg := sync.WaitGroup{}
+func runParallel(config Config, users *userMap) {
+	out := newResponseWriter(config.Encoder, config.Ordered)	// Serialize (and order) the responses
+	pool := startConsumers(config.ConsumersCount, users, func(*queue.Request) *responseWriter { return out })
+
+	// Producer logic
+	producer(pool, config.Decoder, 0)
+
+	// Notify consumers to exit and wait for them
+	pool.stop()
+}
+
+// consumerPool is the task queue of the parallel version and the consumers
+// processing it. route gives the writer of the responses to a task.
+type consumerPool struct {
+	taskQueue *queue.LockFreeQueue
+	cond      *sync.Cond
+	done      bool
+	wg        sync.WaitGroup
+	users     *userMap
+	route     func(task *queue.Request) *responseWriter
+}
+
+// startConsumers spawns the consumers of a new pool
+func startConsumers(count int, users *userMap, route func(task *queue.Request) *responseWriter) *consumerPool {
+	pool := &consumerPool{
+		taskQueue: queue.NewLockFreeQueue(),	// Init lock-free queue
+		cond:      sync.NewCond(&sync.Mutex{}),
+		users:     users,
+		route:     route,
+	}
 
 	// Spawn consumers (goroutines)
-	for i := 0; i < config.ConsumersCount; i++ {
-		wg.Add(1)
+	for i := 0; i < count; i++ {
+		pool.wg.Add(1)
 		go func() {
-			defer wg.Done()	// Mark this goroutine as done
-			consumer(twitterFeed, taskQueue, cond, &done, config.Encoder)
+			defer pool.wg.Done()	// Mark this goroutine as done
+			pool.consumer()
 		}()
 	}
+	return pool
+}
 
-	// Producer logic
-	producer(taskQueue, cond, &done, config.Decoder)
+// enqueue adds a task to the queue and signals a waiting consumer
+func (pool *consumerPool) enqueue(task *queue.Request) {
+	pool.taskQueue.Enqueue(task)
+	pool.cond.Signal()
+}
 
+// stop lets the consumers finish the queued tasks and waits for them to exit
+func (pool *consumerPool) stop() {
 	// Notify consumers to exit
-	cond.L.Lock()
-	done = true
-	cond.Broadcast()		// Wake up all waiting consumers
-	cond.L.Unlock()
+	pool.cond.L.Lock()
+	pool.done = true
+	pool.cond.Broadcast()		// Wake up all waiting consumers
+	pool.cond.L.Unlock()
 
 	// Wait for all consumers to finish
-	wg.Wait()
+	pool.wg.Wait()
 }
 
-// Producer reads tasks and adds them to the queue
-func producer(taskQueue *queue.LockFreeQueue, cond *sync.Cond, done *bool, decoder *json.Decoder) {
-	for {
-		var task queue.Request
+// Producer reads the tasks of a client and adds them to the queue. It returns the
+// number of tasks added.
+func producer(pool *consumerPool, decoder *json.Decoder, client uint64) uint64 {
+	for seq := uint64(0); ; seq++ {
+		task := queue.Request{Seq: seq, Client: client}
 		if err := decoder.Decode(&task); err != nil {
-			break // Exit loop on EOF or error
+			return seq // Exit loop on EOF or error
 		}
 
 		if task.Command == "DONE" {
-			break
+			return seq
 		}
 
 		// Enqueue the task and signal a waiting consumer
-		taskQueue.Enqueue(&task)
-		cond.Signal()
+		pool.enqueue(&task)
 	}
 }
 
 // Consumer processes tasks from the queue
-func consumer(twitterFeed feed.Feed, taskQueue *queue.LockFreeQueue, cond *sync.Cond, done *bool, encoder *json.Encoder) {
+func (pool *consumerPool) consumer() {
 	for {
-		cond.L.Lock()
-		for taskQueue.IsEmpty() && !*done {
-			cond.Wait()
+		pool.cond.L.Lock()
+		for pool.taskQueue.IsEmpty() && !pool.done {
+			pool.cond.Wait()
 		}
 		// Exit if no more tasks and done is true
-		if *done && taskQueue.IsEmpty() {
-			cond.L.Unlock()
+		if pool.done && pool.taskQueue.IsEmpty() {
+			pool.cond.L.Unlock()
 			return 
 		}
 		// Dequeue a task
-		task, ok := taskQueue.Dequeue()
-		cond.L.Unlock()
+		task, ok := pool.taskQueue.Dequeue()
+		pool.cond.L.Unlock()
 
 		// Process task (if successfully dequeued)
 		if ok {
-			handleTask(task, twitterFeed, encoder)
+			handleTask(task, pool.users, pool.route(task))
 		}
 	}
 }
 
-// Handle a single task
-func handleTask(task *queue.Request, twitterFeed feed.Feed, encoder *json.Encoder) {
+// Handle a single task on the feed of its user
+func handleTask(task *queue.Request, users *userMap, out *responseWriter) {
+	if users.failure() != nil {
+		// The feeds may hold mutations that are not durable: refuse every request
+		out.write(task.Seq, Response{ID: task.ID})
+		return
+	}
 	switch task.Command {
 	case "ADD":
-		twitterFeed.Add(task.Body, task.Timestamp)
-		encoder.Encode(Response{Success: true, ID: task.ID})
+		success := users.add(task.User, task.Body, task.Timestamp)
+		out.write(task.Seq, Response{Success: success, ID: task.ID})
 	case "REMOVE":
-		success := twitterFeed.Remove(task.Timestamp)
-		encoder.Encode(Response{Success: success, ID: task.ID})
+		success := users.remove(task.User, task.Timestamp)
+		out.write(task.Seq, Response{Success: success, ID: task.ID})
 	case "CONTAINS":
-		success := twitterFeed.Contains(task.Timestamp)
-		encoder.Encode(Response{Success: success, ID: task.ID})
+		usr := users.lookup(task.User)
+		success := usr != nil && usr.feed.Contains(task.Timestamp)
+		out.write(task.Seq, Response{Success: success, ID: task.ID})
 	case "FEED":
 		posts := []map[string]interface{}{}
 
-		for _, p := range twitterFeed.GetAllPosts() {
+		// Optional cursors and page size: the posts between after and before,
+		// limit at most, and the cursor of the next page if some are left. Without
+		// an offset before excludes every post at it.
+		before, skip, after := math.Inf(1), 0, math.Inf(-1)
+		if task.Before != nil {
+			before, skip = *task.Before, math.MaxInt
+		}
+		if task.Offset != nil {
+			skip = *task.Offset
+		}
+		if task.After != nil {
+			after = *task.After
+		}
+		var next *Cursor
+		if usr := users.lookup(task.User); usr != nil {
+			page, more := usr.feed.Range(before, skip, after, task.Limit)
+			for _, p := range page {
+				posts = append(posts, map[string]interface{}{
+					"body":      p.Body(),
+					"timestamp": p.Timestamp(),
+				})
+			}
+			if more {
+				next = &Cursor{}
+				next.Before, next.Offset = feed.NextPage(page, before, skip)
+			}
+		}
+		out.write(task.Seq, Response{ID: task.ID, Feed: posts, Next: next})
+	case "FOLLOW":
+		success := users.follow(task.User, task.Followee)
+		out.write(task.Seq, Response{Success: success, ID: task.ID})
+	case "UNFOLLOW":
+		success := users.unfollow(task.User, task.Followee)
+		out.write(task.Seq, Response{Success: success, ID: task.ID})
+	case "TIMELINE":
+		posts := []map[string]interface{}{}
+
+		for _, p := range users.timeline(task.User) {
 			posts = append(posts, map[string]interface{}{
-				"body":      p.Body(),
-				"timestamp": p.Timestamp(),
+				"user":      p.author,
+				"body":      p.body,
+				"timestamp": p.timestamp,
 			})
 		}
-		encoder.Encode(Response{ID: task.ID, Feed: posts})
+		out.write(task.Seq, Response{ID: task.ID, Feed: posts})
+	case "SUBSCRIBE":
+		// The posts cannot be streamed in the responses: subscriptions are made with
+		// GET /subscribe on Config.EventsAddr instead (see broker.ServeHTTP)
+		out.write(task.Seq, Response{ID: task.ID})
+	default:
+		out.skip(task.Seq)	// Unknown commands get no response
 	}
 }
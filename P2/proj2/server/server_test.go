@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"proj2/feed"
+	"proj2/queue"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestFeedPages checks the limit, before and after fields of FEED and its next cursor.
+// The posts are added by a first run, so that the FEEDs of the parallel mode see all
+// of them.
+func TestFeedPages(t *testing.T) {
+	for _, mode := range []string{"s", "p"} {
+		dir := t.TempDir()
+		runServer(t, dir, mode, 0, addRequests(1, 11)...)
+		responses := runServer(t, dir, mode, 0,
+			`{"command": "FEED", "id": 20, "user": 1}`,
+			`{"command": "FEED", "id": 21, "user": 1, "limit": 4}`,
+			`{"command": "FEED", "id": 22, "user": 1, "limit": 4, "before": 7}`,
+			`{"command": "FEED", "id": 23, "user": 1, "limit": 4, "before": 3}`,
+			`{"command": "FEED", "id": 24, "user": 1, "after": 7}`,
+			`{"command": "FEED", "id": 25, "user": 1, "limit": 2, "before": 9, "after": 0}`,
+			`{"command": "FEED", "id": 26, "user": 1, "before": 0}`,
+			`{"command": "FEED", "id": 27, "user": 1, "limit": 2, "before": 7, "offset": 1}`,
+		)
+
+		cases := []struct {
+			id       int
+			expected []float64
+			next     *Cursor
+		}{
+			{20, []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, nil},
+			{21, []float64{10, 9, 8, 7}, &Cursor{7, 1}},
+			{22, []float64{6, 5, 4, 3}, &Cursor{3, 1}},
+			{23, []float64{2, 1}, nil},
+			{24, []float64{10, 9, 8}, nil},
+			{25, []float64{8, 7}, &Cursor{7, 1}},
+			{26, []float64{}, nil},
+			{27, []float64{6, 5}, &Cursor{5, 1}},
+		}
+		for _, c := range cases {
+			response := responses[c.id]
+			if got := feedTimestamps(response); !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("%s: FEED %d returned %v, expected %v", mode, c.id, got, c.expected)
+			}
+			if !reflect.DeepEqual(response.Next, c.next) {
+				t.Errorf("%s: FEED %d has next cursor %+v, expected %+v", mode, c.id, response.Next, c.next)
+			}
+		}
+	}
+}
+
+// TestFeedPagesTiedTimestamps pages through posts sharing timestamps with pages
+// that end between them: following the cursors returns every post once
+func TestFeedPagesTiedTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	var adds []string
+	var expected []string
+	for i := 0; i < 9; i++ {
+		body := fmt.Sprintf("post %d", i)
+		request, _ := json.Marshal(map[string]interface{}{"command": "ADD", "id": i, "user": 1, "body": body, "timestamp": 3 - i/3})
+		adds = append(adds, string(request))
+		expected = append(expected, body)
+	}
+	runServer(t, dir, "s", 0, adds...)
+
+	var got []string
+	request := map[string]interface{}{"command": "FEED", "id": 1, "user": 1, "limit": 2}
+	for page := 0; page < 10; page++ {
+		data, _ := json.Marshal(request)
+		response := runServer(t, dir, "p", 0, string(data))[1]
+		for _, post := range response.Feed {
+			got = append(got, post.Body)
+		}
+		if response.Next == nil {
+			break
+		}
+		request["before"], request["offset"] = response.Next.Before, response.Next.Offset
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Pages returned %q, expected %q", got, expected)
+	}
+}
+
+// TestOrderedServer checks that the parallel version with Ordered answers in the
+// order of the requests, including around unknown commands
+func TestOrderedServer(t *testing.T) {
+	var requests []string
+	for i := 0; i < 500; i++ {
+		user, timestamp := i%13, float64(i)
+		var request []byte
+		switch i % 5 {
+		case 0, 1:
+			request, _ = json.Marshal(map[string]interface{}{"command": "ADD", "id": i, "user": user, "body": "post", "timestamp": timestamp})
+		case 2:
+			request, _ = json.Marshal(map[string]interface{}{"command": "CONTAINS", "id": i, "user": user, "timestamp": timestamp - 2})
+		case 3:
+			request, _ = json.Marshal(map[string]interface{}{"command": "FEED", "id": i, "user": user})
+		case 4:
+			request, _ = json.Marshal(map[string]interface{}{"command": "UNKNOWN", "id": i})
+		}
+		requests = append(requests, string(request))
+	}
+
+	var out bytes.Buffer
+	Run(Config{
+		Encoder:        json.NewEncoder(&out),
+		Decoder:        json.NewDecoder(strings.NewReader(strings.Join(requests, "\n"))),
+		Mode:           "p",
+		ConsumersCount: 8,
+		Ordered:        true,
+	})
+	decoder := json.NewDecoder(&out)
+	expected := 0
+	for decoder.More() {
+		var response testResponse
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.ID != expected {
+			t.Fatalf("Got response %d, expected %d", response.ID, expected)
+		}
+		expected++
+		if expected%5 == 4 {
+			expected++ // No response to the unknown command
+		}
+	}
+	if expected != 500 {
+		t.Errorf("Got the responses up to %d of 500", expected)
+	}
+}
+
+// TestReadsDoNotCreateUsers checks that the requests that do not add posts or
+// followees leave unknown users out of the user map, and so out of the snapshots
+func TestReadsDoNotCreateUsers(t *testing.T) {
+	users := newUserMap(feed.NewFeed)
+	var requests []queue.Request
+	for i, command := range []string{"CONTAINS", "FEED", "TIMELINE", "REMOVE", "UNFOLLOW", "UNKNOWN"} {
+		requests = append(requests, queue.Request{Command: command, ID: i, User: 7, Followee: 8, Timestamp: 1})
+	}
+	for _, response := range handleAll(t, users, requests...) {
+		if response.Success || len(response.Feed) != 0 || response.Next != nil {
+			t.Errorf("Unknown user got %+v", response)
+		}
+	}
+	if len(users.table) != 0 {
+		t.Errorf("Read requests created %d users", len(users.table))
+	}
+}
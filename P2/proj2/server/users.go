@@ -0,0 +1,182 @@
+package server
+
+import (
+	"container/heap"
+	"proj2/feed"
+	"proj2/lock"
+	"sort"
+	"sync"
+)
+
+// userMap is the concurrent map from user ID to the user's feed and follow list.
+// Users are created by their first ADD or FOLLOW (or when someone follows them);
+// the other requests of an unknown user find an empty feed and follow list.
+type userMap struct {
+	rw      *lock.RWLock     // read/write lock guarding the map
+	table   map[int]*user    // user ID -> user
+	persist *persistence     // log and snapshots of the mutations (nil = in memory only)
+	newFeed func() feed.Feed // constructor of the feeds of new users
+	events  *broker          // subscribers to the new posts (nil = no subscriptions)
+}
+
+// user holds the feed of a user and the users they follow
+type user struct {
+	feed      feed.Feed
+	mu        sync.Mutex   // guards following
+	following map[int]bool // IDs of the followed users
+	order     sync.Mutex   // keeps the log records and the events of the user in the order of their mutations
+}
+
+// timelinePost is a post of a timeline together with its author
+type timelinePost struct {
+	author    int
+	body      string
+	timestamp float64
+}
+
+// newUserMap creates an empty user map whose users get feeds made by newFeed
+func newUserMap(newFeed func() feed.Feed) *userMap {
+	return &userMap{rw: lock.NewRWLock(), table: make(map[int]*user), newFeed: newFeed}
+}
+
+// lookup returns the user with the given ID, or nil if there is none
+func (u *userMap) lookup(id int) *user {
+	u.rw.RLock()
+	defer u.rw.RUnlock()
+	return u.table[id]
+}
+
+// get returns the user with the given ID, creating them if needed
+func (u *userMap) get(id int) *user {
+	if usr := u.lookup(id); usr != nil {
+		return usr
+	}
+
+	u.rw.Lock()
+	defer u.rw.Unlock()
+	// Another request may have created the user in the meantime
+	if usr, ok := u.table[id]; ok {
+		return usr
+	}
+	usr := &user{feed: u.newFeed(), following: make(map[int]bool)}
+	u.table[id] = usr
+	return usr
+}
+
+// add adds a post to the feed of a user and publishes it to the subscribers
+func (u *userMap) add(id int, body string, timestamp float64) bool {
+	usr := u.get(id)
+	return u.mutate(usr, logEntry{Command: "ADD", User: id, Body: body, Timestamp: timestamp}, func() bool {
+		usr.feed.Add(body, timestamp)
+		u.events.publish(postEvent{id, body, timestamp})
+		return true
+	})
+}
+
+// remove removes a post from the feed of a user. It returns false if there was none.
+func (u *userMap) remove(id int, timestamp float64) bool {
+	usr := u.lookup(id)
+	if usr == nil {
+		return false
+	}
+	return u.mutate(usr, logEntry{Command: "REMOVE", User: id, Timestamp: timestamp}, func() bool {
+		return usr.feed.Remove(timestamp)
+	})
+}
+
+// follow makes follower follow followee. It returns false if it already did.
+func (u *userMap) follow(follower, followee int) bool {
+	u.get(followee)
+	usr := u.get(follower)
+	return u.mutate(usr, logEntry{Command: "FOLLOW", User: follower, Followee: followee}, func() bool {
+		usr.mu.Lock()
+		defer usr.mu.Unlock()
+		if usr.following[followee] {
+			return false
+		}
+		usr.following[followee] = true
+		return true
+	})
+}
+
+// unfollow makes follower stop following followee. It returns false if it did not follow them.
+func (u *userMap) unfollow(follower, followee int) bool {
+	usr := u.lookup(follower)
+	if usr == nil {
+		return false
+	}
+	return u.mutate(usr, logEntry{Command: "UNFOLLOW", User: follower, Followee: followee}, func() bool {
+		usr.mu.Lock()
+		defer usr.mu.Unlock()
+		if !usr.following[followee] {
+			return false
+		}
+		delete(usr.following, followee)
+		return true
+	})
+}
+
+// timeline merges the feeds of the users id follows, most recent post first.
+// Posts with the same timestamp are ordered by author ID.
+func (u *userMap) timeline(id int) []timelinePost {
+	usr := u.lookup(id)
+	if usr == nil {
+		return nil
+	}
+	usr.mu.Lock()
+	followees := make([]int, 0, len(usr.following))
+	for followee := range usr.following {
+		followees = append(followees, followee)
+	}
+	usr.mu.Unlock()
+	sort.Ints(followees)
+
+	// Every feed is already sorted, so a k-way merge of their snapshots suffices
+	merge := &timelineHeap{}
+	for _, followee := range followees {
+		var posts []timelinePost
+		for _, p := range u.lookup(followee).feed.GetAllPosts() {
+			posts = append(posts, timelinePost{author: followee, body: p.Body(), timestamp: p.Timestamp()})
+		}
+		if len(posts) > 0 {
+			*merge = append(*merge, posts)
+		}
+	}
+	heap.Init(merge)
+
+	var merged []timelinePost
+	for merge.Len() > 0 {
+		posts := (*merge)[0]
+		merged = append(merged, posts[0])
+		if len(posts) == 1 {
+			heap.Pop(merge)
+		} else {
+			(*merge)[0] = posts[1:]
+			heap.Fix(merge, 0)
+		}
+	}
+	return merged
+}
+
+// timelineHeap orders the remaining posts of every feed by their most recent post
+type timelineHeap [][]timelinePost
+
+func (h timelineHeap) Len() int { return len(h) }
+
+func (h timelineHeap) Less(i, j int) bool {
+	if h[i][0].timestamp != h[j][0].timestamp {
+		return h[i][0].timestamp > h[j][0].timestamp
+	}
+	return h[i][0].author < h[j][0].author
+}
+
+func (h timelineHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timelineHeap) Push(x interface{}) { *h = append(*h, x.([]timelinePost)) }
+
+func (h *timelineHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
@@ -1,14 +1,30 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
 	"os"
+	"os/signal"
 	"proj2/server"
 	"strconv"
+	"syscall"
 )
 
 func main() {
-	args := os.Args[1:]
+	// Optional persistence, feed implementation and network transport:
+	// twitter.go [-data dir] [-snapshot records] [-feed kind] [-ordered] [-network tcp|unix -listen address] [-events address] [consumers]
+	dataDir := flag.String("data", "", "directory of the write-ahead log and snapshots (default: state is not persisted)")
+	snapshotEvery := flag.Int("snapshot", 0, "log records between two snapshots (default 1000)")
+	feedKind := flag.String("feed", "coarse", "feed implementation: coarse, coupling, optimistic, lazy, lockfree or skiplist")
+	ordered := flag.Bool("ordered", false, "send the responses of the parallel version in the order of the requests")
+	network := flag.String("network", "tcp", "network of -listen: tcp or unix")
+	listen := flag.String("listen", "", "serve clients connecting to this address instead of stdin and stdout")
+	events := flag.String("events", "", "address of an HTTP endpoint streaming new posts as Server-Sent Events (GET /subscribe?user=id)")
+	flag.Parse()
+	args := flag.Args()
 
 	// Determine mode and number of consumers
 	mode := "s"
@@ -24,8 +40,36 @@ func main() {
 		Decoder:        json.NewDecoder(os.Stdin),
 		Mode:           mode,
 		ConsumersCount: consumers,
+		DataDir:        *dataDir,
+		SnapshotEvery:  *snapshotEvery,
+		FeedKind:       *feedKind,
+		Ordered:        *ordered,
+		EventsAddr:     *events,
 	}
 
 	// Run the server
-	server.Run(config)
+	if *listen == "" {
+		server.Run(config)
+		return
+	}
+	if err := serve(*network, *listen, config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the server on a network listener until SIGINT or SIGTERM
+func serve(network, address string, config server.Config) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	fmt.Fprintf(os.Stderr, "Listening on %s %s\n", network, listener.Addr())
+	return server.Serve(listener, config)
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type _TestUserAddRequest struct {
+	Command   string  `json:"command"`
+	Id        int64   `json:"id"`
+	User      int     `json:"user"`
+	Timestamp float64 `json:"timestamp"`
+	Body      string  `json:"body"`
+}
+type _TestUserRequest struct {
+	Command   string  `json:"command"`
+	Id        int64   `json:"id"`
+	User      int     `json:"user"`
+	Timestamp float64 `json:"timestamp,omitempty"`
+}
+type _TestFollowRequest struct {
+	Command  string `json:"command"`
+	Id       int64  `json:"id"`
+	User     int    `json:"user"`
+	Followee int    `json:"followee"`
+}
+
+type _TestTimelineResponse struct {
+	Id   int64               `json:"id"`
+	Feed []_TestTimelinePost `json:"feed"`
+}
+
+type _TestTimelinePost struct {
+	User      int     `json:"user"`
+	Body      string  `json:"body"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// _TestServer is a running twitter.go fed one batch of requests at a time, so that
+// even the parallel version has finished a batch before the next one starts
+type _TestServer struct {
+	cmd     *exec.Cmd
+	cancel  context.CancelFunc
+	stdin   io.WriteCloser
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+// startServer runs twitter.go sequentially (threads == "") or with the given consumers
+func startServer(t *testing.T, threads string) *_TestServer {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	args := []string{"run", "twitter.go"}
+	if threads != "" {
+		args = append(args, threads)
+	}
+	cmd := exec.CommandContext(ctx, "go", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal("<startServer>: error in getting stdout pipe.")
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal("<startServer>: error in getting stdin pipe.")
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal("<startServer> cmd.Start error in executing test.")
+	}
+	return &_TestServer{cmd, cancel, stdin, json.NewEncoder(stdin), json.NewDecoder(stdout)}
+}
+
+// batch sends the requests and returns the raw responses by id
+func (s *_TestServer) batch(t *testing.T, requests ...interface{}) map[int64]json.RawMessage {
+	for _, request := range requests {
+		if err := s.encoder.Encode(request); err != nil {
+			t.Fatal("<batch> cmd.encode error in executing test.")
+		}
+	}
+	responses := make(map[int64]json.RawMessage)
+	for range requests {
+		var raw json.RawMessage
+		if err := s.decoder.Decode(&raw); err != nil {
+			t.Fatalf("<batch> expected %d responses but got %d: %v", len(requests), len(responses), err)
+		}
+		var id struct {
+			Id int64 `json:"id"`
+		}
+		json.Unmarshal(raw, &id)
+		responses[id.Id] = raw
+	}
+	return responses
+}
+
+// stop sends the DONE request and waits for the server to exit
+func (s *_TestServer) stop(t *testing.T) {
+	defer s.cancel()
+	if err := s.encoder.Encode(_TestDoneRequest{"DONE"}); err != nil {
+		t.Fatal("<stop> cmd.encode error in executing test.")
+	}
+	if err := s.cmd.Wait(); err != nil {
+		t.Errorf("The automated test timed out. You may have a deadlock, starvation issue and/or you did not implement" +
+			" the necessary code for passing this test.")
+	}
+}
+
+// checkSuccess checks the success field of the normal responses
+func checkSuccess(t *testing.T, responses map[int64]json.RawMessage, expected map[int64]bool) {
+	for id, success := range expected {
+		var response _TestNormalResponse
+		if err := json.Unmarshal(responses[id], &response); err != nil {
+			t.Errorf("Invalid response for id %v: %s", id, responses[id])
+			continue
+		}
+		if response.Id != id || response.Success != success {
+			t.Errorf("Id and success fields do not match. Got(Id=%v,Success=%v), Expected(Id=%v,Success=%v)",
+				response.Id, response.Success, id, success)
+		}
+	}
+}
+
+// checkTimeline checks the posts of a TIMELINE or FEED response
+func checkTimeline(t *testing.T, raw json.RawMessage, expected []_TestTimelinePost) {
+	var response _TestTimelineResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		t.Fatalf("Invalid timeline response: %s", raw)
+	}
+	if len(response.Feed) == 0 && len(expected) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(response.Feed, expected) {
+		t.Errorf("Timeline does not match.\nGot:%v\nExpected:%v", response.Feed, expected)
+	}
+}
+
+// forEachMode runs a test against the sequential and the parallel version
+func forEachMode(t *testing.T, test func(t *testing.T, threads string)) {
+	for _, threads := range []string{"", "4"} {
+		name := "s"
+		if threads != "" {
+			name = "p" + threads
+		}
+		t.Run(name, func(t *testing.T) { test(t, threads) })
+	}
+}
+
+// FollowRequests
+// Action(s):
+// 1. User 1 follows users 2 and 3, which should both succeed
+// 2. Following user 2 again and unfollowing user 4 (never followed) should fail
+// 3. Unfollowing user 3 should succeed once
+func TestFollowRequests(t *testing.T) {
+	forEachMode(t, func(t *testing.T, threads string) {
+		server := startServer(t, threads)
+		checkSuccess(t, server.batch(t,
+			_TestFollowRequest{"FOLLOW", 0, 1, 2},
+			_TestFollowRequest{"FOLLOW", 1, 1, 3},
+		), map[int64]bool{0: true, 1: true})
+		checkSuccess(t, server.batch(t,
+			_TestFollowRequest{"FOLLOW", 2, 1, 2},
+			_TestFollowRequest{"UNFOLLOW", 3, 1, 4},
+			_TestFollowRequest{"UNFOLLOW", 4, 1, 3},
+		), map[int64]bool{2: false, 3: false, 4: true})
+		checkSuccess(t, server.batch(t,
+			_TestFollowRequest{"UNFOLLOW", 5, 1, 3},
+		), map[int64]bool{5: false})
+		server.stop(t)
+	})
+}
+
+// TimelineRequest
+// Action(s):
+//  1. Users 1, 2 and 3 add posts with interleaved timestamps; user 0 follows users 1 and 3
+//  2. The timeline of user 0 merges the posts of users 1 and 3 by timestamp, FEED and CONTAINS
+//     only see the posts of their own user, and user 0's own feed stays empty
+//  3. After unfollowing user 3 the timeline only has the posts of user 1
+func TestTimelineRequest(t *testing.T) {
+	forEachMode(t, func(t *testing.T, threads string) {
+		server := startServer(t, threads)
+
+		var requests []interface{}
+		posts := make(map[int][]_TestTimelinePost)
+		id := int64(0)
+		for i := 0; i < 20; i++ {
+			for user := 1; user <= 3; user++ {
+				timestamp := float64(i*3 + user)
+				body := strconv.Itoa(i*3 + user)
+				requests = append(requests, _TestUserAddRequest{"ADD", id, user, timestamp, body})
+				posts[user] = append(posts[user], _TestTimelinePost{user, body, timestamp})
+				id++
+			}
+		}
+		requests = append(requests, _TestFollowRequest{"FOLLOW", id, 0, 1}, _TestFollowRequest{"FOLLOW", id + 1, 0, 3})
+		id += 2
+		server.batch(t, requests...)
+
+		mostRecentFirst := func(posts []_TestTimelinePost) []_TestTimelinePost {
+			sort.Slice(posts, func(i, j int) bool { return posts[i].Timestamp > posts[j].Timestamp })
+			return posts
+		}
+		expected := mostRecentFirst(append(append([]_TestTimelinePost{}, posts[1]...), posts[3]...))
+		responses := server.batch(t,
+			_TestUserRequest{"TIMELINE", id, 0, 0},
+			_TestUserRequest{"FEED", id + 1, 2, 0},
+			_TestUserRequest{"FEED", id + 2, 0, 0},
+			_TestUserRequest{"CONTAINS", id + 3, 1, 2},
+			_TestUserRequest{"CONTAINS", id + 4, 2, 2},
+		)
+		checkTimeline(t, responses[id], expected)
+		// FEED responses carry no user field
+		userTwo := mostRecentFirst(append([]_TestTimelinePost{}, posts[2]...))
+		for i := range userTwo {
+			userTwo[i].User = 0
+		}
+		checkTimeline(t, responses[id+1], userTwo)
+		checkTimeline(t, responses[id+2], nil)
+		checkSuccess(t, responses, map[int64]bool{id + 3: false, id + 4: true})
+		id += 5
+
+		server.batch(t, _TestFollowRequest{"UNFOLLOW", id, 0, 3})
+		checkTimeline(t, server.batch(t, _TestUserRequest{"TIMELINE", id + 1, 0, 0})[id+1], mostRecentFirst(posts[1]))
+		server.stop(t)
+	})
+}
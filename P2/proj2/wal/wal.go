@@ -0,0 +1,293 @@
+// Package wal provides an append-only write-ahead log with group commit.
+//
+// A log file is a sequence of records, each framed as a 4-byte length, a 4-byte
+// CRC-32 of the payload and the payload. The first record holds the epoch of the
+// log, which lets the owner tell which snapshot the log continues. Appends from
+// concurrent goroutines are written and fsynced in batches: the first appender
+// that finds no sync in progress writes every pending record with a single fsync
+// while the others wait for it, so N concurrent appends cost far fewer than N syncs.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// headerSize is the size of the length and checksum preceding every payload
+const headerSize = 8
+
+// maxRecordSize bounds the length of a record, so a corrupt length is not trusted
+const maxRecordSize = 64 << 20
+
+// ErrClosed is returned by appends to a closed log
+var ErrClosed = errors.New("wal: log is closed")
+
+// Log is an open write-ahead log
+type Log struct {
+	mu        sync.Mutex
+	cond      *sync.Cond // signalled when a batch has been synced
+	path      string
+	file      *os.File
+	pending   []byte // framed records not yet written
+	nextSeq   uint64 // sequence number of the last enqueued record
+	syncedSeq uint64 // sequence number of the last durable record
+	syncing   bool   // a goroutine is writing and syncing a batch
+	records   int    // records appended since the log was opened or reset
+	syncs     int    // fsyncs of appended records (for tests and statistics)
+	err       error  // sticky write error
+}
+
+// Open opens the log at path, creating it with epoch 0 if it does not exist. It
+// returns the epoch and the payloads of the complete records. A torn or corrupt
+// tail left by a crash in the middle of a write is truncated.
+func Open(path string) (*Log, uint64, [][]byte, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	payloads, valid, err := readRecords(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, nil, err
+	}
+
+	var epoch uint64
+	if len(payloads) == 0 || len(payloads[0]) != 8 {
+		// New log, or not even a complete header: start over
+		valid = 0
+		payloads = nil
+	} else {
+		epoch = binary.BigEndian.Uint64(payloads[0])
+		payloads = payloads[1:]
+	}
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, 0, nil, err
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, nil, err
+	}
+	if valid == 0 {
+		if _, err := file.Write(frame(nil, epochPayload(epoch))); err != nil {
+			file.Close()
+			return nil, 0, nil, err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, 0, nil, err
+	}
+
+	l := &Log{path: path, file: file, records: len(payloads)}
+	l.cond = sync.NewCond(&l.mu)
+	return l, epoch, payloads, nil
+}
+
+// readRecords reads the records of file and returns their payloads and the offset
+// just after the last complete, uncorrupted record
+func readRecords(file *os.File) ([][]byte, int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	reader := bufio.NewReader(file)
+	var payloads [][]byte
+	var valid int64
+	for {
+		var header [headerSize]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return payloads, valid, nil
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		if size > maxRecordSize {
+			return payloads, valid, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return payloads, valid, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return payloads, valid, nil
+		}
+		payloads = append(payloads, payload)
+		valid += headerSize + int64(size)
+	}
+}
+
+// frame appends the framed record of payload to buf
+func frame(buf, payload []byte) []byte {
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	return append(append(buf, header[:]...), payload...)
+}
+
+// epochPayload is the payload of the header record of a log
+func epochPayload(epoch uint64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, epoch)
+	return payload
+}
+
+// Enqueue adds a record to the next batch and returns its sequence number. The
+// record is durable once Wait returns for it. Callers that must log records in the
+// order they applied them enqueue while still holding their own lock, and wait after.
+func (l *Log) Enqueue(payload []byte) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = frame(l.pending, payload)
+	l.nextSeq++
+	l.records++
+	return l.nextSeq
+}
+
+// Wait blocks until the record with sequence number seq is written and synced
+func (l *Log) Wait(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.syncedSeq < seq && l.err == nil {
+		if l.syncing {
+			l.cond.Wait()
+			continue
+		}
+		l.flushLocked()
+	}
+	return l.err
+}
+
+// Append adds a record and returns once it is durable
+func (l *Log) Append(payload []byte) error {
+	return l.Wait(l.Enqueue(payload))
+}
+
+// flushLocked writes and syncs every pending record. It is called with l.mu held
+// and releases it during the I/O, so other appenders can queue the next batch.
+func (l *Log) flushLocked() {
+	batch, upTo := l.pending, l.nextSeq
+	l.pending = nil
+	l.syncing = true
+	l.mu.Unlock()
+
+	var err error
+	if l.file == nil {
+		err = ErrClosed
+	} else if _, err = l.file.Write(batch); err == nil {
+		err = l.file.Sync()
+	}
+
+	l.mu.Lock()
+	l.syncing = false
+	l.syncs++
+	if err != nil {
+		l.err = err
+	} else {
+		l.syncedSeq = upTo
+	}
+	l.cond.Broadcast()
+}
+
+// syncLocked makes every enqueued record durable, waiting for a sync in progress. It is
+// called with l.mu held.
+func (l *Log) syncLocked() error {
+	for (l.syncing || l.syncedSeq < l.nextSeq) && l.err == nil {
+		if l.syncing {
+			l.cond.Wait()
+			continue
+		}
+		l.flushLocked()
+	}
+	return l.err
+}
+
+// Reset makes the enqueued records durable, then atomically replaces the log by
+// an empty one with the given epoch. It is used once a snapshot holds the records.
+// If the replacement cannot be made durable the error is sticky: every later
+// append fails, since a crash could restore the old log and lose the records.
+func (l *Log) Reset(epoch uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.syncLocked(); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(frame(nil, epochPayload(epoch)))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// The new file is the log from now on, whether the rename is durable or not
+	l.file.Close()
+	l.file = tmp
+	l.records = 0
+	if err := syncDir(filepath.Dir(l.path)); err != nil {
+		// A crash could bring the old log back, so no record may be acknowledged
+		l.err = err
+		return err
+	}
+	return nil
+}
+
+// Len returns the number of records appended since the log was opened or reset,
+// including the records recovered by Open
+func (l *Log) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.records
+}
+
+// Syncs returns the number of fsyncs done for appended records
+func (l *Log) Syncs() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncs
+}
+
+// Close makes the enqueued records durable and closes the log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.syncLocked()
+	if l.file != nil {
+		if closeErr := l.file.Close(); err == nil {
+			err = closeErr
+		}
+		l.file = nil
+	}
+	if l.err == nil {
+		l.err = ErrClosed
+	}
+	return err
+}
+
+// syncDir is the SyncDir of Reset, replaced by tests to simulate failures
+var syncDir = SyncDir
+
+// SyncDir fsyncs a directory, making the creation and renaming of its files durable
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,245 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// appendAll opens the log at path, appends the payloads and closes it
+func appendAll(t *testing.T, path string, payloads ...string) {
+	t.Helper()
+	l, _, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range payloads {
+		if err := l.Append([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reopen opens the log at path and returns its epoch and payloads
+func reopen(t *testing.T, path string) (uint64, []string) {
+	t.Helper()
+	l, epoch, records, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var payloads []string
+	for _, record := range records {
+		payloads = append(payloads, string(record))
+	}
+	return epoch, payloads
+}
+
+func TestAppendAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	appendAll(t, path, "a", "", "ccc")
+	appendAll(t, path, "d")
+
+	epoch, payloads := reopen(t, path)
+	if epoch != 0 || !reflect.DeepEqual(payloads, []string{"a", "", "ccc", "d"}) {
+		t.Errorf("got epoch %d and %q", epoch, payloads)
+	}
+}
+
+// TestTruncatesTornTail simulates crashes in the middle of writing a record: the
+// incomplete record is dropped and the log keeps working after it
+func TestTruncatesTornTail(t *testing.T) {
+	cases := map[string]func(data []byte) []byte{
+		"partial header":  func(data []byte) []byte { return append(data, 0, 0, 0) },
+		"partial payload": func(data []byte) []byte { return frame(data, []byte("torn record"))[:len(data)+12] },
+		"bad checksum": func(data []byte) []byte {
+			data = frame(data, []byte("corrupt"))
+			data[len(data)-1] ^= 0xff
+			return data
+		},
+		"huge length": func(data []byte) []byte { return append(data, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1) },
+	}
+	for name, tear := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal.log")
+			appendAll(t, path, "first", "second")
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := len(data)
+			if err := os.WriteFile(path, tear(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, payloads := reopen(t, path); !reflect.DeepEqual(payloads, []string{"first", "second"}) {
+				t.Errorf("got %q after the torn write", payloads)
+			}
+			if info, err := os.Stat(path); err != nil || info.Size() != int64(size) {
+				t.Errorf("log not truncated to its %d valid bytes: %v, %v", size, info.Size(), err)
+			}
+			appendAll(t, path, "third")
+			if _, payloads := reopen(t, path); !reflect.DeepEqual(payloads, []string{"first", "second", "third"}) {
+				t.Errorf("got %q after appending to the truncated log", payloads)
+			}
+		})
+	}
+}
+
+// TestTornHeader checks that a log without a complete header starts over
+func TestTornHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	if err := os.WriteFile(path, frame(nil, epochPayload(7))[:5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if epoch, payloads := reopen(t, path); epoch != 0 || len(payloads) != 0 {
+		t.Errorf("got epoch %d and %q", epoch, payloads)
+	}
+}
+
+// TestGroupCommit checks that records enqueued while a sync is in progress are
+// written together with a single sync
+func TestGroupCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l, _, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend another appender is syncing, so every append has to wait
+	l.mu.Lock()
+	l.syncing = true
+	l.mu.Unlock()
+
+	const appenders = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, appenders)
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- l.Append([]byte(fmt.Sprint(i)))
+		}(i)
+	}
+	for l.Len() < appenders {
+	}
+
+	// The sync is over: one of the waiting appenders writes the whole batch
+	l.mu.Lock()
+	l.syncing = false
+	l.cond.Broadcast()
+	l.mu.Unlock()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if syncs := l.Syncs(); syncs != 1 {
+		t.Errorf("%d appends took %d syncs, want 1", appenders, syncs)
+	}
+	l.Close()
+
+	_, payloads := reopen(t, path)
+	sort.Strings(payloads)
+	var want []string
+	for i := 0; i < appenders; i++ {
+		want = append(want, fmt.Sprint(i))
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(payloads, want) {
+		t.Errorf("recovered %d of %d records", len(payloads), appenders)
+	}
+}
+
+// TestConcurrentAppends checks that no record of concurrent appenders is lost
+func TestConcurrentAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l, _, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := l.Append([]byte(fmt.Sprintf("%d-%d", g, i))); err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if syncs := l.Syncs(); syncs > 400 {
+		t.Errorf("400 appends took %d syncs", syncs)
+	}
+	l.Close()
+	if _, payloads := reopen(t, path); len(payloads) != 400 {
+		t.Errorf("recovered %d of 400 records", len(payloads))
+	}
+}
+
+func TestReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l, _, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := l.Enqueue([]byte("before"))
+	if err := l.Reset(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(seq); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 1 {
+		t.Errorf("Len = %d after reset and one append, want 1", l.Len())
+	}
+	l.Close()
+
+	if epoch, payloads := reopen(t, path); epoch != 5 || !reflect.DeepEqual(payloads, []string{"after"}) {
+		t.Errorf("got epoch %d and %q", epoch, payloads)
+	}
+	if err := l.Append([]byte("closed")); err != ErrClosed {
+		t.Errorf("append to a closed log returned %v", err)
+	}
+}
+
+// TestResetSyncDirFailure checks that a failed sync of the directory after the
+// rename leaves the log on the new file with a sticky error
+func TestResetSyncDirFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l, _, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := fmt.Errorf("sync failed")
+	syncDir = func(string) error { return failure }
+	defer func() { syncDir = SyncDir }()
+
+	if err := l.Reset(3); err != failure {
+		t.Fatalf("Reset returned %v", err)
+	}
+	if err := l.Append([]byte("lost")); err != failure {
+		t.Errorf("append after a failed reset returned %v", err)
+	}
+	if err := l.Close(); err != failure {
+		t.Errorf("Close returned %v", err)
+	}
+	if epoch, payloads := reopen(t, path); epoch != 3 || len(payloads) != 0 {
+		t.Errorf("got epoch %d and %q", epoch, payloads)
+	}
+}